@@ -12,10 +12,16 @@ var AddPeer = cmd.Sub{
 	Name:  "addpeer",
 	Alias: "ap",
 	Short: "Add a new peer dynamically",
+	Flags: &AddPeerFlags{},
 	Args:  &AddPeerArgs{},
 	Run:   AddPeerRun,
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type AddPeerFlags struct {
+	Persist bool `short:"p" long:"persist" desc:"Also write the new peer to the config file"`
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 type AddPeerArgs struct {
 	Name string `desc:"Name of the peer to add"`
@@ -26,6 +32,7 @@ type AddPeerArgs struct {
 func AddPeerRun(r *cmd.Root, c *cmd.Sub) {
 	// Parse Command Args
 	args := c.Args.(*AddPeerArgs)
+	flags := c.Flags.(*AddPeerFlags)
 	ifName := r.Flags.(*GlobalFlags).InterfaceName
 	if ifName == "" {
 		ifName = "mynetwork"
@@ -43,8 +50,9 @@ func AddPeerRun(r *cmd.Root, c *cmd.Sub) {
 
 	// Call RPC to add peer
 	rpcArgs := rpc.AddPeerArgs{
-		Name: args.Name,
-		ID:   args.ID,
+		Name:    args.Name,
+		ID:      args.ID,
+		Persist: flags.Persist,
 	}
 	reply := rpc.AddPeer(ifName, rpcArgs)
 
@@ -0,0 +1,241 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// CA manages the certificate authority of a network and installs its certificates on nodes.
+var CA = cmd.Sub{
+	Name:  "ca",
+	Short: "Issue and install membership certificates",
+	Args:  &CAArgs{},
+	Flags: &CAFlags{},
+	Run:   CARun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type CAArgs struct {
+	Action string   `desc:"init, sign, revoke or install"`
+	Args   []string `zero:"true"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// CAFlags contains the flags for the ca command.
+type CAFlags struct {
+	CAKey       string `short:"k" long:"ca-key" desc:"File holding the key of the network CA, ca.key by default."`
+	Passphrase  bool   `short:"p" long:"passphrase" desc:"Init: encrypt the key of the network CA with a passphrase."`
+	Name        string `short:"n" long:"name" desc:"Sign: name of the peer."`
+	Tags        string `short:"t" long:"tags" desc:"Sign: comma separated tags of the peer."`
+	Expires     string `short:"e" long:"expires" desc:"Sign: how long the certificate is valid, 8760h by default."`
+	Addr4       string `short:"4" long:"addr4" desc:"Sign: pin the IPv4 address of the peer."`
+	Addr6       string `short:"6" long:"addr6" desc:"Sign: pin the IPv6 address of the peer."`
+	Revocations string `short:"r" long:"revocations" desc:"Revoke: file holding the revocation list, ca.crl by default."`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func CARun(r *cmd.Root, c *cmd.Sub) {
+	args := c.Args.(*CAArgs)
+	flags := c.Flags.(*CAFlags)
+	if flags.CAKey == "" {
+		flags.CAKey = "ca.key"
+	}
+	if flags.Revocations == "" {
+		flags.Revocations = "ca.crl"
+	}
+	switch args.Action {
+	case "init":
+		caInit(flags)
+	case "sign":
+		caSign(flags, args.Args)
+	case "revoke":
+		caRevoke(flags, args.Args)
+	case "install":
+		caInstall(r, args.Args)
+	default:
+		fmt.Printf("Error: Unknown action %q\n", args.Action)
+		os.Exit(2)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// caInit creates the key of a new network CA.
+func caInit(flags *CAFlags) {
+	if _, err := os.Stat(flags.CAKey); err == nil {
+		checkErr(fmt.Errorf("%s already exists", flags.CAKey))
+	}
+	key, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 256)
+	checkErr(err)
+	var passphrase []byte
+	if flags.Passphrase {
+		passphrase, err = config.NewPassphrase()
+		checkErr(err)
+	}
+	encoded, err := config.EncodeKey(key, passphrase)
+	checkErr(err)
+	checkErr(os.WriteFile(flags.CAKey, []byte(encoded+"\n"), 0o600))
+
+	id, err := peer.IDFromPrivateKey(key)
+	checkErr(err)
+	fmt.Printf("Created the network CA in %s, keep it offline\n", flags.CAKey)
+	fmt.Printf("Set \"ca\": %q in the config of every node\n", id.String())
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// readCAKey loads the key of the network CA, asking for its passphrase if needed.
+func readCAKey(path string) crypto.PrivKey {
+	data, err := os.ReadFile(path)
+	checkErr(err)
+	key, _, err := config.DecodeKey(strings.TrimSpace(string(data)))
+	checkErr(err)
+	return key
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// caSign issues a certificate for a peer ID.
+func caSign(flags *CAFlags, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mynetwork ca sign <peer ID> --name <name> [--tags a,b] [--expires 8760h]")
+		os.Exit(2)
+	}
+	id, err := peer.Decode(args[0])
+	checkErr(err)
+	if flags.Name == "" {
+		checkErr(errors.New("a certificate needs a name, pass --name"))
+	}
+	validity := config.DefaultCertificateValidity
+	if flags.Expires != "" {
+		validity, err = time.ParseDuration(flags.Expires)
+		checkErr(err)
+	}
+	cert := &config.Certificate{
+		ID:      id,
+		Name:    flags.Name,
+		Issued:  time.Now().Truncate(time.Second),
+		Expires: time.Now().Add(validity).Truncate(time.Second),
+	}
+	var tags []string
+	for _, tag := range strings.Split(flags.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	cert.Tags, err = config.ParseTags(tags)
+	checkErr(err)
+	if flags.Addr4 != "" {
+		if cert.Addr4 = net.ParseIP(flags.Addr4).To4(); cert.Addr4 == nil {
+			checkErr(fmt.Errorf("invalid IPv4 address %q", flags.Addr4))
+		}
+	}
+	if flags.Addr6 != "" {
+		if cert.Addr6 = net.ParseIP(flags.Addr6); cert.Addr6 == nil || cert.Addr6.To4() != nil {
+			checkErr(fmt.Errorf("invalid IPv6 address %q", flags.Addr6))
+		}
+	}
+	checkErr(cert.Sign(readCAKey(flags.CAKey)))
+
+	fmt.Printf("Certificate for %s (/p2p/%s), valid until %s. Install it on that node with:\n\n",
+		cert.Name, cert.ID, cert.Expires.Local().Format(time.RFC1123))
+	fmt.Printf("  mynetwork ca install %s\n", cert)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// caRevoke adds peer IDs to the revocation list and signs it again.
+func caRevoke(flags *CAFlags, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: mynetwork ca revoke <peer ID>...")
+		os.Exit(2)
+	}
+	var revoked []peer.ID
+	if data, err := os.ReadFile(flags.Revocations); err == nil {
+		previous, err := config.ParseRevocationList(string(data))
+		checkErr(err)
+		revoked = previous.Revoked
+	} else if !errors.Is(err, os.ErrNotExist) {
+		checkErr(err)
+	}
+	for _, arg := range args {
+		id, err := peer.Decode(arg)
+		checkErr(err)
+		if !slices.Contains(revoked, id) {
+			revoked = append(revoked, id)
+		}
+	}
+
+	l, err := config.NewRevocationList(readCAKey(flags.CAKey), revoked)
+	checkErr(err)
+	checkErr(os.WriteFile(flags.Revocations, []byte(l.String()+"\n"), 0o644))
+
+	fmt.Printf("Revocation list with %d peer(s) written to %s. Install it on any node, it spreads to the others:\n\n",
+		len(l.Revoked), flags.Revocations)
+	fmt.Printf("  mynetwork ca install %s\n", l)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// caInstall puts a certificate or revocation list into the config of this node.
+func caInstall(r *cmd.Root, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mynetwork ca install <certificate or revocation list>")
+		os.Exit(2)
+	}
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = getDefaultConfigPath(ifName)
+	}
+	cfg, diags, err := config.Validate(configPath)
+	checkErr(err)
+	checkErr(diags.Err())
+
+	if config.IsCertificate(args[0]) {
+		cert, err := config.ParseCertificate(args[0])
+		checkErr(err)
+		self, err := peer.IDFromPrivateKey(cfg.PrivateKey)
+		checkErr(err)
+		if cert.ID != self {
+			checkErr(fmt.Errorf("the certificate is issued to %s, not to this node (/p2p/%s)", cert.ID, self))
+		}
+		// The first certificate brings the network CA along.
+		if cfg.CA == "" {
+			cfg.CA = cert.CA
+		}
+		checkErr(cfg.CheckCertificate(cert))
+		cfg.Certificate = cert
+		fmt.Printf("Installed the certificate of %s, valid until %s\n", cert.Name, cert.Expires.Local().Format(time.RFC1123))
+	} else {
+		l, err := config.ParseRevocationList(args[0])
+		checkErr(err)
+		changed, err := cfg.SetRevocations(l)
+		checkErr(err)
+		if !changed {
+			fmt.Println("A revocation list at least as recent is already installed")
+			return
+		}
+		fmt.Printf("Installed the revocation list with %d peer(s)\n", len(l.Revoked))
+	}
+	checkErr(cfg.Save())
+
+	// A running daemon applies the change right away and passes it on to its peers.
+	if rpc.Running(ifName) {
+		reply := rpc.Reload(ifName)
+		if !reply.Success {
+			fmt.Printf("Error: %s\n", reply.Message)
+			os.Exit(1)
+		}
+	}
+}
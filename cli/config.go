@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Config inspects an interface's config file without a running daemon.
+var Config = cmd.Sub{
+	Name:  "config",
+	Short: "Inspect an interface's config file",
+	Args:  &ConfigArgs{},
+	Flags: &ConfigFlags{},
+	Run:   ConfigRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ConfigArgs struct {
+	Action string `desc:"validate or show"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ConfigFlags contains the flags for the config command.
+type ConfigFlags struct {
+	Merged bool `short:"m" long:"merged" desc:"Show: merge the included drop-in files into the output."`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func ConfigRun(r *cmd.Root, c *cmd.Sub) {
+	args := c.Args.(*ConfigArgs)
+	flags := c.Flags.(*ConfigFlags)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = getDefaultConfigPath(ifName)
+	}
+
+	switch args.Action {
+	case "validate":
+		validateConfig(configPath)
+	case "show":
+		showConfig(configPath, flags.Merged)
+	default:
+		fmt.Printf("Error: Unknown action %q\n", args.Action)
+		os.Exit(2)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// validateConfig prints every problem found in a config file and exits with status 1 if any of them is an error.
+func validateConfig(path string) {
+	_, diags, err := config.Validate(path)
+	checkErr(err)
+	for _, d := range diags {
+		fmt.Println(d)
+	}
+	if diags.HasErrors() {
+		os.Exit(1)
+	}
+	if len(diags) == 0 {
+		fmt.Printf("%s is valid\n", path)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// showConfig prints a config file as the daemon reads it, with the effective settings and optionally with its drop-in
+// files merged in.
+func showConfig(path string, merged bool) {
+	cfg, diags, err := config.Validate(path)
+	checkErr(err)
+	checkErr(diags.Err())
+
+	var previous []byte
+	if !merged {
+		previous, _ = os.ReadFile(path)
+	}
+	out, err := cfg.Effective(merged)
+	checkErr(err)
+	// The notes go to stderr, so the output stays a valid config file.
+	for _, field := range slices.Sorted(maps.Keys(cfg.Settings.Overrides)) {
+		fmt.Fprintf(os.Stderr, "[!] %s is overridden by %s\n", field, cfg.Settings.Overrides[field])
+	}
+	data, err := cfg.Format.Marshal(out, previous)
+	checkErr(err)
+	fmt.Println(strings.TrimRight(string(data), "\n"))
+}
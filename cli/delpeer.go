@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var DelPeer = cmd.Sub{
+	Name:  "delpeer",
+	Alias: "dp",
+	Short: "Remove a peer dynamically",
+	Flags: &DelPeerFlags{},
+	Args:  &DelPeerArgs{},
+	Run:   DelPeerRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type DelPeerFlags struct {
+	Persist bool `short:"p" long:"persist" desc:"Also remove the peer from the config file"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type DelPeerArgs struct {
+	Peer string `desc:"Peer to remove (@name or peer ID prefix)"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func DelPeerRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*DelPeerArgs)
+	flags := c.Flags.(*DelPeerFlags)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+
+	if args.Peer == "" {
+		fmt.Println("Error: Peer is required")
+		return
+	}
+
+	reply := rpc.RemovePeer(ifName, rpc.RemovePeerArgs{
+		Peer:    args.Peer,
+		Persist: flags.Persist,
+	})
+
+	if reply.Success {
+		fmt.Printf("Success: %s\n", reply.Message)
+	} else {
+		fmt.Printf("Error: %s\n", reply.Message)
+	}
+}
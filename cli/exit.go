@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var Exit = cmd.Sub{
+	Name:  "exit",
+	Short: "Route all traffic through an exit node",
+	Args:  &ExitArgs{},
+	Run:   ExitRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ExitArgs struct {
+	Action string   `desc:"show, use or off"`
+	Peer   []string `zero:"true" desc:"Exit node to use (@name or peer ID prefix)"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func ExitRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*ExitArgs)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+
+	eArgs := rpc.ExitArgs{Action: rpc.ExitAction(args.Action)}
+	if eArgs.Action == rpc.ExitUse {
+		if len(args.Peer) != 1 {
+			fmt.Println("Error: Exactly one peer is required")
+			return
+		}
+		eArgs.Peer = args.Peer[0]
+	}
+
+	reply := rpc.Exit(ifName, eArgs)
+	if reply.Success {
+		fmt.Println(reply.Message)
+	} else {
+		fmt.Printf("Error: %s\n", reply.Message)
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/multiformats/go-multibase"
+	"github.com/soitun/mynetwork/config"
 	"github.com/soitun/mynetwork/schema"
 )
 
@@ -19,9 +20,27 @@ var Init = cmd.Sub{
 	Name:  "init",
 	Alias: "i",
 	Short: "Initialize An Interface Config",
+	Flags: &InitFlags{},
 	Run:   InitRun,
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// defaultListenAddresses are the listen addresses of new configs.
+var defaultListenAddresses = []string{
+	"/ip4/0.0.0.0/tcp/8001",
+	"/ip4/0.0.0.0/udp/8001/quic-v1",
+	"/ip6/::/tcp/8001",
+	"/ip6/::/udp/8001/quic-v1",
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// InitFlags contains the flags for the init command.
+type InitFlags struct {
+	Format  string `short:"f" long:"format" desc:"Config file format: json, yaml or toml."`
+	KeyFile string `short:"k" long:"key-file" desc:"Store the private key in this file, relative to the config file."`
+	Encrypt bool   `short:"e" long:"encrypt" desc:"Encrypt the private key with a passphrase."`
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // InitRun handles the execution of the init command.
 func InitRun(r *cmd.Root, c *cmd.Sub) {
@@ -30,32 +49,54 @@ func InitRun(r *cmd.Root, c *cmd.Sub) {
 		ifName = "mynetwork"
 	}
 
+	// Without --format, the format follows the extension of a custom config path.
 	configPath := r.Flags.(*GlobalFlags).Config
+	format := config.DetectFormat(configPath, nil)
+	if name := c.Flags.(*InitFlags).Format; name != "" {
+		var err error
+		format, err = config.ParseFormat(name)
+		checkErr(err)
+		// The config is read back in the format its extension names.
+		if ext, ok := config.ExtensionFormat(configPath); ok && ext != format {
+			checkErr(fmt.Errorf("%s is a %s file, name it %s to write %s", configPath, ext,
+				strings.TrimSuffix(configPath, filepath.Ext(configPath))+format.Extension(), format))
+		}
+	}
 	if configPath == "" {
-		configPath = getDefaultConfigPath(ifName)
+		configPath = getConfigBase(ifName) + format.Extension()
 	}
 
 	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 256)
 	checkErr(err)
 
-	keyBytes, err := crypto.MarshalPrivateKey(privKey)
+	var passphrase []byte
+	if c.Flags.(*InitFlags).Encrypt {
+		passphrase, err = config.NewPassphrase()
+		checkErr(err)
+	}
+	encodedKey, err := config.EncodeKey(privKey, passphrase)
 	checkErr(err)
 
 	// Setup an initial default config.
 	new := schema.Config{
-		PrivateKey: multibase.MustNewEncoder(multibase.Base58BTC).Encode(keyBytes),
-		ListenAddresses: []string{
-			"/ip4/0.0.0.0/tcp/8001",
-			"/ip4/0.0.0.0/udp/8001/quic-v1",
-			"/ip6/::/tcp/8001",
-			"/ip6/::/udp/8001/quic-v1",
-		},
+		PrivateKey:      encodedKey,
+		ListenAddresses: defaultListenAddresses,
 	}
 
-	out, err := json.MarshalIndent(&new, "", "  ")
+	err = os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
 	checkErr(err)
 
-	err = os.MkdirAll(filepath.Dir(configPath), os.ModePerm)
+	if keyFile := c.Flags.(*InitFlags).KeyFile; keyFile != "" {
+		new.PrivateKey, new.PrivateKeyFile = "", keyFile
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(configPath), keyFile)
+		}
+		err = os.WriteFile(keyFile, []byte(encodedKey+"\n"), 0o600)
+		checkErr(err)
+		fmt.Printf("Private key written to %s\n", keyFile)
+	}
+
+	out, err := format.Marshal(new, nil)
 	checkErr(err)
 
 	f, err := os.Create(configPath)
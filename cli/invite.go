@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+	"github.com/soitun/mynetwork/rpc"
+	"github.com/soitun/mynetwork/schema"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Invite issues a token that lets a new node join the network.
+var Invite = cmd.Sub{
+	Name:  "invite",
+	Short: "Create a token for a new node to join the network",
+	Flags: &InviteFlags{},
+	Run:   InviteRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// InviteFlags contains the flags for the invite command.
+type InviteFlags struct {
+	Name    string `short:"n" long:"name" desc:"Name of the new peer, chosen by the new node if not given."`
+	Expires string `short:"e" long:"expires" desc:"How long the invite can be used, 24h by default."`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// InviteRun handles the execution of the invite command.
+func InviteRun(r *cmd.Root, c *cmd.Sub) {
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+	flags := c.Flags.(*InviteFlags)
+
+	expires := config.DefaultInviteExpiry
+	if flags.Expires != "" {
+		var err error
+		expires, err = time.ParseDuration(flags.Expires)
+		checkErr(err)
+	}
+
+	reply := rpc.Invite(ifName, rpc.InviteArgs{Name: flags.Name, Expires: expires})
+	if !reply.Success {
+		fmt.Printf("Error: %s\n", reply.Message)
+		os.Exit(1)
+	}
+	fmt.Printf("Run this on the new node before %s:\n\n", reply.Expires.Local().Format(time.RFC1123))
+	fmt.Printf("  mynetwork join %s\n\n", reply.Token)
+	fmt.Println("The invite can be used once, and only while this daemon is running.")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Join adds this node to a network with an invite.
+var Join = cmd.Sub{
+	Name:  "join",
+	Short: "Join a network with an invite token",
+	Args:  &JoinArgs{},
+	Flags: &JoinFlags{},
+	Run:   JoinRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type JoinArgs struct {
+	Token string `desc:"Invite token from mynetwork invite"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// JoinFlags contains the flags for the join command.
+type JoinFlags struct {
+	Name string `short:"n" long:"name" desc:"Name of this node, if the invite doesn't set one. The hostname by default."`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// JoinRun handles the execution of the join command.
+func JoinRun(r *cmd.Root, c *cmd.Sub) {
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+	token := c.Args.(*JoinArgs).Token
+	name := c.Flags.(*JoinFlags).Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	// A running daemon joins with its own node and applies the new peer right away.
+	if rpc.Running(ifName) {
+		reply := rpc.Join(ifName, rpc.JoinArgs{Token: token, Name: name})
+		if !reply.Success {
+			fmt.Printf("Error: %s\n", reply.Message)
+			os.Exit(1)
+		}
+		fmt.Println(reply.Message)
+		return
+	}
+
+	inv, err := config.ParseInvite(token)
+	checkErr(err)
+
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = getDefaultConfigPath(ifName)
+	}
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		checkErr(createJoinConfig(configPath, inv))
+		fmt.Printf("Initialized new config at %s\n", configPath)
+	}
+	cfg, diags, err := config.Validate(configPath)
+	checkErr(err)
+	checkErr(diags.Err())
+	inviterName, err := cfg.CheckInvite(inv)
+	checkErr(err)
+
+	fmt.Printf("Contacting %s (/p2p/%s)...\n", inviterName, inv.Inviter)
+	res, err := p2p.JoinWithKey(context.Background(), cfg.PrivateKey, inv, name)
+	checkErr(err)
+	addr4, addr6, _ := p2p.ApplyJoin(cfg, inv, res)
+	checkErr(cfg.AddPeerWithAddrs(inviterName, inv.Inviter, addr4, addr6))
+	checkErr(cfg.Save())
+
+	fmt.Printf("Joined the network of %s as %s, start the interface with `mynetwork up`\n", inviterName, res.Name)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// createJoinConfig writes a new config with a fresh key and the overlay ranges of the network of an invite.
+func createJoinConfig(configPath string, inv *config.Invite) error {
+	privKey, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 256)
+	if err != nil {
+		return err
+	}
+	encodedKey, err := config.EncodeKey(privKey, nil)
+	if err != nil {
+		return err
+	}
+	new := schema.Config{
+		PrivateKey:      encodedKey,
+		ListenAddresses: defaultListenAddresses,
+	}
+	if inv.Net4.String() != config.DefaultNet4.String() {
+		new.Network4 = inv.Net4.String()
+	}
+	if inv.Net6.String() != config.DefaultNet6.String() {
+		new.Network6 = inv.Net6.String()
+	}
+	if inv.ServiceNet.String() != config.DefaultServiceNet.String() {
+		new.ServiceNetwork = inv.ServiceNet.String()
+	}
+
+	out, err := config.DetectFormat(configPath, nil).Marshal(new, nil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, out, 0o600)
+}
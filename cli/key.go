@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Key manages the private key of an interface.
+var Key = cmd.Sub{
+	Name:  "key",
+	Short: "Rotate or convert the private key of an interface",
+	Args:  &KeyArgs{},
+	Flags: &KeyFlags{},
+	Run:   KeyRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type KeyArgs struct {
+	Action string `desc:"rotate or convert"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyFlags contains the flags for the key command.
+type KeyFlags struct {
+	Grace   string `short:"g" long:"grace" desc:"How long peers keep accepting the previous key, 168h by default."`
+	Encrypt bool   `short:"e" long:"encrypt" desc:"Convert: encrypt the private key with a new passphrase."`
+	Decrypt bool   `short:"d" long:"decrypt" desc:"Convert: store the private key in plain text."`
+	KeyFile string `short:"k" long:"key-file" desc:"Convert: move the private key into this file, relative to the config file."`
+	Inline  bool   `short:"l" long:"inline" desc:"Convert: move the private key back into the config file."`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func KeyRun(r *cmd.Root, c *cmd.Sub) {
+	args := c.Args.(*KeyArgs)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+	switch args.Action {
+	case "rotate":
+	case "convert":
+		keyConvert(r, c.Flags.(*KeyFlags), ifName)
+		return
+	default:
+		fmt.Printf("Error: Unknown action %q\n", args.Action)
+		os.Exit(2)
+	}
+
+	grace := config.DefaultKeyGrace
+	if s := c.Flags.(*KeyFlags).Grace; s != "" {
+		var err error
+		grace, err = time.ParseDuration(s)
+		checkErr(err)
+	}
+
+	// A running daemon hands the new key to its connected peers right away.
+	if rpc.Running(ifName) {
+		reply := rpc.RotateKey(ifName, rpc.RotateKeyArgs{Grace: grace})
+		if !reply.Success {
+			fmt.Printf("Error: %s\n", reply.Message)
+			os.Exit(1)
+		}
+		fmt.Println(reply.Message)
+		fmt.Printf("Peers accept the previous key until %s\n", reply.Expires.Local().Format(time.RFC1123))
+		return
+	}
+
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = getDefaultConfigPath(ifName)
+	}
+	cfg, diags, err := config.Validate(configPath)
+	checkErr(err)
+	checkErr(diags.Err())
+	t, err := cfg.RotateKey(grace)
+	checkErr(err)
+	checkErr(cfg.Save())
+	fmt.Printf("Key rotated, the interface uses /p2p/%s from its next start\n", t.New)
+	fmt.Printf("Peers learn about the new key when they connect and accept the previous one until %s\n", t.Expires.Local().Format(time.RFC1123))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// keyConvert changes how the private key of an interface is stored.
+func keyConvert(r *cmd.Root, flags *KeyFlags, ifName string) {
+	if flags.Encrypt && flags.Decrypt || flags.KeyFile != "" && flags.Inline {
+		fmt.Println("Error: Conflicting flags")
+		os.Exit(2)
+	}
+	if !flags.Encrypt && !flags.Decrypt && flags.KeyFile == "" && !flags.Inline {
+		fmt.Println("Error: Nothing to convert, use --encrypt, --decrypt, --key-file or --inline")
+		os.Exit(2)
+	}
+	// The daemon would write its own view of the key back on its next save.
+	if rpc.Running(ifName) {
+		fmt.Println("Error: Stop the daemon before converting its key")
+		os.Exit(1)
+	}
+
+	configPath := r.Flags.(*GlobalFlags).Config
+	if configPath == "" {
+		configPath = getDefaultConfigPath(ifName)
+	}
+	cfg, diags, err := config.Validate(configPath)
+	checkErr(err)
+	checkErr(diags.Err())
+
+	previousFile := cfg.KeyFilePath()
+	if flags.KeyFile != "" {
+		cfg.SetKeyFile(flags.KeyFile)
+	} else if flags.Inline {
+		cfg.SetKeyFile("")
+	}
+	if flags.Encrypt {
+		passphrase, err := config.NewPassphrase()
+		checkErr(err)
+		cfg.SetKeyPassphrase(passphrase)
+	} else if flags.Decrypt {
+		cfg.SetKeyPassphrase(nil)
+	}
+	checkErr(cfg.Save())
+
+	state := "in plain text"
+	if cfg.KeyEncrypted() {
+		state = "encrypted"
+	}
+	if file := cfg.KeyFilePath(); file != "" {
+		fmt.Printf("Private key stored %s in %s\n", state, file)
+	} else {
+		fmt.Printf("Private key stored %s in %s\n", state, cfg.Path)
+	}
+	if previousFile != "" && previousFile != cfg.KeyFilePath() {
+		fmt.Printf("The previous key file %s is no longer used and can be deleted\n", previousFile)
+	}
+}
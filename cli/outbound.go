@@ -0,0 +1,310 @@
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/p2p"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	// outboundQueueLen bounds the number of packets waiting for a single peer. Packets beyond that are dropped,
+	// like on a full NIC ring, and left to the inner protocols to retransmit.
+	outboundQueueLen = 512
+	// streamRetryDelay is how long packets to a peer are dropped after opening a stream to it failed. A queue that
+	// stays idle for that long afterwards is taken down.
+	streamRetryDelay = 1 * time.Second
+	// maxBatchBytes and batchLinger limit how many queued packets get coalesced into a single stream write.
+	// A packet is never held back when nothing else is queued behind it.
+	maxBatchBytes = 32 * 1024
+	batchLinger   = 250 * time.Microsecond
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// packetPool recycles packet buffers between the TUN reader and the per-peer writers. They hold a packet of the MTU
+// of the TUN device.
+var packetPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, cfg.MTU)
+		return &b
+	},
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type outboundPacket struct {
+	buf  *[]byte
+	plen int
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// peerQueue holds the packets waiting for one peer. Only its writer goroutine touches the stream.
+type peerQueue struct {
+	dst        peer.ID
+	packets    chan outboundPacket
+	done       chan struct{}
+	stream     network.Stream
+	retryAfter time.Time
+	batch      []outboundPacket
+	streamed   []outboundPacket
+	frame      []byte
+	linger     *time.Timer
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// outboundQueues sends packets to peers with one queue and one writer goroutine per destination, which keeps
+// packets to the same peer in order. Packets go out as datagrams where possible, and over a stream otherwise.
+// Queues only exist while there is traffic to a peer, idle queues of disconnected peers are taken down.
+type outboundQueues struct {
+	ctx       context.Context
+	host      host.Host
+	datagrams *p2p.DatagramPlane
+	lock      sync.Mutex
+	queues    map[peer.ID]*peerQueue
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func newOutboundQueues(ctx context.Context, host host.Host, datagrams *p2p.DatagramPlane) *outboundQueues {
+	o := &outboundQueues{
+		ctx:       ctx,
+		host:      host,
+		datagrams: datagrams,
+		queues:    make(map[peer.ID]*peerQueue),
+	}
+	go o.reapDisconnected()
+	return o
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// send queues a packet for dst and takes ownership of buf, which goes back to the pool once written or dropped.
+func (o *outboundQueues) send(dst peer.ID, buf *[]byte, plen int) {
+	// Packets are queued under the lock, so none slips into a queue that close or reap already took down.
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	q, ok := o.queues[dst]
+	if !ok {
+		q = &peerQueue{
+			dst:     dst,
+			packets: make(chan outboundPacket, outboundQueueLen),
+			done:    make(chan struct{}),
+		}
+		o.queues[dst] = q
+		go o.run(q)
+	}
+
+	select {
+	case q.packets <- outboundPacket{buf, plen}:
+	default:
+		packetPool.Put(buf)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// close stops the writer for dst, drops the packets still queued for it and closes its stream and datagram
+// connection, if there are any.
+func (o *outboundQueues) close(dst peer.ID) {
+	o.lock.Lock()
+	q, ok := o.queues[dst]
+	delete(o.queues, dst)
+	o.lock.Unlock()
+	if ok {
+		close(q.done)
+	}
+	o.datagrams.Close(dst)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// reap takes q down if it is still the queue of its peer and has no packets waiting. The next packet to the peer
+// starts a new one.
+func (o *outboundQueues) reap(q *peerQueue) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.queues[q.dst] == q && len(q.packets) == 0 {
+		delete(o.queues, q.dst)
+		close(q.done)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// reapDisconnected takes down the idle queues of peers that disconnected, along with their dead streams.
+func (o *outboundQueues) reapDisconnected() {
+	sub, err := o.host.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		fmt.Println("[!] Failed to watch for disconnected peers: " + err.Error())
+		return
+	}
+	defer sub.Close()
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case ev := <-sub.Out():
+			evt := ev.(event.EvtPeerConnectednessChanged)
+			if evt.Connectedness == network.Connected {
+				continue
+			}
+			o.lock.Lock()
+			q, ok := o.queues[evt.Peer]
+			o.lock.Unlock()
+			if ok {
+				o.reap(q)
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (o *outboundQueues) run(q *peerQueue) {
+	// idle fires when no packet came in for streamRetryDelay after the stream to the peer failed.
+	idle := time.NewTimer(streamRetryDelay)
+	idle.Stop()
+	defer func() {
+		idle.Stop()
+		if q.stream != nil {
+			q.stream.Close()
+		}
+		// Packets still queued are dropped, their buffers go back to the pool.
+		for {
+			select {
+			case pkt := <-q.packets:
+				packetPool.Put(pkt.buf)
+			default:
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case <-q.done:
+			return
+		case <-idle.C:
+			o.reap(q)
+		case pkt := <-q.packets:
+			idle.Stop()
+			batch := q.collect(pkt)
+			if streamed := o.sendDatagrams(q, batch); len(streamed) > 0 {
+				o.write(q, streamed)
+				if q.stream == nil {
+					idle.Reset(streamRetryDelay)
+				}
+			}
+			for _, p := range batch {
+				packetPool.Put(p.buf)
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// collect gathers the packets queued behind first into one batch, until maxBatchBytes or batchLinger is reached.
+func (q *peerQueue) collect(first outboundPacket) []outboundPacket {
+	batch := append(q.batch[:0], first)
+	size := first.plen + 2
+	if q.linger == nil {
+		q.linger = time.NewTimer(batchLinger)
+	} else {
+		q.linger.Reset(batchLinger)
+	}
+	defer q.linger.Stop()
+
+Collect:
+	for size < maxBatchBytes {
+		select {
+		case pkt := <-q.packets:
+			batch = append(batch, pkt)
+			size += pkt.plen + 2
+			continue
+		default:
+		}
+		// An idle link sends right away, a busy one waits a moment for more packets.
+		if len(batch) == 1 {
+			break
+		}
+		select {
+		case pkt := <-q.packets:
+			batch = append(batch, pkt)
+			size += pkt.plen + 2
+		case <-q.linger.C:
+			break Collect
+		}
+	}
+	q.batch = batch
+	return batch
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// sendDatagrams sends what it can of batch as datagrams and returns the packets that still need a stream.
+func (o *outboundQueues) sendDatagrams(q *peerQueue, batch []outboundPacket) []outboundPacket {
+	streamed := q.streamed[:0]
+	for _, p := range batch {
+		if !o.datagrams.Send(q.dst, (*p.buf)[:p.plen]) {
+			streamed = append(streamed, p)
+		}
+	}
+	q.streamed = streamed
+	return streamed
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (o *outboundQueues) write(q *peerQueue, batch []outboundPacket) {
+	// A broken stream gets replaced once, then the batch is dropped.
+	for attempt := 0; attempt < 2; attempt++ {
+		if q.stream == nil {
+			if time.Now().Before(q.retryAfter) {
+				return
+			}
+			// Peers that only speak the original protocol get one packet per frame.
+			stream, err := o.host.NewStream(o.ctx, q.dst, p2p.BatchProtocol, p2p.Protocol)
+			if err != nil {
+				fmt.Println("[!] Failed to open stream to " + q.dst.String() + ": " + err.Error())
+				q.retryAfter = time.Now().Add(streamRetryDelay)
+				go p2p.Rediscover()
+				return
+			}
+			q.stream = stream
+		}
+		q.frame = encodeBatch(q.frame[:0], batch, q.stream.Protocol() == p2p.BatchProtocol)
+		if err := writeFrame(q.stream, q.frame); err == nil {
+			return
+		}
+		// If we encounter an error when writing to a stream we should
+		// close that stream and open a new one.
+		q.stream.Close()
+		q.stream = nil
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// encodeBatch appends the packets to buf, each prefixed with its length. With batched set the result is prefixed
+// with its total length as well, which turns it into a single BatchProtocol frame.
+func encodeBatch(buf []byte, batch []outboundPacket, batched bool) []byte {
+	if batched {
+		buf = append(buf, 0, 0)
+	}
+	for _, p := range batch {
+		buf = p2p.AppendFrame(buf, (*p.buf)[:p.plen])
+	}
+	if batched {
+		binary.LittleEndian.PutUint16(buf, uint16(len(buf)-2))
+	}
+	return buf
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// writeFrame writes already encoded packets to the stream in a single write.
+func writeFrame(stream network.Stream, frame []byte) error {
+	if err := stream.SetWriteDeadline(time.Now().Add(25 * time.Second)); err != nil {
+		return err
+	}
+	_, err := stream.Write(frame)
+	return err
+}
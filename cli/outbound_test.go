@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// receiver counts the numbered packets a peer gets over its tunnel streams.
+type receiver struct {
+	// received is the number of packets that arrived, next the number expected after the last one.
+	received   atomic.Int64
+	next       atomic.Int64
+	outOfOrder atomic.Int64
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// handle reads the packets of one stream, each stream has to deliver its packets in the order they were sent.
+func (r *receiver) handle(stream network.Stream) {
+	defer stream.Close()
+	last := int64(-1)
+	buf := make([]byte, p2p.MaxBatchSize)
+	_ = p2p.ReadBatches(stream, buf, func(packet []byte) {
+		seq := int64(binary.BigEndian.Uint32(packet))
+		if seq <= last {
+			r.outOfOrder.Add(1)
+		}
+		last = seq
+		r.received.Add(1)
+		r.next.Store(seq + 1)
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// newTestHost starts a host listening on TCP on the loopback interface.
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"), libp2p.DisableRelay())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// setupOutbound connects n receiving peers to a sending host and returns the outbound queues of the sender.
+func setupOutbound(t *testing.T, ctx context.Context, n int) (host.Host, *outboundQueues, []peer.ID, []*receiver) {
+	t.Helper()
+	sender := newTestHost(t)
+	cfg = &config.Config{PrivateKey: sender.Peerstore().PrivKey(sender.ID()), MTU: 1420}
+
+	var ids []peer.ID
+	var receivers []*receiver
+	for range n {
+		h := newTestHost(t)
+		r := new(receiver)
+		h.SetStreamHandler(p2p.BatchProtocol, r.handle)
+		if err := sender.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, h.ID())
+		receivers = append(receivers, r)
+	}
+
+	datagrams, err := p2p.NewDatagramPlane(ctx, sender, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, newOutboundQueues(ctx, sender, datagrams), ids, receivers
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// sendNumbered queues a packet carrying seq for dst.
+func sendNumbered(o *outboundQueues, dst peer.ID, seq int) {
+	buf := packetPool.Get().(*[]byte)
+	binary.BigEndian.PutUint32(*buf, uint32(seq))
+	o.send(dst, buf, 4)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// TestOutboundQueuesOrder sends to several peers at once while the queues of some of them are closed over and over.
+// Peers whose queue stays up get every packet in order, the others get theirs in order per stream.
+func TestOutboundQueuesOrder(t *testing.T) {
+	const peers, chunks, chunkLen = 6, 20, 100
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, o, ids, receivers := setupOutbound(t, ctx, peers)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i, dst := range ids {
+		r := receivers[i]
+		closed := i%2 == 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				for seq := c * chunkLen; seq < (c+1)*chunkLen; seq++ {
+					sendNumbered(o, dst, seq)
+				}
+				// Chunks stay below outboundQueueLen, so nothing is dropped for peers whose queue stays up.
+				if !closed && !waitFor(func() bool { return r.next.Load() == int64((c+1)*chunkLen) }) {
+					t.Errorf("peer %d: chunk %d not delivered, next packet is %d", i, c, r.next.Load())
+					return
+				}
+			}
+		}()
+		if closed {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						o.close(dst)
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}()
+		}
+	}
+	go func() {
+		// The closing goroutines only stop once all packets are sent.
+		for i := range ids {
+			if i%2 == 0 {
+				waitFor(func() bool { return receivers[i].next.Load() == chunks*chunkLen })
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	wg.Wait()
+
+	for i, r := range receivers {
+		if n := r.outOfOrder.Load(); n > 0 {
+			t.Errorf("peer %d: %d packets out of order", i, n)
+		}
+		if i%2 == 0 && r.received.Load() != chunks*chunkLen {
+			t.Errorf("peer %d: got %d packets, sent %d", i, r.received.Load(), chunks*chunkLen)
+		}
+	}
+
+	for _, dst := range ids {
+		o.close(dst)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.queues) != 0 {
+		t.Errorf("%d queues left after closing all of them", len(o.queues))
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// TestOutboundQueuesReapDisconnected checks that the idle queue of a peer goes away when the peer disconnects.
+func TestOutboundQueuesReapDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender, o, ids, receivers := setupOutbound(t, ctx, 1)
+
+	sendNumbered(o, ids[0], 0)
+	if !waitFor(func() bool { return receivers[0].received.Load() == 1 }) {
+		t.Fatal("packet not delivered")
+	}
+	if err := sender.Network().ClosePeer(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	queued := func() bool {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		_, ok := o.queues[ids[0]]
+		return ok
+	}
+	if !waitFor(func() bool { return !queued() }) {
+		t.Error("queue of the disconnected peer still up")
+	}
+}
@@ -2,6 +2,8 @@ package cli
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
 	"github.com/soitun/mynetwork/rpc"
@@ -11,11 +13,18 @@ import (
 var Peers = cmd.Sub{
 	Name:  "peers",
 	Short: "List peer connections",
+	Flags: &PeersFlags{},
 	Run:   PeersRun,
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type PeersFlags struct {
+	Tag string `short:"t" long:"tag" desc:"Only list peers carrying this tag"`
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func PeersRun(r *cmd.Root, c *cmd.Sub) {
+	flags := c.Flags.(*PeersFlags)
 	ifName := r.Flags.(*GlobalFlags).InterfaceName
 	if ifName == "" {
 		ifName = "mynetwork"
@@ -23,6 +32,16 @@ func PeersRun(r *cmd.Root, c *cmd.Sub) {
 
 	peers := rpc.Peers(ifName)
 	for _, peer := range peers.Peers {
-		fmt.Printf("Name: %s, PeerID: %s, IPv4: %s, IPv6: %s\n", peer.Name, peer.PeerID, peer.IPv4, peer.IPv6)
+		if flags.Tag != "" && !slices.Contains(peer.Tags, strings.ToLower(flags.Tag)) {
+			continue
+		}
+		fmt.Printf("Name: %s, PeerID: %s, IPv4: %s, IPv6: %s", peer.Name, peer.PeerID, peer.IPv4, peer.IPv6)
+		if len(peer.Tags) > 0 {
+			fmt.Printf(", Tags: %s", strings.Join(peer.Tags, ","))
+		}
+		if len(peer.Addrs) > 0 {
+			fmt.Printf(", Addrs: %s", strings.Join(peer.Addrs, ","))
+		}
+		fmt.Println()
 	}
 }
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var Reload = cmd.Sub{
+	Name:  "reload",
+	Short: "Reload the config file of a running daemon",
+	Run:   ReloadRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func ReloadRun(r *cmd.Root, c *cmd.Sub) {
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+
+	reply := rpc.Reload(ifName)
+	if !reply.Success {
+		fmt.Printf("Error: %s\n", reply.Message)
+		return
+	}
+	fmt.Printf("Success: %s\n", reply.Message)
+	printListF(reply.Changes, func(s string) string { return s })
+}
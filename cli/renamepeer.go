@@ -0,0 +1,61 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var RenamePeer = cmd.Sub{
+	Name:  "renamepeer",
+	Alias: "rp",
+	Short: "Rename a peer dynamically",
+	Flags: &RenamePeerFlags{},
+	Args:  &RenamePeerArgs{},
+	Run:   RenamePeerRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RenamePeerFlags struct {
+	Persist bool `short:"p" long:"persist" desc:"Also write the new name to the config file"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RenamePeerArgs struct {
+	Peer string `desc:"Peer to rename (@name or peer ID prefix)"`
+	Name string `desc:"New name of the peer"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func RenamePeerRun(r *cmd.Root, c *cmd.Sub) {
+	// Parse Command Args
+	args := c.Args.(*RenamePeerArgs)
+	flags := c.Flags.(*RenamePeerFlags)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+
+	if args.Peer == "" {
+		fmt.Println("Error: Peer is required")
+		return
+	}
+	if args.Name == "" {
+		fmt.Println("Error: Peer name is required")
+		return
+	}
+
+	reply := rpc.RenamePeer(ifName, rpc.RenamePeerArgs{
+		Peer:    args.Peer,
+		Name:    args.Name,
+		Persist: flags.Persist,
+	})
+
+	if reply.Success {
+		fmt.Printf("Success: %s\n", reply.Message)
+	} else {
+		fmt.Printf("Error: %s\n", reply.Message)
+	}
+}
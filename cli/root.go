@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/config"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -38,7 +39,19 @@ func init() {
 	cmd.Register(&Peers)
 	cmd.Register(&Route)
 	cmd.Register(&AddPeer)
+	cmd.Register(&DelPeer)
+	cmd.Register(&RenamePeer)
+	cmd.Register(&Tag)
+	cmd.Register(&Reload)
+	cmd.Register(&Exit)
+	cmd.Register(&Config)
+	cmd.Register(&Key)
+	cmd.Register(&Invite)
+	cmd.Register(&Join)
+	cmd.Register(&CA)
 	cmd.Register(&cmd.Version)
+
+	config.PassphrasePrompt = promptPassphrase
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
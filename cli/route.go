@@ -12,13 +12,19 @@ var Route = cmd.Sub{
 	Name:  "route",
 	Alias: "r",
 	Short: "Control routing",
+	Flags: &RouteFlags{},
 	Args:  &RouteArgs{},
 	Run:   RouteRun,
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RouteFlags struct {
+	Persist bool `short:"p" long:"persist" desc:"Also write route changes to the config file"`
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 type RouteArgs struct {
-	Action string
+	Action string   `desc:"show, add, del, approve or advertised"`
 	Args   []string `zero:"true"`
 }
 
@@ -26,6 +32,7 @@ type RouteArgs struct {
 func RouteRun(r *cmd.Root, c *cmd.Sub) {
 	// Parse Command Args
 	args := c.Args.(*RouteArgs)
+	flags := c.Flags.(*RouteFlags)
 	ifName := r.Flags.(*GlobalFlags).InterfaceName
 	if ifName == "" {
 		ifName = "mynetwork"
@@ -33,10 +40,14 @@ func RouteRun(r *cmd.Root, c *cmd.Sub) {
 
 	action := rpc.RouteAction(args.Action)
 	rArgs := rpc.RouteArgs{
-		Action: action,
-		Args:   args.Args,
+		Action:  action,
+		Args:    args.Args,
+		Persist: flags.Persist,
 	}
 	reply := rpc.Route(ifName, rArgs)
+	if reply.Out != "" {
+		fmt.Println(reply.Out)
+	}
 	for _, r := range reply.Routes {
 		var target string
 		connectStatus := ""
@@ -50,6 +61,15 @@ func RouteRun(r *cmd.Root, c *cmd.Sub) {
 		}
 		if r.IsConnected {
 			connectStatus = " connected"
+			if r.Transport != "" {
+				connectStatus += " (" + r.Transport + ")"
+			}
+		}
+		switch {
+		case r.Overlaps != "":
+			connectStatus = fmt.Sprintf(" %s, overlaps %s", r.State, r.Overlaps)
+		case r.State != "":
+			connectStatus = " " + r.State
 		}
 		fmt.Printf("%s via %s%s\n", &r.Network, target, connectStatus)
 	}
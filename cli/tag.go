@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	"github.com/soitun/mynetwork/rpc"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Tag adds tags to or removes them from a peer of the running daemon.
+var Tag = cmd.Sub{
+	Name:  "tag",
+	Short: "Add or remove tags of a peer dynamically",
+	Flags: &TagFlags{},
+	Args:  &TagArgs{},
+	Run:   TagRun,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type TagFlags struct {
+	Persist bool `short:"p" long:"persist" desc:"Also write the tags to the config file"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type TagArgs struct {
+	Action string   `desc:"add or del"`
+	Peer   string   `desc:"Peer to tag (@name or peer ID prefix)"`
+	Tags   []string `zero:"true"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func TagRun(r *cmd.Root, c *cmd.Sub) {
+	args := c.Args.(*TagArgs)
+	flags := c.Flags.(*TagFlags)
+	ifName := r.Flags.(*GlobalFlags).InterfaceName
+	if ifName == "" {
+		ifName = "mynetwork"
+	}
+
+	if len(args.Tags) == 0 {
+		fmt.Println("Usage: mynetwork tag add|del <peer> <tag>...")
+		os.Exit(2)
+	}
+	tagArgs := rpc.TagArgs{Peer: args.Peer, Persist: flags.Persist}
+	switch args.Action {
+	case "add":
+		tagArgs.Add = args.Tags
+	case "del":
+		tagArgs.Remove = args.Tags
+	default:
+		fmt.Printf("Error: Unknown action %q\n", args.Action)
+		os.Exit(2)
+	}
+
+	reply := rpc.Tag(ifName, tagArgs)
+	if reply.Success {
+		fmt.Printf("Success: %s, tags: %s\n", reply.Message, strings.Join(reply.Tags, ","))
+	} else {
+		fmt.Printf("Error: %s\n", reply.Message)
+	}
+}
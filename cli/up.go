@@ -2,7 +2,6 @@ package cli
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -11,7 +10,6 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/DataDrake/cli-ng/v2/cmd"
@@ -31,12 +29,6 @@ import (
 	"github.com/yl2chen/cidranger"
 )
 
-// -----------------------------------------------------------------------------------------------------------------------------------------------------
-type MuxStream struct {
-	Stream *network.Stream
-	Lock   *sync.Mutex
-}
-
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 var (
 	cfg  *config.Config
@@ -44,8 +36,10 @@ var (
 	// iface is the tun device used to pass packets between
 	// Hyprspace and the user's machine.
 	tunDev *tun.TUN
-	// activeStreams is a map of active streams to a peer
-	activeStreams map[peer.ID]MuxStream
+	// outbound queues packets to peers, with one stream writer per peer
+	outbound *outboundQueues
+	// inbound filters packets received from peers before they reach the tun device
+	inbound *p2p.PacketFilter
 	// context
 	ctx context.Context
 	// context cancel function
@@ -58,9 +52,16 @@ var Up = cmd.Sub{
 	Name:  "up",
 	Alias: "up",
 	Short: "Create and Bring Up a Mynetwork Interface.",
+	Flags: &UpFlags{},
 	Run:   UpRun,
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// UpFlags contains the flags for the up command.
+type UpFlags struct {
+	Watch bool `short:"w" long:"watch" desc:"Reload the config file automatically when it changes."`
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // UpRun handles the execution of the up command.
 func UpRun(r *cmd.Root, c *cmd.Sub) {
@@ -79,6 +80,7 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	cfg2, err := config.Read(configPath)
 	checkErr(err)
 	cfg2.Interface = ifName
+	cfg2.RestoreRevocations()
 	cfg = cfg2
 
 	fmt.Println("[+] Creating TUN Device")
@@ -88,7 +90,7 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 		cfg.Interface,
 		tun.Address(cfg.BuiltinAddr4.String()+"/32"),
 		tun.Address(cfg.BuiltinAddr6.String()+"/128"),
-		tun.MTU(1420),
+		tun.MTU(cfg.MTU),
 	)
 	if err != nil {
 		checkErr(err)
@@ -115,15 +117,17 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 
 	fmt.Println("[+] Creating P2P Node")
 
+	inbound = p2p.NewPacketFilter(cfg)
+
 	// Create P2P Node
 	host, dht, err := p2p.CreateNode(
 		ctx,
 		cfg.PrivateKey,
 		cfg.ListenAddresses,
 		streamHandler,
-		p2p.NewClosedCircuitRelayFilter(cfg.Peers),
+		p2p.NewClosedCircuitRelayFilter(cfg),
 		p2p.NewRecursionGater(cfg),
-		cfg.Peers,
+		cfg,
 	)
 	checkErr(err)
 	host.SetStreamHandler(p2p.PeXProtocol, p2p.NewPeXStreamHandler(host, cfg))
@@ -131,6 +135,7 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 
 	for _, p := range cfg.Peers {
 		host.ConnManager().Protect(p.ID, "/hyprspace/peer")
+		p2p.SetStaticAddrs(host, p.ID, nil, p.Addrs)
 	}
 
 	fmt.Println("[+] Setting Up Node Discovery via DHT")
@@ -144,15 +149,65 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	// PeX
 	go p2p.PeXService(ctx, host, cfg)
 
+	// Refuse peers with different overlay networks
+	go p2p.NetParamsService(ctx, host, cfg)
+
 	// Route metrics and latency
 	go p2p.RouteMetricsService(ctx, host, cfg)
 
+	// Hand key rotations over between peers
+	go p2p.KeyTransitionService(ctx, host, cfg, func(t *config.KeyTransition) error {
+		return hsrpc.ApplyKeyTransition(host, cfg, tunDev, t)
+	})
+
+	// Let new nodes join with invites
+	hsrpc.Invites = p2p.NewInvites(host, cfg, func(name string, id peer.ID) (config.Peer, error) {
+		return hsrpc.AcceptInvite(host, cfg, tunDev, name, id)
+	})
+
+	// Reload the config file on SIGHUP, on file changes if requested and through RPC
+	reload := func() {
+		reply := hsrpc.ReloadConfig(host, cfg, tunDev)
+		if !reply.Success {
+			fmt.Println("[!] Reload failed:", reply.Message)
+		}
+	}
+
 	// Register the application to listen for signals
-	go signals.SignalHandler(ctx, host, lockPath, dht, tunDev, ctxCancel)
+	go signals.SignalHandler(ctx, host, lockPath, dht, tunDev, ctxCancel, reload)
+
+	if c.Flags.(*UpFlags).Watch {
+		fmt.Println("[+] Watching " + cfg.Path + " for changes")
+		go func() {
+			if err := config.Watch(ctx, cfg.Path, reload); err != nil {
+				fmt.Println("[!] Stopped watching the config file:", err)
+			}
+		}()
+	}
 
 	// Log about various events
 	go eventLogger(ctx, host)
 
+	// Unreliable datagram transport, streams remain the fallback
+	datagrams, err := p2p.NewDatagramPlane(ctx, host, cfg, deliver)
+	checkErr(err)
+	hsrpc.Datagrams = datagrams
+
+	// Drop the stream of peers removed at runtime
+	outbound = newOutboundQueues(ctx, host, datagrams)
+	hsrpc.OnPeerRemoved = outbound.close
+
+	// Subnet route announcements
+	hsrpc.Advertiser = p2p.NewRouteAdvertiser(ctx, host, cfg, tunDev)
+
+	// Exit node, both as client and server
+	hsrpc.ExitClient = p2p.NewExitClient(ctx, host, cfg, tunDev)
+	if cfg.ExitNode {
+		if err := p2p.ServeExit(ctx, host, cfg); err != nil {
+			fmt.Printf("[!] Unable to act as exit node: %v\n", err)
+		}
+	}
+
 	// RPC server
 	if runtime.GOOS == "windows" {
 		go hsrpc.RpcServer(ctx, multiaddr.StringCast("/ip4/127.0.0.1/tcp/0"), host, cfg, tunDev)
@@ -164,12 +219,10 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	go hsrpc.StartJSONRPCServer(ctx, host, cfg, tunDev)
 
 	// Magic DNS server
-	go hsdns.MagicDnsServer(ctx, *cfg, node)
+	go hsdns.MagicDnsServer(ctx, cfg, node)
 
 	// metrics endpoint
-	metricsPort, ok := os.LookupEnv("MYNETWORK_METRICS_PORT")
-	if ok {
-		metricsTuple := fmt.Sprintf("127.0.0.1:%s", metricsPort)
+	if metricsTuple := cfg.Settings.Metrics; metricsTuple != "" {
 		http.Handle("/metrics", promhttp.Handler())
 		go func() {
 			http.ListenAndServe(metricsTuple, nil)
@@ -178,6 +231,7 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	}
 
 	serviceNet := svc.NewServiceNetwork(host, cfg, tunDev)
+	hsrpc.Services = serviceNet
 
 	for name, addr := range cfg.Services {
 		proxy, err := svc.ProxyTo(addr)
@@ -188,21 +242,10 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 		)
 	}
 
-	var svcNetIds [][4]byte
 	for _, p := range cfg.Peers {
-		svcNetIds = append(svcNetIds, config.MkNetID(p.ID))
-	}
-	svcNetIds = append(svcNetIds, config.MkNetID(host.ID()))
-	for _, netId := range svcNetIds {
-		addr := make([]byte, 16)
-		copy(addr, serviceNet.NetworkRange.IP)
-		copy(addr[10:], netId[:])
-		mask1, mask0 := serviceNet.NetworkRange.Mask.Size()
-		routeOpts = append(routeOpts, tun.Route(net.IPNet{
-			IP:   addr,
-			Mask: net.CIDRMask(mask1+32, mask0),
-		}))
+		routeOpts = append(routeOpts, tun.Route(serviceNet.PeerRange(p.ID)))
 	}
+	routeOpts = append(routeOpts, tun.Route(serviceNet.PeerRange(host.ID())))
 
 	// Write lock to filesystem to indicate an existing running daemon.
 	err = os.WriteFile(lockPath, []byte(fmt.Sprint(os.Getpid())), os.ModePerm)
@@ -215,18 +258,29 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 	}
 	checkErr(tunDev.Apply(routeOpts...))
 
+	// Admit peers holding a certificate of the network CA
+	go p2p.MembershipService(ctx, host, dht, cfg, p2p.MemberHooks{
+		Admit: func(c *config.Certificate) (bool, error) {
+			return hsrpc.AdmitMember(host, cfg, tunDev, c)
+		},
+		Revoke: func(l *config.RevocationList) (bool, error) {
+			return hsrpc.UpdateRevocations(host, cfg, tunDev, l)
+		},
+		Drop: func(id peer.ID) error {
+			return hsrpc.DropMember(host, cfg, tunDev, id)
+		},
+	})
+
 	fmt.Println("[+] Network setup complete")
 
 	// + ----------------------------------------+
 	// | Listen For New Packets on TUN Interface |
 	// + ----------------------------------------+
 
-	// Initialize active streams map and packet byte array.
-	activeStreams = make(map[peer.ID]MuxStream)
 	for {
-		var packet = make([]byte, 1420)
+		buf := packetPool.Get().(*[]byte)
 		// Read in a packet from the tun device.
-		plen, err := tunDev.Iface.Read(packet)
+		plen, err := tunDev.Iface.Read(*buf)
 		if errors.Is(err, fs.ErrClosed) {
 			fmt.Println("[-] Interface closed")
 			<-ctx.Done()
@@ -234,111 +288,89 @@ func UpRun(r *cmd.Root, c *cmd.Sub) {
 			return
 		} else if err != nil {
 			fmt.Println(err)
+			packetPool.Put(buf)
 			continue
 		}
 
-		var dstIP net.IP
-		proto := packet[0] & 0xf0
-
-		if proto == 0x40 {
-			dstIP = net.IP(packet[16:20])
-			if cfg.BuiltinAddr4.Equal(dstIP) {
-				continue
-			}
-		} else if proto == 0x60 {
-			dstIP = net.IP(packet[24:40])
-			if cfg.BuiltinAddr6.Equal(dstIP) {
-				continue
-			} else if serviceNet.NetworkRange.Contains(dstIP) {
-				// Are you TCP because your protocol is 6, or is your protocol 6 because you are TCP?
-				if packet[6] == 0x06 {
-					port := uint16(packet[42])*256 + uint16(packet[43])
-					if serviceNet.EnsureListener([16]byte(packet[24:40]), port) {
-						count, err := (*serviceNet.Tun).Write([][]byte{packet}, 0)
-						if count == 0 {
-							fmt.Printf("[!] To service network: %s\n", err)
-						}
-					}
-				}
-				continue
-			}
+		if dst, found := forwardTarget(serviceNet, (*buf)[:plen]); found {
+			sendPacket(dst, buf, plen)
 		} else {
-			continue
-		}
-		var dst peer.ID
-
-		// Check route table for destination address.
-		route, found := cfg.FindRouteForIP(dstIP)
-
-		if found {
-			dst = route.Target.ID
-			go sendPacket(dst, packet, plen)
+			packetPool.Put(buf)
 		}
 	}
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func sendPacket(dst peer.ID, packet []byte, plen int) {
-	// Check if we already have an open connection to the destination peer.
-	ms, ok := activeStreams[dst]
-	if ok {
-		if func() bool {
-			ms.Lock.Lock()
-			defer ms.Lock.Unlock()
-			// Write out the packet's length to the libp2p stream to ensure
-			// we know the full size of the packet at the other end.
-			err := binary.Write(*ms.Stream, binary.LittleEndian, uint16(plen))
-			if err == nil {
-				// Write the packet out to the libp2p stream.
-				// If everyting succeeds continue on to the next packet.
-				_, err = (*ms.Stream).Write(packet[:plen])
-				if err == nil {
-					err := (*ms.Stream).SetWriteDeadline(time.Now().Add(25 * time.Second))
-					if err == nil {
-						return true
+// forwardTarget decides what happens to a packet read from the TUN device. Packets for the service network are
+// handed to it directly, packets that should go to a peer return that peer.
+func forwardTarget(serviceNet *svc.ServiceNetwork, packet []byte) (peer.ID, bool) {
+	if len(packet) == 0 {
+		return "", false
+	}
+	var dstIP net.IP
+	proto := packet[0] & 0xf0
+
+	if proto == 0x40 && len(packet) >= 20 {
+		dstIP = net.IP(packet[16:20])
+		if cfg.BuiltinAddr4.Equal(dstIP) {
+			return "", false
+		}
+	} else if proto == 0x60 && len(packet) >= 40 {
+		dstIP = net.IP(packet[24:40])
+		if cfg.BuiltinAddr6.Equal(dstIP) {
+			return "", false
+		} else if serviceNet.NetworkRange.Contains(dstIP) {
+			// Are you TCP because your protocol is 6, or is your protocol 6 because you are TCP?
+			if packet[6] == 0x06 && len(packet) >= 44 {
+				port := uint16(packet[42])*256 + uint16(packet[43])
+				if serviceNet.EnsureListener([16]byte(packet[24:40]), port) {
+					count, err := (*serviceNet.Tun).Write([][]byte{packet}, 0)
+					if count == 0 {
+						fmt.Printf("[!] To service network: %s\n", err)
 					}
 				}
 			}
-			// If we encounter an error when writing to a stream we should
-			// close that stream and delete it from the active stream map.
-			(*ms.Stream).Close()
-			delete(activeStreams, dst)
-			return false
-		}() {
-			return
+			return "", false
 		}
+	} else {
+		return "", false
 	}
 
-	stream, err := node.NewStream(ctx, dst, p2p.Protocol)
-	if err != nil {
-		fmt.Println("[!] Failed to open stream to " + dst.String() + ": " + err.Error())
-		go p2p.Rediscover()
-		return
+	// Check route table for destination address.
+	cfg.RLock()
+	defer cfg.RUnlock()
+	route, found := cfg.FindRouteForIP(dstIP)
+	if !found {
+		return "", false
 	}
-	err = stream.SetWriteDeadline(time.Now().Add(25 * time.Second))
-	if err != nil {
-		fmt.Println("[!] Failed to set write deadline: " + err.Error())
-		stream.Close()
-		return
+	// A peer that rotated its key keeps its previous ID until it restarts.
+	if t := route.Target.KeyTransition; t != nil && t.Active() &&
+		node.Network().Connectedness(route.Target.ID) != network.Connected &&
+		node.Network().Connectedness(t.Old) == network.Connected {
+		return t.Old, true
 	}
-	// Write packet length
-	err = binary.Write(stream, binary.LittleEndian, uint16(plen))
-	if err != nil {
-		stream.Close()
+	return route.Target.ID, true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// sendPacket queues a packet for dst once it fits the path MTU to dst. TCP SYNs get their MSS clamped to it, larger
+// packets are fragmented where IPv4 allows it and answered with an ICMP error otherwise.
+func sendPacket(dst peer.ID, buf *[]byte, plen int) {
+	packet := (*buf)[:plen]
+	mtu := p2p.PathMTU(dst, cfg.MTU)
+	p2p.ClampMSS(packet, mtu)
+	if plen <= mtu {
+		outbound.send(dst, buf, plen)
 		return
 	}
-	// Write the packet
-	_, err = stream.Write(packet[:plen])
-	if err != nil {
-		stream.Close()
+	defer packetPool.Put(buf)
+	if reply := p2p.TooBig(cfg, packet, mtu); reply != nil {
+		_, _ = tunDev.Iface.Write(reply)
 		return
 	}
-
-	// If all succeeds when writing the packet to the stream
-	// we should reuse this stream by adding it active streams map.
-	activeStreams[dst] = MuxStream{
-		Stream: &stream,
-		Lock:   &sync.Mutex{},
+	for _, frag := range p2p.Fragment(packet, mtu) {
+		fbuf := packetPool.Get().(*[]byte)
+		outbound.send(dst, fbuf, copy(*fbuf, frag))
 	}
 }
 
@@ -352,17 +384,18 @@ func eventLogger(ctx context.Context, host host.Host) {
 			return
 		case ev := <-subCon.Out():
 			evt := ev.(event.EvtPeerConnectednessChanged)
-			for _, vpnPeer := range cfg.Peers {
-				if vpnPeer.ID == evt.Peer {
-					if evt.Connectedness == network.Connected {
-						for _, c := range host.Network().ConnsToPeer(evt.Peer) {
-							fmt.Printf("[+] Connected to %s/p2p/%s\n", c.RemoteMultiaddr().String(), evt.Peer.String())
-						}
-					} else if evt.Connectedness == network.NotConnected {
-						fmt.Printf("[!] Disconnected from %s\n", evt.Peer.String())
-					}
-					break
+			cfg.RLock()
+			_, found := config.FindPeer(cfg.Peers, evt.Peer)
+			cfg.RUnlock()
+			if !found {
+				continue
+			}
+			if evt.Connectedness == network.Connected {
+				for _, c := range host.Network().ConnsToPeer(evt.Peer) {
+					fmt.Printf("[+] Connected to %s/p2p/%s\n", c.RemoteMultiaddr().String(), evt.Peer.String())
 				}
+			} else if evt.Connectedness == network.NotConnected {
+				fmt.Printf("[!] Disconnected from %s\n", evt.Peer.String())
 			}
 		}
 	}
@@ -371,39 +404,30 @@ func eventLogger(ctx context.Context, host host.Host) {
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func streamHandler(stream network.Stream) {
 	// If the remote node ID isn't in the list of known nodes don't respond.
-	if _, ok := config.FindPeer(cfg.Peers, stream.Conn().RemotePeer()); !ok {
+	cfg.RLock()
+	_, ok := config.FindPeer(cfg.Peers, stream.Conn().RemotePeer())
+	cfg.RUnlock()
+	if !ok {
 		stream.Reset()
 		return
 	}
-	var packet = make([]byte, 1420)
-	var packetSize = make([]byte, 2)
-	for {
-		// Read the incoming packet's size as a binary value.
-		_, err := stream.Read(packetSize)
-		if err != nil {
-			stream.Close()
-			return
-		}
+	src := stream.Conn().RemotePeer()
+	handle := func(packet []byte) {
+		deliver(src, packet)
+	}
+	if stream.Protocol() == p2p.BatchProtocol {
+		_ = p2p.ReadBatches(stream, make([]byte, p2p.MaxBatchSize), handle)
+	} else {
+		// The frame length limits packets, not our MTU, since the peer may use a larger one.
+		_ = p2p.ReadFrames(stream, make([]byte, p2p.MaxFrameSize), handle)
+	}
+	stream.Close()
+}
 
-		// Decode the incoming packet's size from binary.
-		size := binary.LittleEndian.Uint16(packetSize)
-
-		// Read in the packet until completion.
-		var plen uint16 = 0
-		for plen < size {
-			tmp, err := stream.Read(packet[plen:size])
-			plen += uint16(tmp)
-			if err != nil {
-				stream.Close()
-				return
-			}
-		}
-		err = stream.SetWriteDeadline(time.Now().Add(25 * time.Second))
-		if err != nil {
-			fmt.Println("[!] Failed to set write deadline: " + err.Error())
-			stream.Close()
-			return
-		}
-		_, _ = tunDev.Iface.Write(packet[:size])
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// deliver writes a packet received from src to the tun device, unless the packet filter drops it.
+func deliver(src peer.ID, packet []byte) {
+	if inbound.Allow(src, packet) {
+		_, _ = tunDev.Iface.Write(packet)
 	}
 }
@@ -8,14 +8,32 @@ import (
 	"runtime"
 
 	"github.com/mattn/go-isatty"
+	"github.com/soitun/mynetwork/config"
+	"golang.org/x/term"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
+// getDefaultConfigPath returns the config file of an interface, which may be written in any of the supported formats.
 func getDefaultConfigPath(ifName string) string {
+	base := getConfigBase(ifName)
+	for _, f := range config.Formats {
+		if _, err := os.Stat(base + f.Extension()); err == nil {
+			return base + f.Extension()
+		}
+	}
+	if _, err := os.Stat(base + ".yml"); err == nil {
+		return base + ".yml"
+	}
+	return base + ".json"
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// getConfigBase returns the path of the config file of an interface without its extension.
+func getConfigBase(ifName string) string {
 	if runtime.GOOS == "windows" {
-		return filepath.Join(os.Getenv("APPDATA"), "mynetwork", ifName+".json")
+		return filepath.Join(os.Getenv("APPDATA"), "mynetwork", ifName)
 	}
-	return "/etc/mynetwork/" + ifName + ".json"
+	return "/etc/mynetwork/" + ifName
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -30,6 +48,18 @@ func isTTY() bool {
 	return isatty.IsTerminal(os.Stdout.Fd())
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// promptPassphrase reads a passphrase from the terminal without echoing it.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("the key is encrypted, set $%s or the %s credential", config.PassphraseEnv, config.PassphraseCredential)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(fd)
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func checkErr(err error) {
 	if err != nil {
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/soitun/mynetwork/schema"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// protocolNumbers maps the protocol names accepted in an ACL to their IP protocol numbers.
+var protocolNumbers = map[string][]uint8{
+	"icmp":   {1, 58},
+	"tcp":    {6},
+	"udp":    {17},
+	"icmpv6": {58},
+	"sctp":   {132},
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ACL is the parsed packet filter of a peer. Empty lists allow anything, ports only match TCP, UDP and SCTP packets.
+type ACL struct {
+	Sources      []net.IPNet
+	Destinations []net.IPNet
+	Protocols    []uint8
+	Ports        []PortRange
+	spec         schema.ACL
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseACL parses the packet filter of a peer as written in the config file.
+func ParseACL(spec schema.ACL) (*ACL, error) {
+	acl := &ACL{spec: spec}
+	for _, s := range spec.Sources {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl source %q", s)
+		}
+		acl.Sources = append(acl.Sources, *network)
+	}
+	for _, s := range spec.Destinations {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl destination %q", s)
+		}
+		acl.Destinations = append(acl.Destinations, *network)
+	}
+	for _, s := range spec.Protocols {
+		if numbers, ok := protocolNumbers[strings.ToLower(s)]; ok {
+			acl.Protocols = append(acl.Protocols, numbers...)
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl protocol %q", s)
+		}
+		acl.Protocols = append(acl.Protocols, uint8(n))
+	}
+	for _, s := range spec.Ports {
+		first, last, isRange := strings.Cut(s, "-")
+		if !isRange {
+			last = first
+		}
+		from, err1 := strconv.ParseUint(first, 10, 16)
+		to, err2 := strconv.ParseUint(last, 10, 16)
+		if err1 != nil || err2 != nil || from > to {
+			return nil, fmt.Errorf("invalid acl port %q", s)
+		}
+		acl.Ports = append(acl.Ports, PortRange{uint16(from), uint16(to)})
+	}
+	return acl, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Spec returns the packet filter as it is written in the config file.
+func (acl *ACL) Spec() schema.ACL {
+	return acl.spec
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Allows reports whether an IPv4 or IPv6 packet passes the filter. Malformed packets never do. Fragments other than
+// the first carry no port, so like in most stateless filters they pass on their addresses and protocol alone; the
+// first fragment decides whether the packet can be reassembled.
+func (acl *ACL) Allows(packet []byte) bool {
+	src, dst, proto, port, hasPort, fragment, ok := parsePacket(packet)
+	if !ok {
+		return false
+	}
+	if len(acl.Sources) > 0 && !containsIP(acl.Sources, src) {
+		return false
+	}
+	if len(acl.Destinations) > 0 && !containsIP(acl.Destinations, dst) {
+		return false
+	}
+	if len(acl.Protocols) > 0 && !slices.Contains(acl.Protocols, proto) {
+		return false
+	}
+	if len(acl.Ports) > 0 {
+		if !hasPort {
+			return fragment
+		}
+		return slices.ContainsFunc(acl.Ports, func(r PortRange) bool { return port >= r.First && port <= r.Last })
+	}
+	return true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func containsIP(nets []net.IPNet, ip net.IP) bool {
+	return slices.ContainsFunc(nets, func(n net.IPNet) bool { return n.Contains(ip) })
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parsePacket extracts the addresses, the transport protocol and, for TCP, UDP and SCTP, the destination port of
+// a packet. Fragments other than the first carry no port, fragment reports those.
+func parsePacket(packet []byte) (src, dst net.IP, proto uint8, port uint16, hasPort, fragment bool, ok bool) {
+	if len(packet) < 1 {
+		return
+	}
+	var payload []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return
+		}
+		src, dst, proto = net.IP(packet[12:16]), net.IP(packet[16:20]), packet[9]
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			payload = packet[ihl:]
+		} else {
+			fragment = true
+		}
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		src, dst, proto = net.IP(packet[8:24]), net.IP(packet[24:40]), packet[6]
+		payload = packet[40:]
+		// Skip the extension headers that may precede the transport header.
+	ExtLoop:
+		for {
+			switch proto {
+			case 0, 43, 60:
+				if len(payload) < 8 {
+					return
+				}
+				hlen := (int(payload[1]) + 1) * 8
+				if len(payload) < hlen {
+					return
+				}
+				proto, payload = payload[0], payload[hlen:]
+			case 44:
+				if len(payload) < 8 {
+					return
+				}
+				first := binary.BigEndian.Uint16(payload[2:4])&0xfff8 == 0
+				proto, payload = payload[0], payload[8:]
+				if !first {
+					// The headers that follow are in the first fragment.
+					payload, fragment = nil, true
+					break ExtLoop
+				}
+			default:
+				break ExtLoop
+			}
+		}
+	default:
+		return
+	}
+	ok = true
+	switch proto {
+	case 6, 17, 132:
+		if len(payload) >= 4 {
+			port, hasPort = binary.BigEndian.Uint16(payload[2:4]), true
+		}
+	}
+	return
+}
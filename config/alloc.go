@@ -0,0 +1,169 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxAddrProbes bounds how many candidate addresses are tried for a peer before giving up.
+const maxAddrProbes = 64
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ulaNet holds the unique local IPv6 addresses.
+var ulaNet = net.IPNet{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addrRequest asks for an address for a member of the network, either a fixed one or one derived from its ID.
+type addrRequest struct {
+	id       peer.ID
+	explicit net.IP
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addrCandidates4 returns the candidate IPv4 addresses inside n. The first candidate is the address older versions
+// used.
+func addrCandidates4(n net.IPNet) func(peer.ID, int) net.IP {
+	return func(p peer.ID, k int) net.IP {
+		if k == 0 {
+			return mkBuiltinAddr4(n, p)
+		}
+		h := probeHash(p, k)
+		return hostAddr(n, h[:4])
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addrCandidates6 returns the candidate IPv6 addresses inside n. The first candidate is the address older versions
+// used.
+func addrCandidates6(n net.IPNet) func(peer.ID, int) net.IP {
+	return func(p peer.ID, k int) net.IP {
+		if k == 0 {
+			return mkBuiltinAddr6(n, p)
+		}
+		h := probeHash(p, k)
+		return hostAddr(n, h[:4])
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func probeHash(p peer.ID, k int) [32]byte {
+	return sha256.Sum256(append([]byte(p), byte(k>>8), byte(k)))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// allocateAddrs assigns a distinct address to every member. Explicit addresses are kept as they are, everyone else
+// probes candidate addresses in rounds; when several members want the same address in a round, the lowest peer ID
+// gets it and the others move on to their next candidate. The result only depends on the set of members, so every
+// node with the same peer list arrives at the same addresses.
+func allocateAddrs(members []addrRequest, candidate func(peer.ID, int) net.IP) (map[peer.ID]net.IP, error) {
+	result := make(map[peer.ID]net.IP, len(members))
+	taken := make(map[string]peer.ID, len(members))
+	var pending []peer.ID
+	for _, m := range members {
+		if _, dup := result[m.id]; dup || slices.Contains(pending, m.id) {
+			return nil, fmt.Errorf("peer %s is listed more than once", m.id)
+		}
+		if m.explicit == nil {
+			pending = append(pending, m.id)
+			continue
+		}
+		if owner, ok := taken[m.explicit.String()]; ok {
+			return nil, fmt.Errorf("peers %s and %s are both configured with address %s", owner, m.id, m.explicit)
+		}
+		taken[m.explicit.String()] = m.id
+		result[m.id] = m.explicit
+	}
+	slices.Sort(pending)
+
+	for k := 0; len(pending) > 0; k++ {
+		if k == maxAddrProbes {
+			return nil, fmt.Errorf("no free address left for peer %s", pending[0])
+		}
+		var next []peer.ID
+		for _, p := range pending {
+			addr := candidate(p, k)
+			if _, ok := taken[addr.String()]; ok {
+				next = append(next, p)
+				continue
+			}
+			taken[addr.String()] = p
+			result[p] = addr
+		}
+		pending = next
+	}
+	return result, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parseExplicitAddr parses an address configured for a node, which has to lie inside the builtin network.
+func parseExplicitAddr(s string, within net.IPNet) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	addr := net.ParseIP(s)
+	if addr == nil || !within.Contains(addr) {
+		return nil, fmt.Errorf("address %q is not inside %s", s, &within)
+	}
+	if addr4 := addr.To4(); addr4 != nil {
+		return addr4, nil
+	}
+	return addr, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parseOverlayNet parses one of the overlay ranges of the config file, falling back to def if it isn't set.
+// The network has to be of the same family as def and leave at least minHostBits for the host part; IPv6 networks
+// must be unique local ones.
+func parseOverlayNet(s string, def net.IPNet, minHostBits int, exactly bool) (net.IPNet, error) {
+	if s == "" {
+		return def, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("invalid overlay network %q", s)
+	}
+	ones, bits := n.Mask.Size()
+	_, defBits := def.Mask.Size()
+	switch {
+	case bits != defBits:
+		return net.IPNet{}, fmt.Errorf("overlay network %s has the wrong address family", n)
+	case bits == 128 && !ulaNet.Contains(n.IP):
+		return net.IPNet{}, fmt.Errorf("overlay network %s is not inside %s", n, &ulaNet)
+	case exactly && bits-ones != minHostBits:
+		return net.IPNet{}, fmt.Errorf("overlay network %s must be a /%d", n, bits-minHostBits)
+	case bits-ones < minHostBits:
+		return net.IPNet{}, fmt.Errorf("overlay network %s must be a /%d or larger", n, bits-minHostBits)
+	}
+	return *n, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// assignAddrs allocates the IPv4 and IPv6 addresses of all members and calls moved for every member that had to move
+// away from its first candidate.
+func (cfg *Config) assignAddrs(members4, members6 []addrRequest, moved func(id peer.ID, first, addr net.IP)) (map[peer.ID]net.IP, map[peer.ID]net.IP, error) {
+	candidate4, candidate6 := addrCandidates4(cfg.Net4), addrCandidates6(cfg.Net6)
+	addrs4, err := allocateAddrs(members4, candidate4)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs6, err := allocateAddrs(members6, candidate6)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range members4 {
+		if first := candidate4(m.id, 0); m.explicit == nil && !addrs4[m.id].Equal(first) {
+			moved(m.id, first, addrs4[m.id])
+		}
+	}
+	for _, m := range members6 {
+		if first := candidate6(m.id, 0); m.explicit == nil && !addrs6[m.id].Equal(first) {
+			moved(m.id, first, addrs6[m.id])
+		}
+	}
+	return addrs4, addrs6, nil
+}
@@ -0,0 +1,424 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DefaultCertificateValidity is how long a certificate is valid if no expiry is given.
+const DefaultCertificateValidity = 365 * 24 * time.Hour
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Certificates and revocation lists are shared as tokens with these prefixes.
+const (
+	certificatePrefix    = "mncert1."
+	revocationListPrefix = "mncrl1."
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// The domains separate the signatures of the network CA from other records signed with the same key.
+const (
+	certificateDomain    = "mynetwork-certificate"
+	revocationListDomain = "mynetwork-revocation-list"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var (
+	certificateCodec    = []byte("/mynetwork/certificate")
+	revocationListCodec = []byte("/mynetwork/revocation-list")
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Certificate binds a peer ID to a name and tags. Nodes accept every peer holding a certificate signed by their
+// network CA, without listing it in their config.
+type Certificate struct {
+	// CA is the peer ID of the key that signed the certificate.
+	CA   peer.ID
+	ID   peer.ID
+	Name string
+	Tags []string
+	// Addr4 and Addr6 pin the addresses of the peer, nil if they are allocated from its ID.
+	Addr4   net.IP
+	Addr6   net.IP
+	Issued  time.Time
+	Expires time.Time
+	// Envelope is the signed record as it is sent to peers and stored in config files.
+	Envelope []byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// certificateRecord is the signed payload of a Certificate.
+type certificateRecord struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Tags    []string  `json:"tags,omitempty"`
+	Addr4   string    `json:"addr4,omitempty"`
+	Addr6   string    `json:"addr6,omitempty"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (c *Certificate) Domain() string {
+	return certificateDomain
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (c *Certificate) Codec() []byte {
+	return certificateCodec
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (c *Certificate) MarshalRecord() ([]byte, error) {
+	rec := certificateRecord{
+		ID:      c.ID.String(),
+		Name:    c.Name,
+		Tags:    c.Tags,
+		Issued:  c.Issued.UTC(),
+		Expires: c.Expires.UTC(),
+	}
+	if c.Addr4 != nil {
+		rec.Addr4 = c.Addr4.String()
+	}
+	if c.Addr6 != nil {
+		rec.Addr6 = c.Addr6.String()
+	}
+	return json.Marshal(rec)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (c *Certificate) UnmarshalRecord(data []byte) error {
+	var rec certificateRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	var err error
+	if c.ID, err = peer.Decode(rec.ID); err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if rec.Name == "" {
+		return errors.New("certificate has no name")
+	}
+	if rec.Addr4 != "" {
+		if c.Addr4 = net.ParseIP(rec.Addr4).To4(); c.Addr4 == nil {
+			return fmt.Errorf("invalid address %q", rec.Addr4)
+		}
+	}
+	if rec.Addr6 != "" {
+		if c.Addr6 = net.ParseIP(rec.Addr6); c.Addr6 == nil || c.Addr6.To4() != nil {
+			return fmt.Errorf("invalid address %q", rec.Addr6)
+		}
+	}
+	c.Name = rec.Name
+	c.Tags = rec.Tags
+	c.Issued = rec.Issued
+	c.Expires = rec.Expires
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Sign signs the certificate with the key of the network CA.
+func (c *Certificate) Sign(caKey crypto.PrivKey) error {
+	ca, err := peer.IDFromPrivateKey(caKey)
+	if err != nil {
+		return err
+	}
+	c.CA = ca
+	env, err := record.Seal(c, caKey)
+	if err != nil {
+		return err
+	}
+	c.Envelope, err = env.Marshal()
+	return err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// String encodes the signed certificate for config files and for sharing.
+func (c *Certificate) String() string {
+	return certificatePrefix + base64.RawURLEncoding.EncodeToString(c.Envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseCertificate checks the signature of a certificate and returns its contents. Whether it has been signed by the
+// right CA is up to the caller.
+func ParseCertificate(s string) (*Certificate, error) {
+	c := &Certificate{}
+	env, err := consumeCAToken(s, certificatePrefix, certificateCodec, c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	if c.CA, err = peer.IDFromPublicKey(env.PublicKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Expired reports whether the certificate is no longer valid.
+func (c *Certificate) Expired() bool {
+	return !time.Now().Before(c.Expires)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RevocationList lists the peers whose certificates the network CA has withdrawn. A list issued later replaces the
+// previous one.
+type RevocationList struct {
+	CA      peer.ID
+	Issued  time.Time
+	Revoked []peer.ID
+	// Envelope is the signed record as it is sent to peers and stored in config files.
+	Envelope []byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// revocationListRecord is the signed payload of a RevocationList.
+type revocationListRecord struct {
+	Issued  time.Time `json:"issued"`
+	Revoked []string  `json:"revoked"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (l *RevocationList) Domain() string {
+	return revocationListDomain
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (l *RevocationList) Codec() []byte {
+	return revocationListCodec
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (l *RevocationList) MarshalRecord() ([]byte, error) {
+	rec := revocationListRecord{Issued: l.Issued.UTC(), Revoked: []string{}}
+	for _, id := range l.Revoked {
+		rec.Revoked = append(rec.Revoked, id.String())
+	}
+	return json.Marshal(rec)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (l *RevocationList) UnmarshalRecord(data []byte) error {
+	var rec revocationListRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	l.Revoked = nil
+	for _, s := range rec.Revoked {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return fmt.Errorf("invalid peer ID %q: %w", s, err)
+		}
+		l.Revoked = append(l.Revoked, id)
+	}
+	l.Issued = rec.Issued
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewRevocationList signs a revocation list with the key of the network CA.
+func NewRevocationList(caKey crypto.PrivKey, revoked []peer.ID) (*RevocationList, error) {
+	ca, err := peer.IDFromPrivateKey(caKey)
+	if err != nil {
+		return nil, err
+	}
+	l := &RevocationList{CA: ca, Issued: time.Now().Truncate(time.Second), Revoked: revoked}
+	env, err := record.Seal(l, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if l.Envelope, err = env.Marshal(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// String encodes the signed revocation list for config files and for sharing.
+func (l *RevocationList) String() string {
+	return revocationListPrefix + base64.RawURLEncoding.EncodeToString(l.Envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseRevocationList checks the signature of a revocation list and returns its contents.
+func ParseRevocationList(s string) (*RevocationList, error) {
+	l := &RevocationList{}
+	env, err := consumeCAToken(s, revocationListPrefix, revocationListCodec, l)
+	if err != nil {
+		return nil, fmt.Errorf("invalid revocation list: %w", err)
+	}
+	if l.CA, err = peer.IDFromPublicKey(env.PublicKey); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Revokes reports whether the list withdraws the certificate of id.
+func (l *RevocationList) Revokes(id peer.ID) bool {
+	return l != nil && slices.Contains(l.Revoked, id)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// IsCertificate reports whether s looks like a certificate rather than a revocation list.
+func IsCertificate(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), certificatePrefix)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// consumeCAToken decodes a token with the given prefix and checks the signature of the record in it.
+func consumeCAToken(s, prefix string, codec []byte, rec record.Record) (*record.Envelope, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("unknown format")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	env, err := record.ConsumeTypedEnvelope(data, rec)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(env.PayloadType, codec) {
+		return nil, errors.New("unexpected record type")
+	}
+	switch r := rec.(type) {
+	case *Certificate:
+		r.Envelope = data
+	case *RevocationList:
+		r.Envelope = data
+	}
+	return env, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// CheckCertificate reports why a certificate doesn't make its holder a member of the network, nil if it does.
+func (cfg *Config) CheckCertificate(c *Certificate) error {
+	switch {
+	case cfg.CA == "":
+		return errors.New("no network CA is configured")
+	case c.CA != cfg.CA:
+		return fmt.Errorf("certificate is signed by %s, not by the network CA", c.CA)
+	case c.Expired():
+		return fmt.Errorf("certificate expired at %s", c.Expires.Format(time.RFC3339))
+	case cfg.Revocations.Revokes(c.ID):
+		return errors.New("certificate has been revoked")
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AddMember adds the holder of a valid certificate as a peer. Members are not written to the config file. A member
+// presenting a certificate that expires later gets its name and tags updated. It returns the peer, and false if
+// nothing changed.
+func (cfg *Config) AddMember(c *Certificate) (Peer, bool, error) {
+	if err := cfg.CheckCertificate(c); err != nil {
+		return Peer{}, false, err
+	}
+	if self, err := peer.IDFromPrivateKey(cfg.PrivateKey); err != nil || self == c.ID {
+		return Peer{}, false, errors.New("certificate belongs to this node")
+	}
+	if (c.Addr4 != nil && !cfg.Net4.Contains(c.Addr4)) || (c.Addr6 != nil && !cfg.Net6.Contains(c.Addr6)) {
+		return Peer{}, false, fmt.Errorf("certificate pins addresses outside of %s and %s", &cfg.Net4, &cfg.Net6)
+	}
+	if idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == c.ID }); idx >= 0 {
+		p := cfg.Peers[idx]
+		// Peers listed in the config file keep what is configured for them.
+		if p.Certificate == nil || !c.Expires.After(p.Certificate.Expires) {
+			return p, false, nil
+		}
+		if other, found := FindPeerByName(cfg.Peers, c.Name); found && other.ID != c.ID {
+			return p, false, fmt.Errorf("peer name %s is already taken by /p2p/%s", c.Name, other.ID)
+		}
+		if p.Name != c.Name {
+			delete(cfg.PeerLookup.ByName, strings.ToLower(p.Name))
+		}
+		p.Name, p.Tags, p.Certificate = c.Name, c.Tags, c
+		return p, true, cfg.storePeer(idx, p)
+	}
+	if other, found := FindPeerByName(cfg.Peers, c.Name); found {
+		return Peer{}, false, fmt.Errorf("peer name %s is already taken by /p2p/%s", c.Name, other.ID)
+	}
+	if err := cfg.AddPeerWithAddrs(c.Name, c.ID, c.Addr4, c.Addr6); err != nil {
+		return Peer{}, false, err
+	}
+	idx := len(cfg.Peers) - 1
+	p := cfg.Peers[idx]
+	p.Tags, p.Certificate = c.Tags, c
+	return p, true, cfg.storePeer(idx, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetRevocations replaces the revocation list if l has been issued by the network CA after the current one. It
+// reports whether the list changed.
+func (cfg *Config) SetRevocations(l *RevocationList) (bool, error) {
+	if cfg.CA == "" || l.CA != cfg.CA {
+		return false, fmt.Errorf("revocation list is signed by %s, not by the network CA", l.CA)
+	}
+	if cfg.Revocations != nil && !l.Issued.After(cfg.Revocations.Issued) {
+		return false, nil
+	}
+	cfg.Revocations = l
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// revocationsFile holds the latest revocation list received from peers, in the state directory.
+const revocationsFile = "revocations"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SaveRevocations keeps the revocation list in the state directory, so a list received from peers survives a restart
+// without the config file being rewritten.
+func (cfg *Config) SaveRevocations() error {
+	if cfg.Revocations == nil {
+		return nil
+	}
+	path := filepath.Join(cfg.StateDir(), revocationsFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(cfg.Revocations.String()+"\n"))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RestoreRevocations takes the revocation list saved in the state directory, if it is more recent than the one of
+// the config file.
+func (cfg *Config) RestoreRevocations() {
+	data, err := os.ReadFile(filepath.Join(cfg.StateDir(), revocationsFile))
+	if err != nil || cfg.CA == "" {
+		return
+	}
+	l, err := ParseRevocationList(string(data))
+	if err != nil {
+		fmt.Printf("[!] Ignoring the saved revocation list: %v\n", err)
+		return
+	}
+	// Lists of another CA are left over from a previous network.
+	_, _ = cfg.SetRevocations(l)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// StaleMembers returns the members whose certificate has expired or been revoked.
+func (cfg *Config) StaleMembers() []Peer {
+	var stale []Peer
+	for _, p := range cfg.Peers {
+		if p.Certificate != nil && cfg.CheckCertificate(p.Certificate) != nil {
+			stale = append(stale, p)
+		}
+	}
+	return stale
+}
@@ -2,16 +2,19 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multiaddr"
-	"github.com/multiformats/go-multibase"
 	"github.com/soitun/mynetwork/schema"
 	"github.com/yl2chen/cidranger"
 )
@@ -20,6 +23,7 @@ import (
 // Config is the main Configuration Struct for Hyprspace.
 type Config struct {
 	Path            string                         `json:"-"`
+	Format          Format                         `json:"-"`
 	Interface       string                         `json:"-"`
 	ListenAddresses []multiaddr.Multiaddr          `json:"-"`
 	Peers           []Peer                         `json:"peers"`
@@ -27,9 +31,67 @@ type Config struct {
 	PrivateKey      crypto.PrivKey                 `json:"-"`
 	BuiltinAddr4    net.IP                         `json:"-"`
 	BuiltinAddr6    net.IP                         `json:"-"`
+	Addr4           net.IP                         `json:"-"`
+	Addr6           net.IP                         `json:"-"`
+	Net4            net.IPNet                      `json:"-"`
+	Net6            net.IPNet                      `json:"-"`
+	ServiceNet      net.IPNet                      `json:"-"`
 	Services        map[string]multiaddr.Multiaddr `json:"-"`
+	ExitNode        bool                           `json:"-"`
+	AdvertiseRoutes []net.IPNet                    `json:"-"`
+	// NextKey is the key this node switches to on its next start after a key rotation, nil if there is none.
+	NextKey crypto.PrivKey `json:"-"`
+	// KeyTransition hands the previous identity of this node over to its current key, while it is active.
+	KeyTransition *KeyTransition `json:"-"`
+	// KeyFile is the file holding the private key as written in the config, empty if the key is stored inline.
+	KeyFile string `json:"-"`
+	keyEnc  keyEncoding
+	// CA is the peer ID of the network CA, empty if the network doesn't use certificates.
+	CA peer.ID `json:"-"`
+	// Certificate is the membership certificate of this node, nil if it has none.
+	Certificate *Certificate `json:"-"`
+	// Revocations is the latest revocation list of the network CA, nil if there is none.
+	Revocations *RevocationList `json:"-"`
+	// Relay selects the peers that may use this node as a relay, nil for all of them.
+	Relay *PeerSet `json:"-"`
+	// ServiceAccess selects the peers that may reach a local service, by service name. Services without an entry are
+	// open to all peers.
+	ServiceAccess map[string]*PeerSet `json:"-"`
+	// Include are the patterns of the drop-in files included by the config file.
+	Include []string `json:"-"`
+	// ServiceSources maps the services defined in drop-in files to their file.
+	ServiceSources map[string]string `json:"-"`
+	// Settings are the runtime settings of the daemon, with the environment applied.
+	Settings Settings `json:"-"`
+	// BootstrapPeers replace the default bootstrap nodes, nil to keep them.
+	BootstrapPeers []multiaddr.Multiaddr `json:"-"`
+	// DelegatedRouting replaces the default HTTP routing endpoints, nil to keep them.
+	DelegatedRouting []string `json:"-"`
+	// Private disables the public DHT, the default bootstrap nodes and HTTP routing.
+	Private bool `json:"-"`
+	// MTU is the MTU of the TUN device.
+	MTU int `json:"-"`
+	// lock guards the peers, routes and services of a running daemon, see Lock and RLock.
+	lock *sync.RWMutex
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Lock locks the config for a change of its peers, routes or services at runtime. Functions of this package never
+// lock the config themselves, the caller decides how far a change reaches.
+func (cfg *Config) Lock() { cfg.lock.Lock() }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Unlock undoes Lock.
+func (cfg *Config) Unlock() { cfg.lock.Unlock() }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RLock locks the config for reading its peers, routes or services from a goroutine other than the one changing them.
+func (cfg *Config) RLock() { cfg.lock.RLock() }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RUnlock undoes RLock.
+func (cfg *Config) RUnlock() { cfg.lock.RUnlock() }
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // Peer defines a peer in the configuration. We might add more to this later.
 type Peer struct {
@@ -37,6 +99,24 @@ type Peer struct {
 	Name         string  `json:"name"`
 	BuiltinAddr4 net.IP  `json:"-"`
 	BuiltinAddr6 net.IP  `json:"-"`
+	// Addr4 and Addr6 are the explicitly configured addresses of the peer, nil if they are allocated from its ID.
+	Addr4 net.IP `json:"-"`
+	Addr6 net.IP `json:"-"`
+	ACL   *ACL   `json:"-"`
+	// AllowAnySource disables the check that packets from this peer carry one of its own addresses as source.
+	AllowAnySource bool `json:"-"`
+	// AutoApproveRoutes installs the subnets announced by this peer right away.
+	AutoApproveRoutes bool `json:"-"`
+	// KeyTransition is the last key rotation of the peer, whose previous ID is accepted until it expires.
+	KeyTransition *KeyTransition `json:"-"`
+	// Tags group peers for policies and DNS. Members get them from their certificate.
+	Tags []string `json:"-"`
+	// Certificate is set for members admitted by their certificate, which are not written to the config file.
+	Certificate *Certificate `json:"-"`
+	// Source is the drop-in file the peer is defined in, empty for peers of the main config file.
+	Source string `json:"-"`
+	// Addrs are the static addresses of the peer, without its /p2p part.
+	Addrs []multiaddr.Multiaddr `json:"-"`
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -51,6 +131,8 @@ type PeerLookup struct {
 type RouteTableEntry struct {
 	Net    net.IPNet
 	Target Peer
+	// Transient routes are installed by the daemon itself at runtime and never written to the config file.
+	Transient bool
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -59,75 +141,351 @@ func (rte RouteTableEntry) Network() net.IPNet {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-// Read initializes a config from a file.
+// Read initializes a config from a file. Problems with the file are returned as a *ValidationError, warnings are
+// printed.
 func Read(path string) (*Config, error) {
-	in, err := os.ReadFile(path)
+	result, diags, err := Validate(path)
 	if err != nil {
 		return nil, err
 	}
+	for _, d := range diags.Warnings() {
+		fmt.Println("[!]", d)
+	}
+	if err := diags.Err(); err != nil {
+		return nil, err
+	}
+	for _, p := range result.Peers {
+		routes, _ := result.PeerRoutes(p.ID)
+		for _, r := range routes {
+			fmt.Printf("[+] Route %s via /p2p/%s\n", &r, p.ID)
+		}
+	}
+	return result, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parse builds a config from the contents of a config file, reporting every problem instead of stopping at the
+// first one.
+func parse(in []byte, path string) (*Config, Diagnostics) {
+	format := DetectFormat(path, in)
+	v := newValidator(path, in, format)
 	input := schema.Config{}
-	result := Config{}
+	result := Config{Format: format, lock: new(sync.RWMutex)}
 
 	// Read in config settings from file.
-	err = json.Unmarshal(in, &input)
+	doc, err := format.toJSON(in)
 	if err != nil {
-		return nil, err
+		v.reportSyntax(err)
+		return nil, v.diags
 	}
+	if err := json.Unmarshal(doc, &input); err != nil {
+		v.reportJSON(err)
+		return nil, v.diags
+	}
+	var raw any
+	_ = json.Unmarshal(doc, &raw)
+	v.checkFields(raw, schemaType, "")
 
-	_, keyBytes, err := multibase.Decode(input.PrivateKey)
-	if err != nil {
-		return nil, err
+	// Drop-in files add their peers and services to those of the config file.
+	for i, pattern := range input.Include {
+		files, err := expandInclude(path, pattern)
+		if err != nil {
+			v.errorf(fmt.Sprintf("include[%d]", i), "%v", err)
+			continue
+		}
+		for _, file := range files {
+			v.include(file, &input)
+		}
+	}
+	result.Include = input.Include
+
+	var peerID peer.ID
+	keyField, encoded := "privateKey", input.PrivateKey
+	switch {
+	case input.PrivateKey != "" && input.PrivateKeyFile != "":
+		v.errorf("privateKeyFile", "privateKey and privateKeyFile are mutually exclusive")
+		encoded = ""
+	case input.PrivateKeyFile != "":
+		keyField, result.KeyFile = "privateKeyFile", input.PrivateKeyFile
+		data, err := os.ReadFile(result.keyFilePath(path))
+		if err != nil {
+			v.errorf(keyField, "unable to read private key: %v", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	case input.PrivateKey == "":
+		v.errorf("privateKey", "missing private key")
+	}
+	if encoded != "" {
+		if pk, passphrase, err := DecodeKey(encoded); err != nil {
+			v.errorf(keyField, "%v", err)
+		} else if peerID, err = peer.IDFromPrivateKey(pk); err != nil {
+			v.errorf(keyField, "invalid private key: %v", err)
+		} else {
+			result.PrivateKey = pk
+			result.keyEnc = keyEncoding{pk, encoded, passphrase}
+		}
 	}
 
-	pk, err := crypto.UnmarshalPrivateKey(keyBytes)
-	if err != nil {
-		return nil, err
+	result.Settings = v.parseSettings(input, path)
+
+	if result.Net4, err = parseOverlayNet(input.Network4, DefaultNet4, 2, false); err != nil {
+		v.errorf("network4", "%v", err)
+	}
+	if result.Net6, err = parseOverlayNet(input.Network6, DefaultNet6, 32, false); err != nil {
+		v.errorf("network6", "%v", err)
+	}
+	if result.ServiceNet, err = parseOverlayNet(input.ServiceNetwork, DefaultServiceNet, 48, true); err != nil {
+		v.errorf("serviceNetwork", "%v", err)
+	}
+	if result.Net6.Contains(result.ServiceNet.IP) || result.ServiceNet.Contains(result.Net6.IP) {
+		v.errorf("serviceNetwork", "overlay networks %s and %s overlap", &result.Net6, &result.ServiceNet)
 	}
 
-	result.PrivateKey = pk
+	if input.KeyTransition != "" {
+		t, err := ParseKeyTransition(input.KeyTransition)
+		switch {
+		case err != nil:
+			v.errorf("keyTransition", "%v", err)
+		case peerID != "" && t.New != peerID:
+			v.errorf("keyTransition", "key transition hands over to %s, not to the private key of this node", t.New)
+		case !t.Active():
+			v.warnf("keyTransition", "key transition expired at %s and can be removed", t.Expires.Format(time.RFC3339))
+		default:
+			result.KeyTransition = t
+		}
+	}
 
-	peerID, err := peer.IDFromPrivateKey(result.PrivateKey)
-	if err != nil {
-		return nil, err
+	if input.CA != "" {
+		if result.CA, err = peer.Decode(input.CA); err != nil {
+			v.errorf("ca", "invalid peer ID: %v", err)
+		}
+	}
+	if input.RevocationList != "" {
+		l, err := ParseRevocationList(input.RevocationList)
+		switch {
+		case err != nil:
+			v.errorf("revocationList", "%v", err)
+		case input.CA == "":
+			v.errorf("revocationList", "a revocation list requires ca")
+		case result.CA != "" && l.CA != result.CA:
+			v.errorf("revocationList", "revocation list is signed by %s, not by the network CA", l.CA)
+		default:
+			result.Revocations = l
+		}
+	}
+	if input.Certificate != "" {
+		c, err := ParseCertificate(input.Certificate)
+		switch {
+		case err != nil:
+			v.errorf("certificate", "%v", err)
+		case input.CA == "":
+			v.errorf("certificate", "a certificate requires ca")
+		case result.CA != "" && c.CA != result.CA:
+			v.errorf("certificate", "certificate is signed by %s, not by the network CA", c.CA)
+		case peerID != "" && c.ID != peerID:
+			v.errorf("certificate", "certificate is issued to %s, not to the private key of this node", c.ID)
+		default:
+			if c.Expired() {
+				v.warnf("certificate", "certificate expired at %s", c.Expires.Format(time.RFC3339))
+			} else if result.Revocations.Revokes(c.ID) {
+				v.warnf("certificate", "certificate has been revoked")
+			}
+			result.Certificate = c
+		}
 	}
 
-	result.BuiltinAddr4 = mkBuiltinAddr4(peerID)
-	result.BuiltinAddr6 = mkBuiltinAddr6(peerID)
+	if result.Addr4, err = parseExplicitAddr(input.Addr4, result.Net4); err != nil {
+		v.errorf("addr4", "%v", err)
+	}
+	if result.Addr6, err = parseExplicitAddr(input.Addr6, result.Net6); err != nil {
+		v.errorf("addr6", "%v", err)
+	}
 
-	for _, addrString := range input.ListenAddresses {
+	for i, addrString := range input.ListenAddresses {
 		addr, err := multiaddr.NewMultiaddr(addrString)
 		if err != nil {
-			return nil, err
+			v.errorf(fmt.Sprintf("listenAddresses[%d]", i), "invalid multiaddr: %v", err)
+			continue
 		}
 		result.ListenAddresses = append(result.ListenAddresses, addr)
 	}
 
+	for i, addrString := range input.BootstrapPeers {
+		field := fmt.Sprintf("bootstrapPeers[%d]", i)
+		addr, err := multiaddr.NewMultiaddr(addrString)
+		if err != nil {
+			v.errorf(field, "invalid multiaddr: %v", err)
+			continue
+		}
+		if _, err := peer.AddrInfoFromP2pAddr(addr); err != nil {
+			v.errorf(field, "bootstrap peers need an address ending in /p2p/<peer ID>")
+			continue
+		}
+		result.BootstrapPeers = append(result.BootstrapPeers, addr)
+	}
+	for i, endpoint := range input.DelegatedRouting {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf(fmt.Sprintf("delegatedRouting[%d]", i), "invalid endpoint %q, expected an http or https URL", endpoint)
+			continue
+		}
+		result.DelegatedRouting = append(result.DelegatedRouting, endpoint)
+	}
+	result.Private = input.Private
+	if result.Private {
+		if len(input.DelegatedRouting) > 0 {
+			v.warnf("delegatedRouting", "delegated routing is not used in private mode")
+		}
+		if result.Settings.IPFSAPI != nil {
+			v.warnf("ipfsApi", "the peers of the IPFS node are not used in private mode")
+		}
+		if len(input.BootstrapPeers) == 0 {
+			v.warnf("private", "without bootstrapPeers, peers are only found through the addresses they share")
+		}
+	}
+
+	result.MTU = DefaultMTU
+	if input.MTU != 0 {
+		if input.MTU < MinMTU || input.MTU > MaxMTU {
+			v.errorf("mtu", "MTU %d is out of range, expected %d to %d", input.MTU, MinMTU, MaxMTU)
+		} else {
+			result.MTU = input.MTU
+		}
+	}
+
 	result.PeerLookup.ByRoute = cidranger.NewPCTrieRanger()
 	result.PeerLookup.ByName = make(map[string]Peer)
 	result.PeerLookup.ByNetID = make(map[[4]byte]Peer)
-	result.Peers = make([]Peer, len(input.Peers))
 
+	// Addresses are allocated for the whole network at once, this node included.
+	var members4, members6 []addrRequest
+	if peerID != "" {
+		members4 = append(members4, addrRequest{peerID, result.Addr4})
+		members6 = append(members6, addrRequest{peerID, result.Addr6})
+	}
+	seenIDs := make(map[peer.ID]int)
+	seenNames := make(map[string]int)
+	var valid []int
 	for i, configPeer := range input.Peers {
+		field := fmt.Sprintf("peers[%d]", i)
 		p := Peer{}
 		p.ID, err = peer.Decode(configPeer.Id)
 		if err != nil {
-			return nil, err
+			v.errorf(field+".id", "invalid peer ID: %v", err)
+			continue
+		}
+		if p.ID == peerID {
+			v.errorf(field+".id", "peer %s is this node itself", p.ID)
+			continue
 		}
+		if j, dup := seenIDs[p.ID]; dup {
+			v.errorf(field+".id", "peer %s is already listed as %s", p.ID, v.locate(fmt.Sprintf("peers[%d]", j)))
+			continue
+		}
+		seenIDs[p.ID] = i
+		if name := strings.ToLower(configPeer.Name); name != "" {
+			if j, dup := seenNames[name]; dup {
+				v.errorf(field+".name", "name %q is already used by %s", configPeer.Name, v.locate(fmt.Sprintf("peers[%d]", j)))
+			}
+			seenNames[name] = i
+		}
+		if p.Addr4, err = parseExplicitAddr(configPeer.Addr4, result.Net4); err != nil {
+			v.errorf(field+".addr4", "%v", err)
+		}
+		if p.Addr6, err = parseExplicitAddr(configPeer.Addr6, result.Net6); err != nil {
+			v.errorf(field+".addr6", "%v", err)
+		}
+		for j, addrString := range configPeer.Addrs {
+			addrField := fmt.Sprintf("%s.addrs[%d]", field, j)
+			addr, err := multiaddr.NewMultiaddr(addrString)
+			if err != nil {
+				v.errorf(addrField, "invalid multiaddr: %v", err)
+				continue
+			}
+			transport, id := peer.SplitAddr(addr)
+			switch {
+			case transport == nil:
+				v.errorf(addrField, "address %s has no transport part", addr)
+			case id != "" && id != p.ID:
+				v.errorf(addrField, "address %s belongs to %s, not to the peer", addr, id)
+			default:
+				p.Addrs = append(p.Addrs, transport)
+			}
+		}
+		if configPeer.KeyTransition != "" {
+			t, err := ParseKeyTransition(configPeer.KeyTransition)
+			switch {
+			case err != nil:
+				v.errorf(field+".keyTransition", "%v", err)
+			case t.New != p.ID:
+				v.errorf(field+".keyTransition", "key transition hands over to %s, not to the ID of the peer", t.New)
+			case !t.Active():
+				v.warnf(field+".keyTransition", "key transition expired at %s and can be removed", t.Expires.Format(time.RFC3339))
+			default:
+				p.KeyTransition = t
+			}
+		}
+		members4 = append(members4, addrRequest{p.ID, p.Addr4})
+		members6 = append(members6, addrRequest{p.ID, p.Addr6})
+		result.Peers = append(result.Peers, p)
+		valid = append(valid, i)
+	}
+	addrs4, addrs6, err := result.assignAddrs(members4, members6, func(id peer.ID, first, addr net.IP) {
+		field := "peers"
+		if j, ok := seenIDs[id]; ok {
+			field = fmt.Sprintf("peers[%d].id", j)
+		}
+		v.warnf(field, "address %s of %s collides with another node, using %s instead", first, id, addr)
+	})
+	if err != nil {
+		v.errorf("peers", "%v", err)
+		return &result, v.diags
+	}
+	result.BuiltinAddr4 = addrs4[peerID]
+	result.BuiltinAddr6 = addrs6[peerID]
+	if c := result.Certificate; c != nil {
+		if (c.Addr4 != nil && !c.Addr4.Equal(result.BuiltinAddr4)) || (c.Addr6 != nil && !c.Addr6.Equal(result.BuiltinAddr6)) {
+			v.warnf("certificate", "certificate pins the addresses %s %s, but this node uses %s %s", c.Addr4, c.Addr6,
+				result.BuiltinAddr4, result.BuiltinAddr6)
+		}
+	}
+
+	// routeFields remembers where each route was defined, to point at both ends of an overlap.
+	routeFields := make(map[*RouteTableEntry]string)
+	for k, i := range valid {
+		configPeer := input.Peers[i]
+		p := result.Peers[k]
 		p.Name = configPeer.Name
-		p.BuiltinAddr4 = mkBuiltinAddr4(p.ID)
-		p.BuiltinAddr6 = mkBuiltinAddr6(p.ID)
-		for _, r := range configPeer.Routes {
+		p.BuiltinAddr4 = addrs4[p.ID]
+		p.BuiltinAddr6 = addrs6[p.ID]
+		p.AllowAnySource = configPeer.AllowAnySource
+		p.AutoApproveRoutes = configPeer.AutoApproveRoutes
+		if source := v.source(fmt.Sprintf("peers[%d]", i)); source != path {
+			p.Source = source
+		}
+		if p.Tags, err = ParseTags(configPeer.Tags); err != nil {
+			v.errorf(fmt.Sprintf("peers[%d].tags", i), "%v", err)
+		}
+		if configPeer.ACL != nil {
+			p.ACL, err = ParseACL(*configPeer.ACL)
+			if err != nil {
+				v.errorf(fmt.Sprintf("peers[%d].acl", i), "%v", err)
+			}
+		}
+		for j, r := range configPeer.Routes {
+			field := fmt.Sprintf("peers[%d].routes[%d].net", i, j)
 			_, network, err := net.ParseCIDR(r.Net)
 			if err != nil {
-				log.Fatal("[!] Invalid network:", r.Net)
+				v.errorf(field, "invalid network %q", r.Net)
+				continue
 			}
+			v.checkRoute(&result, routeFields, *network, field)
 
-			result.PeerLookup.ByRoute.Insert(&RouteTableEntry{
+			rte := &RouteTableEntry{
 				Net:    *network,
 				Target: p,
-			})
-
-			fmt.Printf("[+] Route %s via /p2p/%s\n", network.String(), p.ID)
+			}
+			result.PeerLookup.ByRoute.Insert(rte)
+			routeFields[rte] = v.locate(field)
 		}
 		result.PeerLookup.ByRoute.Insert(&RouteTableEntry{
 			Net: net.IPNet{
@@ -146,28 +504,90 @@ func Read(path string) (*Config, error) {
 		if configPeer.Name != "" {
 			result.PeerLookup.ByName[strings.ToLower(configPeer.Name)] = p
 		}
-		result.PeerLookup.ByNetID[[4]byte(p.BuiltinAddr6[12:16])] = p
-		result.Peers[i] = p
+		result.PeerLookup.ByNetID[MkNetID(p.ID)] = p
+		result.Peers[k] = p
 	}
 
 	result.Services = make(map[string]multiaddr.Multiaddr)
+	result.ServiceSources = make(map[string]string)
 	for name, addrString := range input.Services {
+		field := joinPath("services", name)
 		addr, err := multiaddr.NewMultiaddr(addrString)
 		if err != nil {
-			return nil, err
+			v.errorf(field, "invalid multiaddr: %v", err)
+			continue
 		}
 		result.Services[name] = addr
+		if source := v.source(field); source != path {
+			result.ServiceSources[name] = source
+		}
+	}
+
+	if len(input.Relay) > 0 {
+		if result.Relay, err = ParsePeerSet(input.Relay); err != nil {
+			v.errorf("relay", "%v", err)
+		}
+	}
+	result.ServiceAccess = make(map[string]*PeerSet)
+	for name, entries := range input.ServiceAccess {
+		field := joinPath("serviceAccess", name)
+		if _, found := input.Services[name]; !found {
+			v.warnf(field, "no service named %q is configured", name)
+		}
+		if result.ServiceAccess[name], err = ParsePeerSet(entries); err != nil {
+			v.errorf(field, "%v", err)
+		}
+	}
+
+	result.ExitNode = input.ExitNode
+
+	for i, r := range input.AdvertiseRoutes {
+		field := fmt.Sprintf("advertiseRoutes[%d]", i)
+		_, network, err := net.ParseCIDR(r)
+		if err != nil {
+			v.errorf(field, "invalid network %q", r)
+			continue
+		}
+		if overlaps, _ := result.OverlappingRoutes(*network); len(overlaps) > 0 {
+			v.warnf(field, "advertised route %s overlaps %s via peer %s", network, &overlaps[0].Net, overlaps[0].Target.ID)
+		}
+		result.AdvertiseRoutes = append(result.AdvertiseRoutes, *network)
 	}
 
 	// Overwrite path of config to input.
 	result.Path = path
-	return &result, nil
+	return &result, v.diags
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// checkRoute reports a configured route that collides with the overlay networks or with a route defined earlier.
+func (v *validator) checkRoute(cfg *Config, routeFields map[*RouteTableEntry]string, n net.IPNet, field string) {
+	for _, overlay := range []net.IPNet{cfg.Net4, cfg.Net6, cfg.ServiceNet} {
+		if overlay.Contains(n.IP) || n.Contains(overlay.IP) {
+			v.warnf(field, "route %s overlaps the overlay network %s", &n, &overlay)
+		}
+	}
+	overlaps, err := cfg.OverlappingRoutes(n)
+	if err != nil {
+		return
+	}
+	for _, rte := range overlaps {
+		other, ok := routeFields[rte]
+		switch {
+		case !ok:
+		case rte.Net.String() == n.String():
+			v.errorf(field, "route %s is already defined at %s", &n, other)
+		default:
+			v.warnf(field, "route %s overlaps %s defined at %s, packets take the more specific one", &n, &rte.Net, other)
+		}
+	}
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
+// FindPeer looks up a peer by its ID, or by its previous ID while it is handing its identity over to a new key.
 func FindPeer(peers []Peer, needle peer.ID) (*Peer, bool) {
 	for _, p := range peers {
-		if p.ID == needle {
+		if p.Is(needle) {
 			return &p, true
 		}
 	}
@@ -185,27 +605,38 @@ func FindPeerByName(peers []Peer, needle string) (*Peer, bool) {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func FindPeerByIDPrefix(peers []Peer, needle string) (*Peer, bool) {
+// FindPeerByIDPrefix returns the peer whose ID starts with needle. A prefix shared by several peers is an error.
+func FindPeerByIDPrefix(peers []Peer, needle string) (*Peer, error) {
+	var match *Peer
 	for _, p := range peers {
 		if strings.HasPrefix(p.ID.String(), needle) {
-			return &p, true
+			if match != nil {
+				return nil, fmt.Errorf("peer ID prefix %s is ambiguous, it matches %s and %s", needle, match.ID, p.ID)
+			}
+			match = &p
 		}
 	}
-	return nil, false
+	if match == nil {
+		return nil, errors.New("no such peer")
+	}
+	return match, nil
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func FindPeerByCLIRef(peers []Peer, needle string) (*Peer, bool) {
+// FindPeerByCLIRef returns the peer referred to as @name or by a unique prefix of its ID.
+func FindPeerByCLIRef(peers []Peer, needle string) (*Peer, error) {
 	if strings.HasPrefix(needle, "@") {
 		name := strings.TrimPrefix(needle, "@")
-		return FindPeerByName(peers, name)
-	} else {
-		return FindPeerByIDPrefix(peers, needle)
+		if p, found := FindPeerByName(peers, name); found {
+			return p, nil
+		}
+		return nil, errors.New("no such peer")
 	}
+	return FindPeerByIDPrefix(peers, needle)
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func (cfg Config) FindRoute(needle net.IPNet) (*RouteTableEntry, bool) {
+func (cfg *Config) FindRoute(needle net.IPNet) (*RouteTableEntry, bool) {
 	networks, err := cfg.PeerLookup.ByRoute.CoveredNetworks(needle)
 	if err != nil {
 		fmt.Println(err)
@@ -214,37 +645,117 @@ func (cfg Config) FindRoute(needle net.IPNet) (*RouteTableEntry, bool) {
 		return nil, false
 	} else if len(networks) > 1 {
 		for _, n := range networks {
-			fmt.Printf("[!] Found duplicate route %s to /p2p/%s for %s\n", n.Network(), n.(RouteTableEntry).Target.ID, needle)
+			fmt.Printf("[!] Found duplicate route %s to /p2p/%s for %s\n", n.Network(), n.(*RouteTableEntry).Target.ID, needle)
 		}
 	}
 	return networks[0].(*RouteTableEntry), true
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func (cfg Config) FindRouteForIP(needle net.IP) (*RouteTableEntry, bool) {
+// FindExactRoute returns the route for exactly the network n, not one it covers or is covered by.
+func (cfg *Config) FindExactRoute(n net.IPNet) (*RouteTableEntry, bool) {
+	entries, err := cfg.PeerLookup.ByRoute.CoveredNetworks(n)
+	if err != nil {
+		return nil, false
+	}
+	for _, e := range entries {
+		if rte := e.(*RouteTableEntry); rte.Net.String() == n.String() {
+			return rte, true
+		}
+	}
+	return nil, false
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// FindRouteForIP returns the most specific route containing needle.
+func (cfg *Config) FindRouteForIP(needle net.IP) (*RouteTableEntry, bool) {
 	networks, err := cfg.PeerLookup.ByRoute.ContainingNetworks(needle)
 	if err != nil {
 		fmt.Println(err)
 		return nil, false
 	} else if len(networks) == 0 {
 		return nil, false
-	} else if len(networks) > 1 {
-		for _, n := range networks {
-			fmt.Printf("[!] Found duplicate route %s to /p2p/%s for %s\n", n.Network(), n.(RouteTableEntry).Target.ID, needle)
+	}
+	// Containing networks are ordered from the least to the most specific one.
+	return networks[len(networks)-1].(*RouteTableEntry), true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// OverlappingRoutes returns every route that contains needle or is contained in it, builtin host routes included.
+func (cfg *Config) OverlappingRoutes(needle net.IPNet) ([]*RouteTableEntry, error) {
+	containing, err := cfg.PeerLookup.ByRoute.ContainingNetworks(needle.IP)
+	if err != nil {
+		return nil, err
+	}
+	covered, err := cfg.PeerLookup.ByRoute.CoveredNetworks(needle)
+	if err != nil {
+		return nil, err
+	}
+	var result []*RouteTableEntry
+	for _, n := range append(containing, covered...) {
+		rte := n.(*RouteTableEntry)
+		if !slices.Contains(result, rte) {
+			result = append(result, rte)
 		}
 	}
-	return networks[0].(*RouteTableEntry), true
+	return result, nil
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // AddPeer dynamically adds a new peer to the configuration
 func (cfg *Config) AddPeer(name string, peerID peer.ID) error {
+	return cfg.AddPeerWithAddrs(name, peerID, nil, nil)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AddPeerWithAddrs dynamically adds a new peer with optional explicit addresses to the configuration. It fails if
+// the addresses of the new peer collide with one of the existing nodes in a way that would move that node.
+func (cfg *Config) AddPeerWithAddrs(name string, peerID peer.ID, addr4, addr6 net.IP) error {
+	if _, found := FindPeer(cfg.Peers, peerID); found {
+		return errors.New("peer already exists")
+	}
+	self, err := peer.IDFromPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	// 重新分配整个网络的地址，已有节点的地址不能改变
+	// 加入网络后固定的新地址在重启后才生效，此前本节点仍使用当前地址
+	self4, self6 := cfg.Addr4, cfg.Addr6
+	if self4 != nil && !self4.Equal(cfg.BuiltinAddr4) || self6 != nil && !self6.Equal(cfg.BuiltinAddr6) {
+		self4, self6 = cfg.BuiltinAddr4, cfg.BuiltinAddr6
+	}
+	members4 := []addrRequest{{self, self4}, {peerID, addr4}}
+	members6 := []addrRequest{{self, self6}, {peerID, addr6}}
+	for _, p := range cfg.Peers {
+		members4 = append(members4, addrRequest{p.ID, p.Addr4})
+		members6 = append(members6, addrRequest{p.ID, p.Addr6})
+	}
+	addrs4, err := allocateAddrs(members4, addrCandidates4(cfg.Net4))
+	if err != nil {
+		return err
+	}
+	addrs6, err := allocateAddrs(members6, addrCandidates6(cfg.Net6))
+	if err != nil {
+		return err
+	}
+	if !addrs4[self].Equal(cfg.BuiltinAddr4) || !addrs6[self].Equal(cfg.BuiltinAddr6) {
+		return errors.New("address of the new peer collides with this node, configure addr4/addr6 for one of them")
+	}
+	for _, p := range cfg.Peers {
+		if !addrs4[p.ID].Equal(p.BuiltinAddr4) || !addrs6[p.ID].Equal(p.BuiltinAddr6) {
+			return fmt.Errorf("address of the new peer collides with %s (/p2p/%s), configure addr4/addr6 for one of them", p.Name, p.ID)
+		}
+	}
+
 	// 创建新的 peer 对象
 	newPeer := Peer{
 		ID:           peerID,
 		Name:         name,
-		BuiltinAddr4: mkBuiltinAddr4(peerID),
-		BuiltinAddr6: mkBuiltinAddr6(peerID),
+		BuiltinAddr4: addrs4[peerID],
+		BuiltinAddr6: addrs6[peerID],
+		Addr4:        addr4,
+		Addr6:        addr6,
 	}
 
 	// 添加到 peers 列表
@@ -274,7 +785,7 @@ func (cfg *Config) AddPeer(name string, peerID peer.ID) error {
 	}
 
 	// 添加到网络 ID 查找表
-	cfg.PeerLookup.ByNetID[[4]byte(newPeer.BuiltinAddr6[12:16])] = newPeer
+	cfg.PeerLookup.ByNetID[MkNetID(peerID)] = newPeer
 
 	fmt.Printf("[+] Added peer %s (/p2p/%s) with IPv4: %s, IPv6: %s\n", 
 		name, peerID.String(), newPeer.BuiltinAddr4.String(), newPeer.BuiltinAddr6.String())
@@ -312,3 +823,163 @@ func (cfg *Config) AddPeerWithTUN(name string, peerID peer.ID, tunDev interface{
 
 	return nil
 }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// peerRouteEntries returns every route table entry that targets the given peer, including its builtin host routes.
+func (cfg *Config) peerRouteEntries(p peer.ID) ([]*RouteTableEntry, error) {
+	var result []*RouteTableEntry
+	for _, all := range []*net.IPNet{cidranger.AllIPv4, cidranger.AllIPv6} {
+		entries, err := cfg.PeerLookup.ByRoute.CoveredNetworks(*all)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if rte := e.(*RouteTableEntry); rte.Target.ID == p {
+				result = append(result, rte)
+			}
+		}
+	}
+	return result, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RemoveRouteTo removes the route for exactly the network n if it targets p. A route for n to another peer stays.
+func (cfg *Config) RemoveRouteTo(n net.IPNet, p peer.ID) (bool, error) {
+	entries, err := cfg.PeerLookup.ByRoute.CoveredNetworks(n)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		rte := e.(*RouteTableEntry)
+		if rte.Target.ID != p || rte.Net.String() != n.String() {
+			continue
+		}
+		if _, err := cfg.PeerLookup.ByRoute.Remove(n); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RemovePeer dynamically removes a peer and all of its routes from the configuration. It returns the networks
+// that were routed to the peer so the caller can remove them from the TUN device.
+func (cfg *Config) RemovePeer(peerID peer.ID) ([]net.IPNet, error) {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return nil, errors.New("no such peer")
+	}
+	p := cfg.Peers[idx]
+
+	entries, err := cfg.peerRouteEntries(peerID)
+	if err != nil {
+		return nil, err
+	}
+	var removed []net.IPNet
+	for _, rte := range entries {
+		ok, err := cfg.RemoveRouteTo(rte.Net, peerID)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed = append(removed, rte.Net)
+		}
+	}
+
+	if n, ok := cfg.PeerLookup.ByName[strings.ToLower(p.Name)]; ok && n.ID == peerID {
+		delete(cfg.PeerLookup.ByName, strings.ToLower(p.Name))
+	}
+	netID := MkNetID(peerID)
+	if n, ok := cfg.PeerLookup.ByNetID[netID]; ok && n.ID == peerID {
+		delete(cfg.PeerLookup.ByNetID, netID)
+	}
+
+	// Build a new slice so holders of the old one don't observe shifted elements.
+	cfg.Peers = slices.Concat(cfg.Peers[:idx], cfg.Peers[idx+1:])
+
+	fmt.Printf("[-] Removed peer %s (/p2p/%s)\n", p.Name, peerID)
+	return removed, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RenamePeer dynamically changes the name of a peer in the configuration and all lookup tables.
+func (cfg *Config) RenamePeer(peerID peer.ID, name string) error {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return errors.New("no such peer")
+	}
+	if n, ok := cfg.PeerLookup.ByName[strings.ToLower(name)]; ok && n.ID != peerID {
+		return errors.New("peer name already exists")
+	}
+
+	p := cfg.Peers[idx]
+	oldName := p.Name
+	if n, ok := cfg.PeerLookup.ByName[strings.ToLower(oldName)]; ok && n.ID == peerID {
+		delete(cfg.PeerLookup.ByName, strings.ToLower(oldName))
+	}
+	p.Name = name
+	if err := cfg.storePeer(idx, p); err != nil {
+		return err
+	}
+
+	fmt.Printf("[+] Renamed peer %s to %s (/p2p/%s)\n", oldName, name, peerID)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetPeerACL dynamically replaces the packet filter of a peer. A nil acl lets the peer send anything, apart from
+// foreign source addresses unless allowAnySource is set.
+func (cfg *Config) SetPeerACL(peerID peer.ID, acl *ACL, allowAnySource bool) error {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return errors.New("no such peer")
+	}
+	p := cfg.Peers[idx]
+	p.ACL = acl
+	p.AllowAnySource = allowAnySource
+	return cfg.storePeer(idx, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetPeerAutoApprove dynamically changes whether the subnets announced by a peer are installed without approval.
+func (cfg *Config) SetPeerAutoApprove(peerID peer.ID, autoApprove bool) error {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return errors.New("no such peer")
+	}
+	p := cfg.Peers[idx]
+	p.AutoApproveRoutes = autoApprove
+	return cfg.storePeer(idx, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetPeerAddrs dynamically replaces the static addresses of a peer.
+func (cfg *Config) SetPeerAddrs(peerID peer.ID, addrs []multiaddr.Multiaddr) error {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return errors.New("no such peer")
+	}
+	p := cfg.Peers[idx]
+	p.Addrs = addrs
+	return cfg.storePeer(idx, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// storePeer writes an updated peer back to its slot in Peers and to every lookup table holding a copy of it.
+func (cfg *Config) storePeer(idx int, p Peer) error {
+	cfg.Peers[idx] = p
+	if p.Name != "" {
+		cfg.PeerLookup.ByName[strings.ToLower(p.Name)] = p
+	}
+	cfg.PeerLookup.ByNetID[MkNetID(p.ID)] = p
+
+	entries, err := cfg.peerRouteEntries(p.ID)
+	if err != nil {
+		return err
+	}
+	for _, rte := range entries {
+		rte.Target = p
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"slices"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Diff describes what changed between a running configuration and a freshly read one.
+type Diff struct {
+	AddedPeers       []Peer
+	RemovedPeers     []Peer
+	RenamedPeers     []Peer
+	ChangedACLs      []Peer
+	ChangedApprovals []Peer
+	ChangedTags      []Peer
+	ChangedAddrs     []Peer
+	AddedRoutes      []RouteTableEntry
+	RemovedRoutes    []RouteTableEntry
+	AddedServices    map[string]multiaddr.Multiaddr
+	RemovedServices  []string
+	AdvertiseChanged bool
+	// MembershipChanged is set if the network CA, the certificate of this node or the revocation list changed.
+	MembershipChanged bool
+	// PoliciesChanged is set if the relay or service access policies changed.
+	PoliciesChanged bool
+	// Changes to these can only be applied by restarting the daemon.
+	KeyChanged      bool
+	ListenChanged   bool
+	ExitNodeChanged bool
+	AddrsChanged    bool
+	MTUChanged      bool
+	// SettingsChanged is set if the swarm key, the IPFS API, the metrics listener or the routing settings changed.
+	SettingsChanged bool
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Empty reports whether the diff contains no changes at all.
+func (d Diff) Empty() bool {
+	return len(d.AddedPeers) == 0 && len(d.RemovedPeers) == 0 && len(d.RenamedPeers) == 0 && len(d.ChangedACLs) == 0 &&
+		len(d.ChangedApprovals) == 0 && len(d.ChangedTags) == 0 && len(d.ChangedAddrs) == 0 &&
+		!d.AdvertiseChanged && !d.MembershipChanged && !d.PoliciesChanged &&
+		len(d.AddedRoutes) == 0 && len(d.RemovedRoutes) == 0 &&
+		len(d.AddedServices) == 0 && len(d.RemovedServices) == 0 &&
+		!d.KeyChanged && !d.ListenChanged && !d.ExitNodeChanged && !d.AddrsChanged && !d.MTUChanged && !d.SettingsChanged
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Diff compares the running configuration with next and returns the changes needed to turn one into the other.
+// Routes of removed peers are not listed separately, RemovePeer already takes care of them.
+func (cfg *Config) Diff(next *Config) (Diff, error) {
+	d := Diff{
+		AddedServices: make(map[string]multiaddr.Multiaddr),
+	}
+
+	d.KeyChanged = !cfg.fileKey().Equals(next.PrivateKey)
+	d.SettingsChanged = !cfg.Settings.equal(next.Settings) || cfg.Private != next.Private ||
+		!slices.Equal(cfg.DelegatedRouting, next.DelegatedRouting) ||
+		!slices.EqualFunc(cfg.BootstrapPeers, next.BootstrapPeers, multiaddr.Multiaddr.Equal)
+	d.ListenChanged = len(cfg.ListenAddresses) != len(next.ListenAddresses)
+	for i := 0; !d.ListenChanged && i < len(cfg.ListenAddresses); i++ {
+		d.ListenChanged = !cfg.ListenAddresses[i].Equal(next.ListenAddresses[i])
+	}
+
+	d.ExitNodeChanged = cfg.ExitNode != next.ExitNode
+	d.MTUChanged = cfg.MTU != next.MTU
+	d.AddrsChanged = !cfg.BuiltinAddr4.Equal(next.BuiltinAddr4) || !cfg.BuiltinAddr6.Equal(next.BuiltinAddr6) ||
+		cfg.Net4.String() != next.Net4.String() || cfg.Net6.String() != next.Net6.String() ||
+		cfg.ServiceNet.String() != next.ServiceNet.String()
+	d.AdvertiseChanged = len(cfg.AdvertiseRoutes) != len(next.AdvertiseRoutes)
+	for _, r := range next.AdvertiseRoutes {
+		d.AdvertiseChanged = d.AdvertiseChanged || !containsNet(cfg.AdvertiseRoutes, r)
+	}
+
+	d.MembershipChanged = cfg.CA != next.CA || !sameCertificate(cfg.Certificate, next.Certificate) ||
+		!sameRevocations(cfg.Revocations, next.Revocations)
+
+	d.PoliciesChanged = !slices.Equal(cfg.Relay.Spec(), next.Relay.Spec()) ||
+		len(cfg.ServiceAccess) != len(next.ServiceAccess)
+	for name, set := range next.ServiceAccess {
+		old, found := cfg.ServiceAccess[name]
+		d.PoliciesChanged = d.PoliciesChanged || !found || !slices.Equal(old.Spec(), set.Spec())
+	}
+
+	// Members never appear in the config file. One that is added to it is replaced by the configured peer.
+	for _, p := range cfg.Peers {
+		_, found := FindPeer(next.Peers, p.ID)
+		if found == (p.Certificate != nil) {
+			d.RemovedPeers = append(d.RemovedPeers, p)
+		}
+	}
+
+	for _, np := range next.Peers {
+		var oldRoutes []net.IPNet
+		op, found := FindPeer(cfg.Peers, np.ID)
+		if found && op.Certificate == nil {
+			if op.Name != np.Name {
+				d.RenamedPeers = append(d.RenamedPeers, np)
+			}
+			if !sameACL(op.ACL, np.ACL) || op.AllowAnySource != np.AllowAnySource {
+				d.ChangedACLs = append(d.ChangedACLs, np)
+			}
+			if !op.BuiltinAddr4.Equal(np.BuiltinAddr4) || !op.BuiltinAddr6.Equal(np.BuiltinAddr6) {
+				d.AddrsChanged = true
+			}
+			if op.AutoApproveRoutes != np.AutoApproveRoutes {
+				d.ChangedApprovals = append(d.ChangedApprovals, np)
+			}
+			if !slices.Equal(op.Tags, np.Tags) {
+				d.ChangedTags = append(d.ChangedTags, np)
+			}
+			if !slices.EqualFunc(op.Addrs, np.Addrs, multiaddr.Multiaddr.Equal) {
+				d.ChangedAddrs = append(d.ChangedAddrs, np)
+			}
+			routes, err := cfg.PeerRoutes(np.ID)
+			if err != nil {
+				return d, err
+			}
+			oldRoutes = routes
+		} else {
+			d.AddedPeers = append(d.AddedPeers, np)
+		}
+
+		newRoutes, err := next.PeerRoutes(np.ID)
+		if err != nil {
+			return d, err
+		}
+		for _, r := range newRoutes {
+			if !containsNet(oldRoutes, r) {
+				d.AddedRoutes = append(d.AddedRoutes, RouteTableEntry{Net: r, Target: np})
+			}
+		}
+		for _, r := range oldRoutes {
+			if !containsNet(newRoutes, r) {
+				d.RemovedRoutes = append(d.RemovedRoutes, RouteTableEntry{Net: r, Target: *op})
+			}
+		}
+	}
+
+	for name, addr := range next.Services {
+		if old, ok := cfg.Services[name]; !ok || !old.Equal(addr) {
+			d.AddedServices[name] = addr
+		}
+	}
+	for name := range cfg.Services {
+		if _, ok := next.Services[name]; !ok {
+			d.RemovedServices = append(d.RemovedServices, name)
+		}
+	}
+	return d, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sameACL(a, b *ACL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(a.Spec(), b.Spec())
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sameCertificate(a, b *Certificate) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Envelope, b.Envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sameRevocations(a, b *RevocationList) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Envelope, b.Envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func containsNet(nets []net.IPNet, needle net.IPNet) bool {
+	for _, n := range nets {
+		if n.IP.Equal(needle.IP) && n.Mask.String() == needle.Mask.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/soitun/mynetwork/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Format is the syntax a config file is written in. Every format is decoded into the same schema.Config.
+type Format string
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Formats lists the supported formats in the order config files are looked for.
+var Formats = []Format{FormatJSON, FormatYAML, FormatTOML}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// formatExtensions maps the file extensions of config files to their format.
+var formatExtensions = map[string]Format{
+	".json": FormatJSON,
+	".yaml": FormatYAML,
+	".yml":  FormatYAML,
+	".toml": FormatTOML,
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ErrTOMLComments is returned when writing back a TOML config file with comments, which the TOML encoder can't keep.
+var ErrTOMLComments = errors.New("writing the config would drop the comments of the TOML file, change it by hand or convert it to YAML")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// tomlStatement matches the first statement of a TOML document: a table header or a key/value pair.
+var tomlStatement = regexp.MustCompile(`^(\[|[A-Za-z0-9_."'-]+\s*=)`)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseFormat parses the name of a format.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if strings.EqualFold(s, string(f)) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown config format %q, expected one of json, yaml or toml", s)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Extension returns the file extension used for config files of the format.
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ExtensionFormat returns the format the extension of path stands for, and false for other extensions.
+func ExtensionFormat(path string) (Format, bool) {
+	f, ok := formatExtensions[strings.ToLower(filepath.Ext(path))]
+	return f, ok
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DetectFormat determines the format of a config file from its extension or, for unknown extensions, from its
+// contents.
+func DetectFormat(path string, data []byte) Format {
+	if f, ok := ExtensionFormat(path); ok {
+		return f
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return FormatJSON
+		case tomlStatement.MatchString(line):
+			return FormatTOML
+		}
+		return FormatYAML
+	}
+	return FormatJSON
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// toJSON converts a config file into JSON, so that every format goes through the same decoding and validation.
+func (f Format) toJSON(data []byte) ([]byte, error) {
+	var doc any
+	switch f {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			// An empty document, which the validation reports like an empty JSON object.
+			doc = map[string]any{}
+		}
+	case FormatTOML:
+		if _, err := toml.Decode(string(data), &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return data, nil
+	}
+	return json.Marshal(doc)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Marshal encodes a config in the format. previous holds the current contents of the file being replaced, if any;
+// the comments of a YAML file and the order of its keys and list items are carried over to the new contents.
+func (f Format) Marshal(cfg schema.Config, previous []byte) ([]byte, error) {
+	data, err := json.MarshalIndent(&cfg, "", "  ")
+	if err != nil || f == FormatJSON || f == "" {
+		return data, err
+	}
+	switch f {
+	case FormatYAML:
+		// Going through a node keeps the keys in the order of the schema.
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		prepareYAML(&doc)
+		var old yaml.Node
+		if len(previous) > 0 && yaml.Unmarshal(previous, &old) == nil {
+			layout := yamlLayout{comments: make(map[string]yamlComments), order: make(map[string]int)}
+			layout.collect(&old, "")
+			layout.apply(&doc, "")
+		}
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case FormatTOML:
+		// Numbers are kept as written, decoding them as float64 would turn mtu = 1400 into 1400.0.
+		var doc map[string]any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		enc := toml.NewEncoder(&buf)
+		enc.Indent = ""
+		if err := enc.Encode(tomlValues(doc)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown config format %q", f)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// prepareYAML turns a node tree decoded from JSON into block style YAML and leaves out null values.
+func prepareYAML(n *yaml.Node) {
+	n.Style = 0
+	if n.Kind == yaml.MappingNode {
+		content := n.Content[:0]
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i+1].Tag != "!!null" {
+				content = append(content, n.Content[i], n.Content[i+1])
+			}
+		}
+		n.Content = content
+	}
+	for _, c := range n.Content {
+		prepareYAML(c)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// yamlComments are the comments attached to a single YAML node.
+type yamlComments struct {
+	head, line, foot string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// yamlLayout is what a YAML file written by hand has beyond its values: the comments of every node and the order of
+// the keys, both keyed by the path of the node. Items of lists are identified by their id or net, so their comments
+// stay with them when other items are added or removed.
+type yamlLayout struct {
+	comments map[string]yamlComments
+	order    map[string]int
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (l yamlLayout) collect(n *yaml.Node, path string) {
+	if n.HeadComment != "" || n.LineComment != "" || n.FootComment != "" {
+		l.comments[path] = yamlComments{n.HeadComment, n.LineComment, n.FootComment}
+	}
+	walkYAML(n, path, func(child *yaml.Node, childPath string) {
+		l.order[childPath] = len(l.order)
+		l.collect(child, childPath)
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// apply restores the layout on a newly encoded tree. Keys and items that weren't in the old file follow the ones
+// that were.
+func (l yamlLayout) apply(n *yaml.Node, path string) {
+	if c, ok := l.comments[path]; ok {
+		n.HeadComment, n.LineComment, n.FootComment = c.head, c.line, c.foot
+	}
+	// Sort the children by their position in the old file, as groups of key and value for mappings.
+	var groups [][]*yaml.Node
+	var ranks []int
+	walkYAML(n, path, func(child *yaml.Node, childPath string) {
+		rank, ok := l.order[childPath]
+		if !ok {
+			rank = len(l.order)
+		}
+		if n.Kind == yaml.MappingNode && !strings.HasSuffix(childPath, "#key") {
+			groups[len(groups)-1] = append(groups[len(groups)-1], child)
+			return
+		}
+		groups = append(groups, []*yaml.Node{child})
+		ranks = append(ranks, rank)
+	})
+	idx := make([]int, len(groups))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortStableFunc(idx, func(a, b int) int { return ranks[a] - ranks[b] })
+	n.Content = n.Content[:0]
+	for _, i := range idx {
+		n.Content = append(n.Content, groups[i]...)
+	}
+	walkYAML(n, path, func(child *yaml.Node, childPath string) {
+		l.apply(child, childPath)
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// walkYAML calls fn with the children of n and their paths. Mapping keys get their own path, since comments above
+// a key are attached to the key and not to its value.
+func walkYAML(n *yaml.Node, path string, fn func(*yaml.Node, string)) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			fn(c, path+"/")
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := path + "." + n.Content[i].Value
+			fn(n.Content[i], key+"#key")
+			fn(n.Content[i+1], key)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			fn(c, fmt.Sprintf("%s[%s]", path, yamlItemID(c, i)))
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// yamlItemID identifies an item of a list by its id or net, falling back to its index.
+func yamlItemID(n *yaml.Node, i int) string {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value
+	case yaml.MappingNode:
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if k := n.Content[j].Value; k == "id" || k == "net" {
+				return n.Content[j+1].Value
+			}
+		}
+	}
+	return fmt.Sprint(i)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// tomlHasComments reports whether a TOML document has comments, not counting # inside strings.
+func tomlHasComments(data []byte) bool {
+	s := string(data)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '#':
+			return true
+		case strings.HasPrefix(s[i:], `"""`) || strings.HasPrefix(s[i:], "'''"):
+			end := strings.Index(s[i+3:], s[i:i+3])
+			if end < 0 {
+				return false
+			}
+			i += 3 + end + 2
+		case s[i] == '"' || s[i] == '\'':
+			// Basic strings may escape their quote, literal strings can't.
+			j := i + 1
+			for ; j < len(s) && s[j] != s[i] && s[j] != '\n'; j++ {
+				if s[i] == '"' && s[j] == '\\' {
+					j++
+				}
+			}
+			i = j
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// tomlValues removes the null values TOML has no representation for and turns numbers into integers where they are
+// whole.
+func tomlValues(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if item == nil {
+				delete(v, k)
+			} else {
+				v[k] = tomlValues(item)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = tomlValues(item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
@@ -2,38 +2,67 @@ package config
 
 import (
 	"net"
+	"slices"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func mkBuiltinAddr4(p peer.ID) net.IP {
-	builtinAddr := []byte{100, 64, 1, 2}
+// Default overlay ranges, used unless the config file sets its own.
+var (
+	DefaultNet4       = net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(16, 32)}
+	DefaultNet6       = net.IPNet{IP: net.IP("\xfd\x00hyprspace\x00\x00\x00\x00\x00"), Mask: net.CIDRMask(96, 128)}
+	DefaultServiceNet = net.IPNet{IP: net.IP("\xfd\x00hyprspsv\x00\x00\x00\x00\x00\x00"), Mask: net.CIDRMask(80, 128)}
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MTU limits. IPv6 needs at least 1280 bytes on every link, and every packet has to fit into a single frame.
+const (
+	DefaultMTU = 1420
+	MinMTU     = 1280
+	MaxMTU     = 9000
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func mkBuiltinAddr4(n net.IPNet, p peer.ID) net.IP {
+	fold := []byte{1, 2}
 	for i, b := range []byte(p) {
-		builtinAddr[(i%2)+2] ^= b
+		fold[i%2] ^= b
 	}
-	return net.IP(builtinAddr).To4()
+	return hostAddr(n, fold)
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func mkBuiltinAddr6(p peer.ID) net.IP {
-	builtinAddr := []byte("\xfd\x00hyprspace\x00\x00\x00\x00\x00")
-	for i, b := range []byte(p) {
-		builtinAddr[(i%4)+12] ^= b
-	}
+func mkBuiltinAddr6(n net.IPNet, p peer.ID) net.IP {
 	netId := MkNetID(p)
-	builtinAddr[12], builtinAddr[13], builtinAddr[14], builtinAddr[15] = netId[0], netId[1], netId[2], netId[3]
-	return net.IP(builtinAddr).To16()
+	return hostAddr(n, netId[:])
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// hostAddr fills the host part of n with the trailing bits of bits.
+func hostAddr(n net.IPNet, bits []byte) net.IP {
+	addr := slices.Clone(n.IP)
+	if len(addr) == net.IPv6len && len(n.Mask) == net.IPv4len {
+		addr = addr.To4()
+	}
+	offset := len(addr) - len(bits)
+	for i, b := range bits {
+		if j := offset + i; j >= 0 {
+			addr[j] |= b &^ n.Mask[j]
+		}
+	}
+	return addr
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func MkServiceAddr6(p peer.ID, serviceName string) net.IP {
-	serviceAddr := []byte("\xfd\x00hyprspsv\x00\x00\x00\x00\x00\x00")
+// MkServiceAddr6 returns the address of a service of p inside the /80 service network n.
+func MkServiceAddr6(n net.IPNet, p peer.ID, serviceName string) net.IP {
+	serviceAddr := slices.Clone(n.IP.To16())
 	netId := MkNetID(p)
 	serviceAddr[10], serviceAddr[11], serviceAddr[12], serviceAddr[13] = netId[0], netId[1], netId[2], netId[3]
 	svcId := MkServiceID(serviceName)
 	serviceAddr[14], serviceAddr[15] = svcId[0], svcId[1]
-	return net.IP(serviceAddr).To16()
+	return serviceAddr
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/soitun/mynetwork/schema"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// includeFile is the part of the config that drop-in files may set.
+type includeFile struct {
+	Peers    []schema.Peer     `json:"peers"`
+	Services map[string]string `json:"services"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// includeType is the type drop-in files are decoded into, checked for unknown keys.
+var includeType = reflect.TypeOf(includeFile{})
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// origin is where a value merged in from a drop-in file is defined: the validator of that file and its path there.
+type origin struct {
+	v    *validator
+	path string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// expandInclude returns the files an include entry refers to, sorted by name. A directory stands for every config
+// file in it.
+func expandInclude(configPath string, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(configPath), pattern)
+	}
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	} else if err == nil {
+		return []string{pattern}, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	var files []string
+	for _, match := range matches {
+		if _, known := formatExtensions[strings.ToLower(filepath.Ext(match))]; !known || match == configPath {
+			continue
+		}
+		if fi, err := os.Stat(match); err == nil && fi.Mode().IsRegular() {
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// includePatterns returns the include entries of the config file at path, nil if it can't be read.
+func includePatterns(path string) []string {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	doc, err := DetectFormat(path, in).toJSON(in)
+	if err != nil {
+		return nil
+	}
+	var input struct {
+		Include []string `json:"include"`
+	}
+	if json.Unmarshal(doc, &input) != nil {
+		return nil
+	}
+	return input.Include
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// IncludedFiles returns the config file at path followed by the drop-in files it includes at the moment.
+func IncludedFiles(path string) []string {
+	files := []string{path}
+	for _, pattern := range includePatterns(path) {
+		matches, _ := expandInclude(path, pattern)
+		files = append(files, matches...)
+	}
+	return files
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// IncludedDirs returns the directory of the config file at path followed by the existing directories its include
+// entries look into, so drop-in files created there later are noticed too.
+func IncludedDirs(path string) []string {
+	dirs := []string{filepath.Dir(path)}
+	for _, pattern := range includePatterns(path) {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		dir := pattern
+		if fi, err := os.Stat(pattern); err != nil || !fi.IsDir() {
+			dir = filepath.Dir(pattern)
+		}
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() && !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// include merges the peers and services of a drop-in file into input. Problems are reported against the drop-in file,
+// including those found later while validating the merged config.
+func (v *validator) include(file string, input *schema.Config) {
+	in, err := os.ReadFile(file)
+	if err != nil {
+		v.diags = append(v.diags, Diagnostic{Severity: SeverityError, File: file, Message: err.Error()})
+		return
+	}
+	format := DetectFormat(file, in)
+	sub := newValidator(file, in, format)
+	defer func() { v.diags = append(v.diags, sub.diags...) }()
+
+	doc, err := format.toJSON(in)
+	if err != nil {
+		sub.reportSyntax(err)
+		return
+	}
+	var fragment includeFile
+	if err := json.Unmarshal(doc, &fragment); err != nil {
+		sub.reportJSON(err)
+		return
+	}
+	var raw map[string]any
+	_ = json.Unmarshal(doc, &raw)
+	for key := range raw {
+		if _, found := jsonField(includeType, key); !found {
+			if _, found := jsonField(schemaType, key); found {
+				sub.errorf(key, "%s can only be set in the main config file", key)
+				delete(raw, key)
+			}
+		}
+	}
+	sub.checkFields(raw, includeType, "")
+
+	for i, p := range fragment.Peers {
+		v.origins[fmt.Sprintf("peers[%d]", len(input.Peers))] = origin{sub, fmt.Sprintf("peers[%d]", i)}
+		input.Peers = append(input.Peers, p)
+	}
+	names := make([]string, 0, len(fragment.Services))
+	for name := range fragment.Services {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		field := joinPath("services", name)
+		if _, dup := input.Services[name]; dup {
+			sub.errorf(field, "service %q is already defined in %s", name, v.source(field))
+			continue
+		}
+		if input.Services == nil {
+			input.Services = make(map[string]string)
+		}
+		v.origins[field] = origin{sub, field}
+		input.Services[name] = fragment.Services[name]
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// resolve finds the validator of the file a field is defined in and the path of the field there.
+func (v *validator) resolve(field string) (*validator, string) {
+	for path := field; path != ""; path = parentPath(path) {
+		if o, ok := v.origins[path]; ok {
+			return o.v, o.path + strings.TrimPrefix(field, path)
+		}
+	}
+	return v, field
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// source returns the file a field is defined in.
+func (v *validator) source(field string) string {
+	sub, _ := v.resolve(field)
+	return sub.file
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// locate describes where a field is defined, for messages that point at another value than the one reported.
+func (v *validator) locate(field string) string {
+	sub, path := v.resolve(field)
+	if sub == v {
+		return path
+	}
+	return fmt.Sprintf("%s in %s", path, sub.file)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AdoptSources takes over the drop-in files and which of them each peer and service comes from, after the config
+// file has been read again as next.
+func (cfg *Config) AdoptSources(next *Config) {
+	cfg.Include, cfg.ServiceSources = next.Include, next.ServiceSources
+	for _, np := range next.Peers {
+		idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == np.ID })
+		if idx >= 0 && cfg.Peers[idx].Source != np.Source {
+			p := cfg.Peers[idx]
+			p.Source = np.Source
+			_ = cfg.storePeer(idx, p)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DefaultInviteExpiry is how long an invite can be used if no expiry is given.
+const DefaultInviteExpiry = 24 * time.Hour
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// invitePrefix marks invite tokens, so they can't be confused with other base64 strings.
+const invitePrefix = "mninv1."
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// inviteDomain separates the signatures of invites from other records signed with the same key.
+const inviteDomain = "mynetwork-invite"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var inviteCodec = []byte("/mynetwork/invite")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Invite lets a new node join the network of the node that issued it. It is signed by the inviter and carries a
+// secret that the inviter accepts once.
+type Invite struct {
+	Inviter peer.ID
+	// Host is the name the new node gives the inviter.
+	Host  string
+	Addrs []multiaddr.Multiaddr
+	// Name is the name the inviter gives the new node, empty to let the new node pick one.
+	Name    string
+	Secret  []byte
+	Expires time.Time
+	// Net4, Net6 and ServiceNet are the overlay ranges of the network.
+	Net4       net.IPNet
+	Net6       net.IPNet
+	ServiceNet net.IPNet
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// inviteRecord is the signed payload of an Invite.
+type inviteRecord struct {
+	Host       string    `json:"host,omitempty"`
+	Addrs      []string  `json:"addrs"`
+	Name       string    `json:"name,omitempty"`
+	Secret     []byte    `json:"secret"`
+	Expires    time.Time `json:"expires"`
+	Network4   string    `json:"network4,omitempty"`
+	Network6   string    `json:"network6,omitempty"`
+	ServiceNet string    `json:"serviceNetwork,omitempty"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (inv *Invite) Domain() string {
+	return inviteDomain
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (inv *Invite) Codec() []byte {
+	return inviteCodec
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (inv *Invite) MarshalRecord() ([]byte, error) {
+	rec := inviteRecord{
+		Host:    inv.Host,
+		Name:    inv.Name,
+		Secret:  inv.Secret,
+		Expires: inv.Expires.UTC(),
+	}
+	// The default overlay ranges are left out to keep tokens short.
+	if inv.Net4.String() != DefaultNet4.String() {
+		rec.Network4 = inv.Net4.String()
+	}
+	if inv.Net6.String() != DefaultNet6.String() {
+		rec.Network6 = inv.Net6.String()
+	}
+	if inv.ServiceNet.String() != DefaultServiceNet.String() {
+		rec.ServiceNet = inv.ServiceNet.String()
+	}
+	for _, addr := range inv.Addrs {
+		rec.Addrs = append(rec.Addrs, addr.String())
+	}
+	return json.Marshal(rec)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (inv *Invite) UnmarshalRecord(data []byte) error {
+	var rec inviteRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	inv.Addrs = nil
+	for _, s := range rec.Addrs {
+		addr, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		inv.Addrs = append(inv.Addrs, addr)
+	}
+	for _, n := range []struct {
+		s   string
+		def net.IPNet
+		out *net.IPNet
+	}{{rec.Network4, DefaultNet4, &inv.Net4}, {rec.Network6, DefaultNet6, &inv.Net6}, {rec.ServiceNet, DefaultServiceNet, &inv.ServiceNet}} {
+		if n.s == "" {
+			*n.out = n.def
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n.s)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", n.s)
+		}
+		*n.out = *ipnet
+	}
+	if len(rec.Secret) == 0 {
+		return errors.New("invite has no secret")
+	}
+	inv.Host = rec.Host
+	inv.Name = rec.Name
+	inv.Secret = rec.Secret
+	inv.Expires = rec.Expires
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewInvite creates an invite into the network of cfg, valid until expires. The inviter is reachable at addrs.
+func (cfg *Config) NewInvite(host, name string, addrs []multiaddr.Multiaddr, expires time.Time) (*Invite, error) {
+	self, err := peer.IDFromPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Invite{
+		Inviter:    self,
+		Host:       host,
+		Addrs:      addrs,
+		Name:       name,
+		Secret:     secret,
+		Expires:    expires.Truncate(time.Second),
+		Net4:       cfg.Net4,
+		Net6:       cfg.Net6,
+		ServiceNet: cfg.ServiceNet,
+	}, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Token signs the invite with the key of the inviter and encodes it for sharing.
+func (inv *Invite) Token(key crypto.PrivKey) (string, error) {
+	env, err := record.Seal(inv, key)
+	if err != nil {
+		return "", err
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseInvite checks the signature of an invite token and returns its contents.
+func ParseInvite(token string) (*Invite, error) {
+	token = strings.TrimSpace(token)
+	if !strings.HasPrefix(token, invitePrefix) {
+		return nil, errors.New("not an invite token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token[len(invitePrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %w", err)
+	}
+	inv := &Invite{}
+	env, err := record.ConsumeTypedEnvelope(data, inv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid invite: %w", err)
+	}
+	if !bytes.Equal(env.PayloadType, inviteCodec) {
+		return nil, errors.New("not an invite token")
+	}
+	if inv.Inviter, err = peer.IDFromPublicKey(env.PublicKey); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(inv.Expires) {
+		return nil, fmt.Errorf("invite expired at %s", inv.Expires.Local().Format(time.RFC1123))
+	}
+	return inv, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// CheckInvite reports whether this node can join with an invite and returns the name it gives the inviter.
+func (cfg *Config) CheckInvite(inv *Invite) (string, error) {
+	if cfg.Net4.String() != inv.Net4.String() || cfg.Net6.String() != inv.Net6.String() ||
+		cfg.ServiceNet.String() != inv.ServiceNet.String() {
+		return "", fmt.Errorf("the network uses the overlay ranges %s %s %s, but %s %s %s are configured",
+			&inv.Net4, &inv.Net6, &inv.ServiceNet, &cfg.Net4, &cfg.Net6, &cfg.ServiceNet)
+	}
+	if self, err := peer.IDFromPrivateKey(cfg.PrivateKey); err != nil || self == inv.Inviter {
+		return "", errors.New("the invite has been issued by this node")
+	}
+	if p, found := FindPeer(cfg.Peers, inv.Inviter); found {
+		return "", fmt.Errorf("the inviter is already configured as %s", p.Name)
+	}
+	name := inv.Host
+	if name == "" {
+		id := inv.Inviter.String()
+		name = "peer-" + id[len(id)-6:]
+	}
+	if _, found := FindPeerByName(cfg.Peers, name); found {
+		return "", fmt.Errorf("a peer named %s is already configured", name)
+	}
+	return name, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PreferredAddrs returns the addresses a node gets when none of them collide with another node.
+func (cfg *Config) PreferredAddrs(id peer.ID) (net.IP, net.IP) {
+	return addrCandidates4(cfg.Net4)(id, 0), addrCandidates6(cfg.Net6)(id, 0)
+}
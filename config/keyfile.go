@@ -0,0 +1,277 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/multiformats/go-multibase"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Encrypted private keys look like $mynetwork-key$v=1$scrypt$ln=15,r=8,p=1$<salt>$<nonce and ciphertext>. The key is
+// sealed with XChaCha20-Poly1305 under a key derived from the passphrase with scrypt; everything up to the salt is
+// authenticated as additional data.
+const encryptedKeyPrefix = "$mynetwork-key$"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// scrypt cost parameters for newly encrypted keys.
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PassphraseEnv names the environment variable that holds the passphrase of an encrypted private key.
+const PassphraseEnv = "MYNETWORK_KEY_PASSPHRASE"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PassphraseCredential names the systemd credential that holds the passphrase of an encrypted private key.
+const PassphraseCredential = "mynetwork-key-passphrase"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PassphrasePrompt asks the user for the passphrase of an encrypted private key. It is nil if there is nobody to ask.
+var PassphrasePrompt func(prompt string) ([]byte, error)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// unlockedKeys caches decrypted keys by their encrypted form, so reloading the config doesn't ask again.
+var unlockedKeys sync.Map
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type unlockedKey struct {
+	key        crypto.PrivKey
+	passphrase []byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// keyEncoding is how the private key of a config is stored. encoded is cached, so that saving the config doesn't
+// encrypt an unchanged key again with a new salt.
+type keyEncoding struct {
+	key        crypto.PrivKey
+	encoded    string
+	passphrase []byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// IsEncryptedKey reports whether s is a passphrase encrypted private key.
+func IsEncryptedKey(s string) bool {
+	return strings.HasPrefix(s, encryptedKeyPrefix)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// EncodeKey encodes a private key for a config or key file, encrypted if a passphrase is given.
+func EncodeKey(key crypto.PrivKey, passphrase []byte) (string, error) {
+	keyBytes, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	if passphrase == nil {
+		return multibase.MustNewEncoder(multibase.Base58BTC).Encode(keyBytes), nil
+	}
+
+	salt := make([]byte, 16)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := fmt.Sprintf("%sv=1$scrypt$ln=%d,r=%d,p=%d$%s$", encryptedKeyPrefix, scryptLogN, scryptR, scryptP,
+		base64.RawStdEncoding.EncodeToString(salt))
+	aead, err := keyCipher(passphrase, salt, scryptLogN, scryptR, scryptP)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, keyBytes, []byte(header))
+	return header + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// decryptKey decrypts a key encoded by EncodeKey with a passphrase.
+func decryptKey(s string, passphrase []byte) (crypto.PrivKey, error) {
+	fields := strings.Split(strings.TrimPrefix(s, encryptedKeyPrefix), "$")
+	if len(fields) != 5 || fields[0] != "v=1" || fields[1] != "scrypt" {
+		return nil, errors.New("unsupported encrypted key format")
+	}
+	var logN, r, p int
+	if _, err := fmt.Sscanf(fields[2], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil || logN < 1 || logN > 30 {
+		return nil, errors.New("invalid scrypt parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return nil, errors.New("invalid salt")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil || len(sealed) < chacha20poly1305.NonceSizeX {
+		return nil, errors.New("invalid ciphertext")
+	}
+	aead, err := keyCipher(passphrase, salt, logN, r, p)
+	if err != nil {
+		return nil, err
+	}
+	header := s[:strings.LastIndex(s, "$")+1]
+	keyBytes, err := aead.Open(nil, sealed[:chacha20poly1305.NonceSizeX], sealed[chacha20poly1305.NonceSizeX:], []byte(header))
+	if err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return crypto.UnmarshalPrivateKey(keyBytes)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func keyCipher(passphrase, salt []byte, logN, r, p int) (interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, r, p, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DecodeKey decodes a private key from a config or key file. Encrypted keys are unlocked with the passphrase from
+// $MYNETWORK_KEY_PASSPHRASE, from the systemd credential mynetwork-key-passphrase or from PassphrasePrompt, in this
+// order. The passphrase is returned along with the key, nil for plaintext keys.
+func DecodeKey(s string) (crypto.PrivKey, []byte, error) {
+	if !IsEncryptedKey(s) {
+		_, keyBytes, err := multibase.Decode(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		key, err := crypto.UnmarshalPrivateKey(keyBytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		return key, nil, nil
+	}
+	if cached, ok := unlockedKeys.Load(s); ok {
+		return cached.(unlockedKey).key, cached.(unlockedKey).passphrase, nil
+	}
+
+	passphrase, prompted, err := readPassphrase("Passphrase for the private key: ")
+	for attempt := 1; err == nil; attempt++ {
+		var key crypto.PrivKey
+		key, err = decryptKey(s, passphrase)
+		if err == nil {
+			unlockedKeys.Store(s, unlockedKey{key, passphrase})
+			return key, passphrase, nil
+		}
+		if !prompted || attempt == 3 {
+			break
+		}
+		passphrase, _, err = readPassphrase("Wrong passphrase, try again: ")
+	}
+	return nil, nil, fmt.Errorf("unable to unlock private key: %w", err)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewPassphrase returns the passphrase to encrypt a new key with, from the same sources as DecodeKey. A passphrase
+// typed at the prompt has to be entered twice.
+func NewPassphrase() ([]byte, error) {
+	passphrase, prompted, err := readPassphrase("Passphrase for the private key: ")
+	if err != nil || !prompted {
+		return passphrase, err
+	}
+	again, _, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// readPassphrase looks up a passphrase and reports whether it has been typed by the user.
+func readPassphrase(prompt string) ([]byte, bool, error) {
+	if s, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(s), false, nil
+	}
+	if dir, ok := os.LookupEnv("CREDENTIALS_DIRECTORY"); ok {
+		data, err := os.ReadFile(filepath.Join(dir, PassphraseCredential))
+		if err == nil {
+			return bytes.TrimRight(data, "\r\n"), false, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, false, err
+		}
+	}
+	if PassphrasePrompt == nil {
+		return nil, false, fmt.Errorf("the key is encrypted, but neither $%s nor the %s credential is set", PassphraseEnv, PassphraseCredential)
+	}
+	passphrase, err := PassphrasePrompt(prompt)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(passphrase) == 0 {
+		return nil, false, errors.New("empty passphrase")
+	}
+	return passphrase, true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// keyFilePath resolves the path of the key file, which is relative to the directory of the config file at configPath.
+func (cfg *Config) keyFilePath(configPath string) string {
+	if filepath.IsAbs(cfg.KeyFile) {
+		return cfg.KeyFile
+	}
+	return filepath.Join(filepath.Dir(configPath), cfg.KeyFile)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// storedKey returns the private key as it is written to disk and reports whether it differs from what has been read
+// or written before.
+func (cfg *Config) storedKey() (string, bool, error) {
+	key := cfg.fileKey()
+	if cfg.keyEnc.key != nil && cfg.keyEnc.key.Equals(key) {
+		return cfg.keyEnc.encoded, false, nil
+	}
+	encoded, err := EncodeKey(key, cfg.keyEnc.passphrase)
+	if err != nil {
+		return "", false, err
+	}
+	cfg.keyEnc = keyEncoding{key, encoded, cfg.keyEnc.passphrase}
+	return encoded, true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetKeyFile moves the private key into file on the next Save, or back into the config file if file is empty.
+func (cfg *Config) SetKeyFile(file string) {
+	cfg.KeyFile = file
+	cfg.keyEnc.key = nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetKeyPassphrase encrypts the private key with passphrase on the next Save, or stores it in plain text if
+// passphrase is nil.
+func (cfg *Config) SetKeyPassphrase(passphrase []byte) {
+	cfg.keyEnc = keyEncoding{passphrase: passphrase}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyEncrypted reports whether the private key is stored encrypted.
+func (cfg *Config) KeyEncrypted() bool {
+	return cfg.keyEnc.passphrase != nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyFilePath returns the path of the file holding the private key, empty if it is stored in the config file.
+func (cfg *Config) KeyFilePath() string {
+	if cfg.KeyFile == "" {
+		return ""
+	}
+	return cfg.keyFilePath(cfg.Path)
+}
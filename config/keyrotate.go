@@ -0,0 +1,229 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DefaultKeyGrace is how long peers accept the previous identity of a node after it rotated its key.
+const DefaultKeyGrace = 7 * 24 * time.Hour
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// keyTransitionDomain separates the signatures of key transitions from other records signed with the same key.
+const keyTransitionDomain = "mynetwork-key-transition"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var keyTransitionCodec = []byte("/mynetwork/key-transition")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyTransition hands the identity of a node over from its previous key to a new one. It is signed with the previous
+// key, so every peer that knows the old peer ID can check it. The node keeps its VPN addresses across the change.
+type KeyTransition struct {
+	Old     peer.ID
+	New     peer.ID
+	Addr4   net.IP
+	Addr6   net.IP
+	Expires time.Time
+	// Envelope is the signed record as it is sent to peers and stored in config files.
+	Envelope []byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// keyTransitionRecord is the signed payload of a KeyTransition.
+type keyTransitionRecord struct {
+	Old     string    `json:"old"`
+	New     string    `json:"new"`
+	Addr4   string    `json:"addr4"`
+	Addr6   string    `json:"addr6"`
+	Expires time.Time `json:"expires"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (t *KeyTransition) Domain() string {
+	return keyTransitionDomain
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (t *KeyTransition) Codec() []byte {
+	return keyTransitionCodec
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (t *KeyTransition) MarshalRecord() ([]byte, error) {
+	return json.Marshal(keyTransitionRecord{
+		Old:     t.Old.String(),
+		New:     t.New.String(),
+		Addr4:   t.Addr4.String(),
+		Addr6:   t.Addr6.String(),
+		Expires: t.Expires.UTC(),
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (t *KeyTransition) UnmarshalRecord(data []byte) error {
+	var rec keyTransitionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	var err error
+	if t.Old, err = peer.Decode(rec.Old); err != nil {
+		return fmt.Errorf("invalid previous peer ID: %w", err)
+	}
+	if t.New, err = peer.Decode(rec.New); err != nil {
+		return fmt.Errorf("invalid new peer ID: %w", err)
+	}
+	if t.Addr4 = net.ParseIP(rec.Addr4).To4(); t.Addr4 == nil {
+		return fmt.Errorf("invalid address %q", rec.Addr4)
+	}
+	if t.Addr6 = net.ParseIP(rec.Addr6); t.Addr6 == nil || t.Addr6.To4() != nil {
+		return fmt.Errorf("invalid address %q", rec.Addr6)
+	}
+	t.Expires = rec.Expires
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Active reports whether the grace window of the transition is still open.
+func (t *KeyTransition) Active() bool {
+	return time.Now().Before(t.Expires)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// String encodes the signed record for config files.
+func (t *KeyTransition) String() string {
+	return base64.StdEncoding.EncodeToString(t.Envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ConsumeKeyTransition checks a signed key transition and returns its contents. The record must be signed by the key
+// of the peer ID it hands over from.
+func ConsumeKeyTransition(envelope []byte) (*KeyTransition, error) {
+	t := &KeyTransition{}
+	env, err := record.ConsumeTypedEnvelope(envelope, t)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(env.PayloadType, keyTransitionCodec) {
+		return nil, errors.New("not a key transition")
+	}
+	if !t.Old.MatchesPublicKey(env.PublicKey) {
+		return nil, fmt.Errorf("key transition is not signed by %s", t.Old)
+	}
+	if t.Old == t.New {
+		return nil, errors.New("key transition does not change the peer ID")
+	}
+	t.Envelope = envelope
+	return t, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseKeyTransition decodes a key transition stored in a config file.
+func ParseKeyTransition(s string) (*KeyTransition, error) {
+	envelope, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key transition: %w", err)
+	}
+	return ConsumeKeyTransition(envelope)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Is reports whether id identifies the peer, either as its current peer ID or as the previous one while the grace
+// window of its key transition is open.
+func (p Peer) Is(id peer.ID) bool {
+	return p.ID == id || (p.KeyTransition != nil && p.KeyTransition.Old == id && p.KeyTransition.Active())
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RotateKey generates a new private key for this node and signs a transition to it with the current key. The new key
+// is written to the config file by Save, but the running node keeps using the current one until it is restarted. The
+// VPN addresses of the node are pinned, so they survive the change of its peer ID.
+func (cfg *Config) RotateKey(grace time.Duration) (*KeyTransition, error) {
+	if cfg.NextKey != nil {
+		return nil, errors.New("the key has already been rotated, restart the daemon first")
+	}
+	oldID, err := peer.IDFromPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 256)
+	if err != nil {
+		return nil, err
+	}
+	newID, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &KeyTransition{
+		Old:     oldID,
+		New:     newID,
+		Addr4:   cfg.BuiltinAddr4,
+		Addr6:   cfg.BuiltinAddr6,
+		Expires: time.Now().Add(grace).Truncate(time.Second),
+	}
+	env, err := record.Seal(t, cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if t.Envelope, err = env.Marshal(); err != nil {
+		return nil, err
+	}
+
+	cfg.NextKey = key
+	cfg.KeyTransition = t
+	cfg.Addr4 = cfg.BuiltinAddr4
+	cfg.Addr6 = cfg.BuiltinAddr6
+	return t, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ApplyKeyTransition replaces the peer ID of the peer that signed t with its new one. The previous peer ID stays
+// accepted until t expires. It returns the updated peer, and false if t has already been applied.
+func (cfg *Config) ApplyKeyTransition(t *KeyTransition) (Peer, bool, error) {
+	if p, found := FindPeer(cfg.Peers, t.New); found {
+		if p.KeyTransition != nil && p.KeyTransition.Old == t.Old {
+			return *p, false, nil
+		}
+		return *p, false, fmt.Errorf("peer %s is already configured", t.New)
+	}
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == t.Old })
+	if idx < 0 {
+		return Peer{}, false, fmt.Errorf("no such peer: %s", t.Old)
+	}
+	p := cfg.Peers[idx]
+	if !p.BuiltinAddr4.Equal(t.Addr4) || !p.BuiltinAddr6.Equal(t.Addr6) {
+		return p, false, fmt.Errorf("peer %s uses the addresses %s and %s, but %s and %s are configured",
+			t.Old, t.Addr4, t.Addr6, p.BuiltinAddr4, p.BuiltinAddr6)
+	}
+	entries, err := cfg.peerRouteEntries(t.Old)
+	if err != nil {
+		return p, false, err
+	}
+
+	delete(cfg.PeerLookup.ByNetID, MkNetID(t.Old))
+	p.ID = t.New
+	p.Addr4 = t.Addr4
+	p.Addr6 = t.Addr6
+	p.KeyTransition = t
+	cfg.Peers[idx] = p
+	if p.Name != "" {
+		cfg.PeerLookup.ByName[strings.ToLower(p.Name)] = p
+	}
+	cfg.PeerLookup.ByNetID[MkNetID(p.ID)] = p
+	for _, rte := range entries {
+		rte.Target = p
+	}
+	return p, true, nil
+}
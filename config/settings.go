@@ -0,0 +1,157 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/soitun/mynetwork/schema"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Environment variables that override the settings of the config file.
+const (
+	// SwarmKeyEnv names a file holding the swarm key.
+	SwarmKeyEnv = "HYPRSPACE_SWARM_KEY"
+	// IPFSAPIEnv is the multiaddr of the API of a local IPFS node.
+	IPFSAPIEnv = "MYNETWORK_IPFS_API"
+	// MetricsPortEnv is the port the metrics are served on, on the loopback interface.
+	MetricsPortEnv = "MYNETWORK_METRICS_PORT"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// swarmKeyHeader starts a swarm key in the format written by ipfs-swarm-key-gen.
+const swarmKeyHeader = "/key/swarm/psk/1.0.0/"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Settings are runtime settings of the daemon, taken from the config file unless an environment variable overrides
+// them.
+type Settings struct {
+	// SwarmKey is the pre-shared key of a private libp2p network, nil to join the public one.
+	SwarmKey pnet.PSK
+	// IPFSAPI is the API of a local IPFS node that contributes peers and bootstrap nodes, nil if there is none.
+	IPFSAPI multiaddr.Multiaddr
+	// Metrics is the address the Prometheus metrics are served on, empty if they are not served.
+	Metrics string
+	// Overrides maps the config fields overridden by the environment to the variables doing so.
+	Overrides map[string]string
+	// file holds the settings as written in the config file.
+	file schema.Config
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parseSettings reads the runtime settings of a config file at path and applies the environment on top of them.
+func (v *validator) parseSettings(input schema.Config, path string) Settings {
+	s := Settings{Overrides: make(map[string]string)}
+	s.file = schema.Config{
+		SwarmKey:     input.SwarmKey,
+		SwarmKeyFile: input.SwarmKeyFile,
+		IPFSAPI:      input.IPFSAPI,
+		Metrics:      input.Metrics,
+	}
+
+	var err error
+	keyField, keyFile := "swarmKeyFile", input.SwarmKeyFile
+	if keyFile != "" && !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(filepath.Dir(path), keyFile)
+	}
+	if env, ok := os.LookupEnv(SwarmKeyEnv); ok {
+		keyField, keyFile = SwarmKeyEnv, env
+		s.Overrides["swarmKey"] = SwarmKeyEnv
+	}
+	switch {
+	case keyField != SwarmKeyEnv && input.SwarmKey != "" && input.SwarmKeyFile != "":
+		v.errorf("swarmKeyFile", "swarmKey and swarmKeyFile are mutually exclusive")
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			v.errorf(keyField, "unable to read swarm key: %v", err)
+		} else if s.SwarmKey, err = decodeSwarmKey(string(data)); err != nil {
+			v.errorf(keyField, "%v", err)
+		}
+	case input.SwarmKey != "":
+		if s.SwarmKey, err = decodeSwarmKey(input.SwarmKey); err != nil {
+			v.errorf("swarmKey", "%v", err)
+		}
+	}
+
+	field, api := "ipfsApi", input.IPFSAPI
+	if env, ok := os.LookupEnv(IPFSAPIEnv); ok {
+		field, api = IPFSAPIEnv, env
+		s.Overrides["ipfsApi"] = IPFSAPIEnv
+	}
+	if api != "" {
+		if s.IPFSAPI, err = multiaddr.NewMultiaddr(api); err != nil {
+			v.errorf(field, "invalid multiaddr: %v", err)
+		}
+	}
+
+	field, s.Metrics = "metrics", input.Metrics
+	if env, ok := os.LookupEnv(MetricsPortEnv); ok {
+		field, s.Metrics = MetricsPortEnv, net.JoinHostPort("127.0.0.1", env)
+		s.Overrides["metrics"] = MetricsPortEnv
+	}
+	if s.Metrics != "" {
+		if _, port, err := net.SplitHostPort(s.Metrics); err != nil {
+			v.errorf(field, "invalid listen address: %v", err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			v.errorf(field, "invalid port %q", port)
+		}
+	}
+	return s
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// decodeSwarmKey decodes a swarm key, either in the format written by ipfs-swarm-key-gen or as the bare hex encoded
+// key.
+func decodeSwarmKey(s string) (pnet.PSK, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, swarmKeyHeader) {
+		s = swarmKeyHeader + "\n/base16/\n" + s
+	}
+	key, err := pnet.DecodeV1PSK(strings.NewReader(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key: %v", err)
+	}
+	return key, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// equal reports whether two sets of settings take the same effect.
+func (s Settings) equal(other Settings) bool {
+	sameAPI := s.IPFSAPI == nil && other.IPFSAPI == nil ||
+		s.IPFSAPI != nil && other.IPFSAPI != nil && s.IPFSAPI.Equal(other.IPFSAPI)
+	return bytes.Equal(s.SwarmKey, other.SwarmKey) && sameAPI && s.Metrics == other.Metrics
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Effective converts the configuration back into a config file with the settings the daemon actually uses, including
+// those taken from the environment. merged merges in the drop-in files like Merged does.
+func (cfg *Config) Effective(merged bool) (schema.Config, error) {
+	out, err := cfg.toSchema(merged)
+	if err != nil {
+		return out, err
+	}
+	s := cfg.Settings
+	if _, ok := s.Overrides["swarmKey"]; ok {
+		out.SwarmKey, out.SwarmKeyFile = "", os.Getenv(SwarmKeyEnv)
+	}
+	if s.IPFSAPI != nil {
+		out.IPFSAPI = s.IPFSAPI.String()
+	}
+	out.Metrics = s.Metrics
+	return out, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// StateDir is the directory the daemon of the interface keeps what it learned about the network in across restarts,
+// next to the config file.
+func (cfg *Config) StateDir() string {
+	return filepath.Join(filepath.Dir(cfg.Path), cfg.Interface+".state")
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Tags double as DNS labels, so they are restricted to what a label may hold.
+var tagPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// tagPrefix marks the entries of a PeerSet that select peers by tag.
+const tagPrefix = "tag:"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParseTags normalizes tags to lower case and checks that they can be used as DNS labels.
+func ParseTags(tags []string) ([]string, error) {
+	var result []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q, tags consist of letters, digits and hyphens", tag)
+		}
+		if !slices.Contains(result, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// HasTag reports whether the peer carries a tag.
+func (p Peer) HasTag(tag string) bool {
+	return slices.Contains(p.Tags, strings.ToLower(tag))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PeersWithTag returns every peer carrying a tag.
+func (cfg *Config) PeersWithTag(tag string) []Peer {
+	var result []Peer
+	for _, p := range cfg.Peers {
+		if p.HasTag(tag) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetPeerTags dynamically replaces the tags of a peer.
+func (cfg *Config) SetPeerTags(peerID peer.ID, tags []string) error {
+	idx := slices.IndexFunc(cfg.Peers, func(p Peer) bool { return p.ID == peerID })
+	if idx < 0 {
+		return errors.New("no such peer")
+	}
+	p := cfg.Peers[idx]
+	p.Tags = tags
+	return cfg.storePeer(idx, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PeerSet selects peers by name, by peer ID or by tag, written as tag:<tag>. Policies use it in place of lists of
+// individual peers.
+type PeerSet struct {
+	Names []string
+	IDs   []peer.ID
+	Tags  []string
+	// entries are the entries as written in the config file.
+	entries []string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ParsePeerSet parses the entries of a peer set from a config file.
+func ParsePeerSet(entries []string) (*PeerSet, error) {
+	set := &PeerSet{entries: entries}
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, tagPrefix):
+			tags, err := ParseTags([]string{strings.TrimPrefix(entry, tagPrefix)})
+			if err != nil {
+				return nil, err
+			}
+			set.Tags = append(set.Tags, tags...)
+		case entry == "":
+			return nil, errors.New("empty peer")
+		default:
+			if id, err := peer.Decode(entry); err == nil {
+				set.IDs = append(set.IDs, id)
+			} else {
+				set.Names = append(set.Names, strings.ToLower(entry))
+			}
+		}
+	}
+	return set, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Matches reports whether the set selects a peer.
+func (s *PeerSet) Matches(p Peer) bool {
+	if slices.ContainsFunc(s.IDs, p.Is) || slices.Contains(s.Names, strings.ToLower(p.Name)) {
+		return true
+	}
+	return slices.ContainsFunc(s.Tags, p.HasTag)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Spec returns the entries of the set as written in the config file.
+func (s *PeerSet) Spec() []string {
+	if s == nil {
+		return nil
+	}
+	return s.entries
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MayRelay reports whether a peer may use this node as a relay.
+func (cfg *Config) MayRelay(p Peer) bool {
+	return cfg.Relay == nil || cfg.Relay.Matches(p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MayUseService reports whether a peer may reach the local service with the given ID.
+func (cfg *Config) MayUseService(svcId [2]byte, p Peer) bool {
+	for name, set := range cfg.ServiceAccess {
+		if MkServiceID(name) == svcId {
+			return set.Matches(p)
+		}
+	}
+	return true
+}
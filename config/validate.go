@@ -0,0 +1,399 @@
+package config
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/soitun/mynetwork/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type Severity string
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Diagnostic is a problem found in a config file. Field is the path of the offending value, like
+// peers[1].routes[0].net, Line and Column are 0 if the position is unknown. Some decoders only report the line.
+type Diagnostic struct {
+	Severity Severity
+	File     string
+	Line     int
+	Column   int
+	Field    string
+	Message  string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (d Diagnostic) String() string {
+	pos := d.File
+	switch {
+	case d.Line > 0 && d.Column > 0:
+		pos = fmt.Sprintf("%s:%d:%d", d.File, d.Line, d.Column)
+	case d.Line > 0:
+		pos = fmt.Sprintf("%s:%d", d.File, d.Line)
+	}
+	if d.Field != "" {
+		return fmt.Sprintf("%s: %s: %s: %s", pos, d.Severity, d.Field, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, d.Severity, d.Message)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type Diagnostics []Diagnostic
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (ds Diagnostics) HasErrors() bool {
+	return slices.ContainsFunc(ds, func(d Diagnostic) bool { return d.Severity == SeverityError })
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Warnings returns the diagnostics that don't prevent the config from being used.
+func (ds Diagnostics) Warnings() Diagnostics {
+	return slices.DeleteFunc(slices.Clone(ds), func(d Diagnostic) bool { return d.Severity != SeverityWarning })
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Err returns the errors among the diagnostics as a *ValidationError, or nil if there are none.
+func (ds Diagnostics) Err() error {
+	errs := slices.DeleteFunc(slices.Clone(ds), func(d Diagnostic) bool { return d.Severity != SeverityError })
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{errs}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ValidationError is returned by Read for config files with errors in them.
+type ValidationError struct {
+	Diagnostics Diagnostics
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		lines[i] = d.String()
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Validate reads a config file and the drop-in files it includes and reports every problem found in them. The returned config is only usable if none
+// of the diagnostics is an error. err is set only if the file can't be read at all.
+func Validate(path string) (*Config, Diagnostics, error) {
+	in, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, diags := parse(in, path)
+	// Diagnostics are grouped by file, the main config file first.
+	files := []string{path}
+	for _, d := range diags {
+		if !slices.Contains(files, d.File) {
+			files = append(files, d.File)
+		}
+	}
+	slices.SortStableFunc(diags, func(a, b Diagnostic) int {
+		return cmp.Or(slices.Index(files, a.File)-slices.Index(files, b.File), a.Line-b.Line)
+	})
+	return cfg, diags, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// validator collects the diagnostics of a single config file.
+type validator struct {
+	file      string
+	src       []byte
+	format    Format
+	positions map[string]position
+	diags     Diagnostics
+	// origins maps the peers and services merged in from drop-in files to where they are defined.
+	origins map[string]origin
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// position is a line and column in a config file, both starting at 1.
+type position struct {
+	line, column int
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func newValidator(file string, src []byte, format Format) *validator {
+	v := &validator{file: file, src: src, format: format, positions: make(map[string]position),
+		origins: make(map[string]origin)}
+	// Positions are best effort, a syntax error just leaves the rest of the file unindexed. TOML files only get
+	// positions for syntax errors.
+	switch format {
+	case FormatJSON:
+		_ = v.index(json.NewDecoder(bytes.NewReader(src)), "")
+	case FormatYAML:
+		var doc yaml.Node
+		if yaml.Unmarshal(src, &doc) == nil && len(doc.Content) > 0 {
+			v.indexYAML(doc.Content[0], "")
+		}
+	}
+	return v
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (v *validator) errorf(field string, format string, a ...any) {
+	v.report(SeverityError, field, fmt.Sprintf(format, a...))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (v *validator) warnf(field string, format string, a ...any) {
+	v.report(SeverityWarning, field, fmt.Sprintf(format, a...))
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// report adds a diagnostic positioned at field, or at the closest enclosing value present in the file. Fields merged
+// in from a drop-in file are reported against that file.
+func (v *validator) report(severity Severity, field string, message string) {
+	sub, field := v.resolve(field)
+	d := Diagnostic{Severity: severity, File: sub.file, Field: field, Message: message}
+	for path := field; ; path = parentPath(path) {
+		if pos, ok := sub.positions[path]; ok {
+			d.Line, d.Column = pos.line, pos.column
+			break
+		}
+		if path == "" {
+			break
+		}
+	}
+	v.diags = append(v.diags, d)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// reportJSON turns an error of the JSON decoder into a diagnostic. Files in other formats are converted to JSON
+// first, so type errors are positioned by their field there.
+func (v *validator) reportJSON(err error) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && v.format != FormatJSON:
+		v.errorf(decoderPath(typeErr.Field), "expected %s, found %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		return
+	}
+	d := Diagnostic{Severity: SeverityError, File: v.file, Message: err.Error()}
+	switch {
+	case errors.As(err, &syntaxErr):
+		d.Line, d.Column = v.offsetPosition(syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		d.Line, d.Column = v.offsetPosition(typeErr.Offset)
+		d.Field = decoderPath(typeErr.Field)
+		d.Message = fmt.Sprintf("expected %s, found %s", jsonTypeName(typeErr.Type), typeErr.Value)
+	}
+	v.diags = append(v.diags, d)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// reportSyntax turns a syntax error of the YAML or TOML decoder into a diagnostic.
+func (v *validator) reportSyntax(err error) {
+	d := Diagnostic{Severity: SeverityError, File: v.file, Message: err.Error()}
+	var tomlErr toml.ParseError
+	if errors.As(err, &tomlErr) {
+		d.Line, d.Column, d.Message = tomlErr.Position.Line, tomlErr.Position.Col, tomlErr.Message
+	} else if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		d.Line, _ = strconv.Atoi(m[1])
+		d.Message = strings.TrimPrefix(err.Error(), m[0])
+	}
+	v.diags = append(v.diags, d)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// yamlErrorLine matches the position in the errors of the YAML decoder, which don't carry it separately.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// jsonTypeName names the JSON type a Go type is decoded from.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return "number"
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// offsetPosition converts a byte offset into a line and column, both starting at 1.
+func (v *validator) offsetPosition(off int64) (int, int) {
+	off = min(off, int64(len(v.src)))
+	before := v.src[:off]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, int(off) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// index records the offset of every value in the document, keyed by its field path.
+func (v *validator) index(dec *json.Decoder, path string) error {
+	line, column := v.offsetPosition(v.skipSeparators(dec.InputOffset()))
+	v.positions[path] = position{line, column}
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			if err := v.index(dec, joinPath(path, key.(string))); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := v.index(dec, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// indexYAML records the position of every value in a YAML document, keyed by its field path.
+func (v *validator) indexYAML(n *yaml.Node, path string) {
+	v.positions[path] = position{n.Line, n.Column}
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v.indexYAML(n.Content[i+1], joinPath(path, n.Content[i].Value))
+		}
+	case yaml.SequenceNode:
+		for i, item := range n.Content {
+			v.indexYAML(item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// skipSeparators moves off past the whitespace, colons and commas that precede the next value.
+func (v *validator) skipSeparators(off int64) int64 {
+	for off < int64(len(v.src)) && strings.IndexByte(" \t\r\n:,", v.src[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// checkFields warns about keys that don't correspond to any field of t, which usually are typos.
+func (v *validator) checkFields(value any, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			field, found := jsonField(t, key)
+			switch {
+			case found:
+				v.checkFields(obj[key], field.Type, joinPath(path, key))
+			case path == "" && key == "$schema":
+			default:
+				v.warnf(joinPath(path, key), "unknown field %q", key)
+			}
+		}
+	case reflect.Slice:
+		if arr, ok := value.([]any); ok {
+			for i, item := range arr {
+				v.checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case reflect.Map:
+		if obj, ok := value.(map[string]any); ok {
+			for key, item := range obj {
+				v.checkFields(item, t.Elem(), joinPath(path, key))
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// jsonField finds the field of the struct type t that is stored under key.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" {
+			name = f.Name
+		}
+		if name == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// decoderPath converts a field path of the JSON decoder, like peers.1.routes, to the notation used in diagnostics.
+func decoderPath(field string) string {
+	var path string
+	for _, key := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(key); err == nil {
+			path += "[" + key + "]"
+		} else {
+			path = joinPath(path, key)
+		}
+	}
+	return path
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// parentPath strips the last key or index from a field path.
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// schemaType is the type the config file is decoded into, checked for unknown keys.
+var schemaType = reflect.TypeOf(schema.Config{})
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"context"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// settleTime is how long Watch waits after the last event before it looks at the files, editors write a file in
+// several steps.
+const settleTime = 200 * time.Millisecond
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Watch watches the config file at path and the drop-in files it includes, and calls onChange whenever one of them
+// changes its size or modification time, or a drop-in file is added or removed. It watches the directories holding
+// them rather than the files, so editors that replace a file by renaming a new one over it are picked up the same
+// way. Watch returns when ctx is done, or with an error if the files can't be watched.
+func Watch(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var dirs []string
+	watchDirs := func() error {
+		current := IncludedDirs(path)
+		for _, dir := range dirs {
+			if !slices.Contains(current, dir) {
+				_ = watcher.Remove(dir)
+			}
+		}
+		for _, dir := range current {
+			if !slices.Contains(dirs, dir) {
+				if err := watcher.Add(dir); err != nil {
+					return err
+				}
+			}
+		}
+		dirs = current
+		return nil
+	}
+	if err := watchDirs(); err != nil {
+		return err
+	}
+
+	last := snapshot(path)
+	settle := time.NewTimer(settleTime)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			settle.Reset(settleTime)
+		case <-settle.C:
+			if _, err := os.Stat(path); err != nil {
+				// The file may be in the middle of being replaced, its new version brings another event.
+				continue
+			}
+			if current := snapshot(path); !slices.Equal(current, last) {
+				last = current
+				// The include entries may have changed along with the file.
+				if err := watchDirs(); err != nil {
+					return err
+				}
+				onChange()
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// fileState is what Watch compares to notice a change of a file.
+type fileState struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// snapshot records the state of the config file at path and of its drop-in files.
+func snapshot(path string) []fileState {
+	var states []fileState
+	for _, file := range IncludedFiles(path) {
+		if fi, err := os.Stat(file); err == nil {
+			states = append(states, fileState{file, fi.Size(), fi.ModTime()})
+		}
+	}
+	return states
+}
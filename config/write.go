@@ -0,0 +1,418 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/schema"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PeerRoutes returns the configured routes of a peer, leaving out the host routes for its builtin addresses and
+// transient routes.
+func (cfg *Config) PeerRoutes(p peer.ID) ([]net.IPNet, error) {
+	entries, err := cfg.peerRouteEntries(p)
+	if err != nil {
+		return nil, err
+	}
+	var routes []net.IPNet
+	for _, rte := range entries {
+		if !isBuiltinRoute(rte) && !rte.Transient {
+			routes = append(routes, rte.Net)
+		}
+	}
+	return routes, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func isBuiltinRoute(rte *RouteTableEntry) bool {
+	ones, bits := rte.Net.Mask.Size()
+	if ones != bits {
+		return false
+	}
+	return rte.Net.IP.Equal(rte.Target.BuiltinAddr4) || rte.Net.IP.Equal(rte.Target.BuiltinAddr6)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ToSchema converts the running configuration back into its on-disk representation. Peers and services of drop-in
+// files are left to those files.
+func (cfg *Config) ToSchema() (schema.Config, error) {
+	return cfg.toSchema(false)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Merged converts the running configuration into a single config file, with the contents of the drop-in files merged
+// in.
+func (cfg *Config) Merged() (schema.Config, error) {
+	return cfg.toSchema(true)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (cfg *Config) toSchema(merged bool) (schema.Config, error) {
+	out := schema.Config{}
+
+	if cfg.KeyFile != "" {
+		out.PrivateKeyFile = cfg.KeyFile
+	} else if key, _, err := cfg.storedKey(); err != nil {
+		return out, err
+	} else {
+		out.PrivateKey = key
+	}
+
+	out.ListenAddresses = []string{}
+	for _, addr := range cfg.ListenAddresses {
+		out.ListenAddresses = append(out.ListenAddresses, addr.String())
+	}
+
+	out.Peers = []schema.Peer{}
+	for _, p := range cfg.Peers {
+		// Members are admitted again when they present their certificate.
+		if p.Certificate != nil || (p.Source != "" && !merged) {
+			continue
+		}
+		sp, err := cfg.peerSchema(p)
+		if err != nil {
+			return out, err
+		}
+		out.Peers = append(out.Peers, sp)
+	}
+
+	if cfg.Net4.String() != DefaultNet4.String() {
+		out.Network4 = cfg.Net4.String()
+	}
+	if cfg.Net6.String() != DefaultNet6.String() {
+		out.Network6 = cfg.Net6.String()
+	}
+	if cfg.ServiceNet.String() != DefaultServiceNet.String() {
+		out.ServiceNetwork = cfg.ServiceNet.String()
+	}
+	if cfg.Addr4 != nil {
+		out.Addr4 = cfg.Addr4.String()
+	}
+	if cfg.Addr6 != nil {
+		out.Addr6 = cfg.Addr6.String()
+	}
+	out.ExitNode = cfg.ExitNode
+	if cfg.KeyTransition != nil && cfg.KeyTransition.Active() {
+		out.KeyTransition = cfg.KeyTransition.String()
+	}
+	if cfg.CA != "" {
+		out.CA = cfg.CA.String()
+	}
+	if cfg.Certificate != nil {
+		out.Certificate = cfg.Certificate.String()
+	}
+	if cfg.Revocations != nil {
+		out.RevocationList = cfg.Revocations.String()
+	}
+	for _, r := range cfg.AdvertiseRoutes {
+		out.AdvertiseRoutes = append(out.AdvertiseRoutes, r.String())
+	}
+
+	out.Relay = cfg.Relay.Spec()
+	if len(cfg.ServiceAccess) > 0 {
+		out.ServiceAccess = make(map[string][]string)
+		for name, set := range cfg.ServiceAccess {
+			out.ServiceAccess[name] = set.Spec()
+		}
+	}
+
+	if len(cfg.Services) > 0 {
+		out.Services = make(map[string]string)
+		for name, addr := range cfg.Services {
+			if cfg.ServiceSources[name] == "" || merged {
+				out.Services[name] = addr.String()
+			}
+		}
+	}
+	if !merged {
+		out.Include = cfg.Include
+	}
+	out.SwarmKey, out.SwarmKeyFile = cfg.Settings.file.SwarmKey, cfg.Settings.file.SwarmKeyFile
+	out.IPFSAPI, out.Metrics = cfg.Settings.file.IPFSAPI, cfg.Settings.file.Metrics
+	for _, addr := range cfg.BootstrapPeers {
+		out.BootstrapPeers = append(out.BootstrapPeers, addr.String())
+	}
+	out.DelegatedRouting = cfg.DelegatedRouting
+	out.Private = cfg.Private
+	if cfg.MTU != DefaultMTU {
+		out.MTU = cfg.MTU
+	}
+	return out, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// peerSchema converts a peer into its entry in the config file.
+func (cfg *Config) peerSchema(p Peer) (schema.Peer, error) {
+	routes, err := cfg.PeerRoutes(p.ID)
+	if err != nil {
+		return schema.Peer{}, err
+	}
+	sp := schema.Peer{
+		Id:                p.ID.String(),
+		Name:              p.Name,
+		AllowAnySource:    p.AllowAnySource,
+		AutoApproveRoutes: p.AutoApproveRoutes,
+		Tags:              p.Tags,
+	}
+	if p.Addr4 != nil {
+		sp.Addr4 = p.Addr4.String()
+	}
+	if p.Addr6 != nil {
+		sp.Addr6 = p.Addr6.String()
+	}
+	for _, addr := range p.Addrs {
+		sp.Addrs = append(sp.Addrs, addr.String())
+	}
+	if p.KeyTransition != nil && p.KeyTransition.Active() {
+		sp.KeyTransition = p.KeyTransition.String()
+	}
+	if p.ACL != nil {
+		acl := p.ACL.Spec()
+		sp.ACL = &acl
+	}
+	for _, r := range routes {
+		sp.Routes = append(sp.Routes, schema.Route{Net: r.String()})
+	}
+	return sp, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// fileKey is the private key stored in the config file, which differs from the running one after a key rotation.
+func (cfg *Config) fileKey() crypto.PrivKey {
+	if cfg.NextKey != nil {
+		return cfg.NextKey
+	}
+	return cfg.PrivateKey
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Save writes the running configuration back to the file it was read from, in the format it was written in. TOML
+// files with comments are left alone, as their comments would be lost. Save is meant for configs that hold nothing
+// but the contents of the file, the daemon writes single changes with Persist.
+func (cfg *Config) Save() error {
+	previous, _ := os.ReadFile(cfg.Path)
+	if cfg.Format == FormatTOML && tomlHasComments(previous) {
+		return ErrTOMLComments
+	}
+	// The key file is written first, so the config never refers to a key that isn't there.
+	if err := cfg.writeKeyFile(); err != nil {
+		return err
+	}
+	out, err := cfg.ToSchema()
+	if err != nil {
+		return err
+	}
+	data, err := cfg.Format.Marshal(out, previous)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.Path, data)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// writeKeyFile stores the private key in its own file, if it is kept in one and has changed.
+func (cfg *Config) writeKeyFile() error {
+	if cfg.KeyFile == "" {
+		return nil
+	}
+	key, changed, err := cfg.storedKey()
+	if err != nil {
+		return err
+	}
+	path := cfg.KeyFilePath()
+	if _, err := os.Stat(path); changed || err != nil {
+		return writeFileAtomic(path, []byte(key+"\n"))
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Persist applies change to the config file as it is on disk and writes it back. Everything change doesn't touch
+// stays as it is in the file, so changes made to the running configuration without being persisted stay out of it.
+func (cfg *Config) Persist(change func(*schema.Config) error) error {
+	previous, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return err
+	}
+	if cfg.Format == FormatTOML && tomlHasComments(previous) {
+		return ErrTOMLComments
+	}
+	doc, err := cfg.Format.toJSON(previous)
+	if err != nil {
+		return err
+	}
+	var out schema.Config
+	if err := json.Unmarshal(doc, &out); err != nil {
+		return err
+	}
+	if err := change(&out); err != nil {
+		return err
+	}
+	data, err := cfg.Format.Marshal(out, previous)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg.Path, data)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistIdentity writes the private key, the key transition and the pinned addresses of this node to the config
+// file.
+func (cfg *Config) PersistIdentity() error {
+	if err := cfg.writeKeyFile(); err != nil {
+		return err
+	}
+	return cfg.Persist(func(out *schema.Config) error {
+		if cfg.KeyFile == "" {
+			key, _, err := cfg.storedKey()
+			if err != nil {
+				return err
+			}
+			out.PrivateKey = key
+		}
+		out.KeyTransition = ""
+		if cfg.KeyTransition != nil && cfg.KeyTransition.Active() {
+			out.KeyTransition = cfg.KeyTransition.String()
+		}
+		out.Addr4, out.Addr6 = ipString(cfg.Addr4), ipString(cfg.Addr6)
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistAddedPeer writes a peer of the running configuration to the config file, replacing its entry if it has one.
+func (cfg *Config) PersistAddedPeer(id peer.ID) error {
+	p, found := FindPeer(cfg.Peers, id)
+	if !found {
+		return fmt.Errorf("no such peer: %s", id)
+	}
+	sp, err := cfg.peerSchema(*p)
+	if err != nil {
+		return err
+	}
+	return cfg.Persist(func(out *schema.Config) error {
+		if i := schemaPeerIndex(out.Peers, id); i >= 0 {
+			out.Peers[i] = sp
+		} else {
+			out.Peers = append(out.Peers, sp)
+		}
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistRemovedPeer removes the entry of a peer from the config file.
+func (cfg *Config) PersistRemovedPeer(id peer.ID) error {
+	return cfg.Persist(func(out *schema.Config) error {
+		if i := schemaPeerIndex(out.Peers, id); i >= 0 {
+			out.Peers = slices.Delete(out.Peers, i, i+1)
+		}
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistPeer applies change to the entry of a peer in the config file. The peer must have been written there before.
+func (cfg *Config) PersistPeer(id peer.ID, change func(*schema.Peer)) error {
+	return cfg.Persist(func(out *schema.Config) error {
+		i := schemaPeerIndex(out.Peers, id)
+		if i < 0 {
+			return fmt.Errorf("peer %s is not in %s, add it with --persist first", id, cfg.Path)
+		}
+		change(&out.Peers[i])
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistRoute writes the route n via a peer to the config file, taking it away from any other peer it was routed
+// via there.
+func (cfg *Config) PersistRoute(n net.IPNet, id peer.ID) error {
+	return cfg.Persist(func(out *schema.Config) error {
+		i := schemaPeerIndex(out.Peers, id)
+		if i < 0 {
+			return fmt.Errorf("peer %s is not in %s, add it with --persist first", id, cfg.Path)
+		}
+		for j := range out.Peers {
+			out.Peers[j].Routes = slices.DeleteFunc(out.Peers[j].Routes, func(r schema.Route) bool { return sameRoute(r, n) })
+		}
+		out.Peers[i].Routes = append(out.Peers[i].Routes, schema.Route{Net: n.String()})
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PersistRemovedRoute removes the route n via a peer from the config file.
+func (cfg *Config) PersistRemovedRoute(n net.IPNet, id peer.ID) error {
+	return cfg.Persist(func(out *schema.Config) error {
+		if i := schemaPeerIndex(out.Peers, id); i >= 0 {
+			out.Peers[i].Routes = slices.DeleteFunc(out.Peers[i].Routes, func(r schema.Route) bool { return sameRoute(r, n) })
+		}
+		return nil
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// schemaPeerIndex returns the index of the entry of a peer in the peers of a config file, or -1.
+func schemaPeerIndex(peers []schema.Peer, id peer.ID) int {
+	return slices.IndexFunc(peers, func(sp schema.Peer) bool {
+		pid, err := peer.Decode(sp.Id)
+		return err == nil && pid == id
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// sameRoute reports whether a route of a config file is the network n.
+func sameRoute(r schema.Route, n net.IPNet) bool {
+	_, rn, err := net.ParseCIDR(r.Net)
+	return err == nil && rn.String() == n.String()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ipString formats an optional address for the config file.
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// writeFileAtomic replaces the file at path by writing to a temporary file in the same directory and renaming it
+// over the original, so readers never see a partially written config.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
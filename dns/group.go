@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// writeGroupResponse answers a query for a tag, such as servers.mynetwork, with the addresses of every node carrying
+// it.
+func writeGroupResponse(msg *dns.Msg, q dns.Question, cfg *config.Config, tag string) {
+	addrs := func(addr4, addr6 net.IP) {
+		if q.Qtype == dns.TypeA {
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    0,
+				},
+				A: addr4.To4(),
+			})
+		} else {
+			msg.Answer = append(msg.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    0,
+				},
+				AAAA: addr6.To16(),
+			})
+		}
+	}
+	// This node carries the tags of its certificate.
+	if c := cfg.Certificate; c != nil && (config.Peer{Tags: c.Tags}).HasTag(tag) {
+		addrs(cfg.BuiltinAddr4, cfg.BuiltinAddr6)
+	}
+	for _, p := range cfg.PeersWithTag(tag) {
+		addrs(p.BuiltinAddr4, p.BuiltinAddr6)
+	}
+}
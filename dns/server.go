@@ -21,7 +21,7 @@ import (
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func domainSuffix(config config.Config) string {
+func domainSuffix(config *config.Config) string {
 	if config.Interface == "mynetwork" {
 		return "mynetwork."
 	} else {
@@ -30,12 +30,12 @@ func domainSuffix(config config.Config) string {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func withDomainSuffix(config config.Config, str string) string {
+func withDomainSuffix(config *config.Config, str string) string {
 	return fmt.Sprintf("%s.%s", str, domainSuffix(config))
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func mkAliasRecord(config config.Config, alias string, serviceName string, p peer.ID) *dns.CNAME {
+func mkAliasRecord(config *config.Config, alias string, serviceName string, p peer.ID) *dns.CNAME {
 	cid, _ := peer.ToCid(p).StringOfBase(multibase.Base36)
 	var aliasWithSvc string
 	var cidWithSvc string
@@ -58,7 +58,7 @@ func mkAliasRecord(config config.Config, alias string, serviceName string, p pee
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func mkIDRecord4(config config.Config, p peer.ID, addr net.IP) *dns.A {
+func mkIDRecord4(config *config.Config, p peer.ID, addr net.IP) *dns.A {
 	cid, _ := peer.ToCid(p).StringOfBase(multibase.Base36)
 	return &dns.A{
 		Hdr: dns.RR_Header{
@@ -72,7 +72,7 @@ func mkIDRecord4(config config.Config, p peer.ID, addr net.IP) *dns.A {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func mkIDRecord6(cfg config.Config, p peer.ID, serviceName string, addr net.IP) *dns.AAAA {
+func mkIDRecord6(cfg *config.Config, p peer.ID, serviceName string, addr net.IP) *dns.AAAA {
 	cid, _ := peer.ToCid(p).StringOfBase(multibase.Base36)
 	var addrWithSvc net.IP
 	var cidWithSvc string
@@ -80,7 +80,7 @@ func mkIDRecord6(cfg config.Config, p peer.ID, serviceName string, addr net.IP)
 		addrWithSvc = addr
 		cidWithSvc = cid
 	} else {
-		addrWithSvc = config.MkServiceAddr6(p, serviceName)
+		addrWithSvc = config.MkServiceAddr6(cfg.ServiceNet, p, serviceName)
 		cidWithSvc = serviceName + "." + cid
 	}
 	return &dns.AAAA{
@@ -118,8 +118,12 @@ func writeResponse(msg *dns.Msg, q dns.Question, p peer.ID, addr net.IP) {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func MagicDnsServer(ctx context.Context, config config.Config, node host.Host) {
+func MagicDnsServer(ctx context.Context, cfg *config.Config, node host.Host) {
+	config := cfg
 	dns.HandleFunc(domainSuffix(config), func(w dns.ResponseWriter, r *dns.Msg) {
+		// Peers may be changed at runtime, hold the config while answering.
+		cfg.RLock()
+		defer cfg.RUnlock()
 		m := new(dns.Msg)
 		m.SetReply(r)
 
@@ -177,6 +181,8 @@ func MagicDnsServer(ctx context.Context, config config.Config, node host.Host) {
 							m.Answer = append(m.Answer, mkIDRecord4(config, p.ID, p.BuiltinAddr4))
 						}
 						m.Answer = append(m.Answer, mkIDRecord6(config, p.ID, qServiceName, p.BuiltinAddr6))
+					} else if !isService {
+						writeGroupResponse(m, q, config, qName)
 					}
 				}
 			}
@@ -0,0 +1,343 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RouteProtocol carries the subnets a peer offers to route for the rest of the network.
+const RouteProtocol = "/hyprspace/routes/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxAnnouncedRoutes limits how many subnets a single peer may announce.
+const maxAnnouncedRoutes = 256
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// States of an announced subnet.
+const (
+	RoutePending = "pending"
+	RouteActive  = "active"
+	RouteOverlap = "overlap"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AnnouncedRoute is a subnet announced by a peer.
+type AnnouncedRoute struct {
+	Net    net.IPNet
+	Target config.Peer
+	State  string
+	// Overlaps describes the route the subnet collides with, if State is RouteOverlap.
+	Overlaps string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// RouteAdvertiser announces the advertised routes of this node to its peers and installs the routes announced by
+// them, either right away or once they are approved. Its methods are called with the config locked.
+type RouteAdvertiser struct {
+	host      host.Host
+	cfg       *config.Config
+	tunDev    *tun.TUN
+	lock      sync.Mutex
+	announced map[peer.ID][]net.IPNet
+	approved  map[peer.ID][]net.IPNet
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewRouteAdvertiser registers the route protocol and announces the advertised routes to every peer that connects
+// until ctx is done.
+func NewRouteAdvertiser(ctx context.Context, h host.Host, cfg *config.Config, tunDev *tun.TUN) *RouteAdvertiser {
+	a := &RouteAdvertiser{
+		host:      h,
+		cfg:       cfg,
+		tunDev:    tunDev,
+		announced: make(map[peer.ID][]net.IPNet),
+		approved:  make(map[peer.ID][]net.IPNet),
+	}
+	h.SetStreamHandler(RouteProtocol, a.handle)
+
+	subCon, err := h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		defer subCon.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-subCon.Out():
+				evt := ev.(event.EvtPeerConnectednessChanged)
+				cfg.RLock()
+				_, found := config.FindPeer(cfg.Peers, evt.Peer)
+				cfg.RUnlock()
+				if found && evt.Connectedness == network.Connected {
+					go a.announceTo(ctx, evt.Peer)
+				}
+			}
+		}
+	}()
+	return a
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Announce sends the advertised routes to every connected peer again, after they have changed.
+func (a *RouteAdvertiser) Announce(ctx context.Context) {
+	for _, p := range a.cfg.Peers {
+		if a.host.Network().Connectedness(p.ID) == network.Connected {
+			go a.announceTo(ctx, p.ID)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (a *RouteAdvertiser) announceTo(ctx context.Context, p peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	s, err := a.host.NewStream(ctx, p, RouteProtocol)
+	if err != nil {
+		// Peers running an older version don't speak the protocol.
+		return
+	}
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	var b strings.Builder
+	a.cfg.RLock()
+	for _, r := range a.cfg.AdvertiseRoutes {
+		b.WriteString(r.String() + "\n")
+	}
+	a.cfg.RUnlock()
+	if _, err := s.Write([]byte(b.String())); err != nil {
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (a *RouteAdvertiser) handle(s network.Stream) {
+	p := s.Conn().RemotePeer()
+	a.cfg.RLock()
+	_, found := config.FindPeer(a.cfg.Peers, p)
+	a.cfg.RUnlock()
+	if !found {
+		s.Reset()
+		return
+	}
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	var nets []net.IPNet
+	scanner := bufio.NewScanner(s)
+	for scanner.Scan() {
+		_, n, err := net.ParseCIDR(scanner.Text())
+		if err != nil || len(nets) == maxAnnouncedRoutes {
+			fmt.Printf("[!] Ignoring invalid route announcement from /p2p/%s\n", p)
+			s.Reset()
+			return
+		}
+		if !containsNet(nets, *n) {
+			nets = append(nets, *n)
+		}
+	}
+	if scanner.Err() != nil {
+		s.Reset()
+		return
+	}
+	s.Close()
+	a.cfg.Lock()
+	defer a.cfg.Unlock()
+	a.update(p, nets)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// update replaces the announcement of p, withdrawing the routes it no longer contains.
+func (a *RouteAdvertiser) update(p peer.ID, nets []net.IPNet) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	target, found := config.FindPeer(a.cfg.Peers, p)
+	if !found {
+		return
+	}
+	old := a.announced[p]
+	for _, n := range old {
+		if !containsNet(nets, n) {
+			a.withdraw(p, n)
+			fmt.Printf("[-] @%s no longer announces route %s\n", target.Name, &n)
+		}
+	}
+	a.approved[p] = slices.DeleteFunc(a.approved[p], func(n net.IPNet) bool { return !containsNet(nets, n) })
+	a.announced[p] = nets
+
+	for _, n := range nets {
+		state, overlaps := a.state(p, n)
+		fresh := !containsNet(old, n)
+		switch {
+		case state == RouteOverlap && fresh:
+			fmt.Printf("[!] Route %s announced by @%s overlaps %s\n", &n, target.Name, overlaps)
+		case state == RoutePending && (target.AutoApproveRoutes || containsNet(a.approved[p], n)):
+			a.install(*target, n, true)
+		case state == RoutePending && fresh:
+			fmt.Printf("[+] @%s announces route %s, approve it with: mynetwork route approve %s\n", target.Name, &n, &n)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Reevaluate installs the pending routes of p if it has been allowed to announce routes without approval.
+func (a *RouteAdvertiser) Reevaluate(p peer.ID) {
+	a.lock.Lock()
+	nets := a.announced[p]
+	a.lock.Unlock()
+	a.update(p, nets)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Approve installs the announced route n. If target is nil, n must be announced by a single peer. Routes approved
+// with persist are kept as regular routes of the peer, even once it stops announcing them.
+func (a *RouteAdvertiser) Approve(n net.IPNet, target *config.Peer, persist bool) (config.Peer, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var announcers []config.Peer
+	for p, nets := range a.announced {
+		if containsNet(nets, n) && (target == nil || target.ID == p) {
+			if ap, found := config.FindPeer(a.cfg.Peers, p); found {
+				announcers = append(announcers, *ap)
+			}
+		}
+	}
+	switch {
+	case len(announcers) == 0:
+		return config.Peer{}, errors.New("no such announced route")
+	case len(announcers) > 1:
+		return config.Peer{}, errors.New("route is announced by several peers, name the one to use")
+	}
+	p := announcers[0]
+
+	overlaps, err := a.cfg.OverlappingRoutes(n)
+	if err != nil {
+		return p, err
+	}
+	for _, rte := range overlaps {
+		if sameNet(rte.Net, n) {
+			if rte.Target.ID != p.ID {
+				return p, fmt.Errorf("%s is already routed via @%s", &n, rte.Target.Name)
+			}
+			if persist {
+				rte.Transient = false
+			}
+			return p, nil
+		}
+	}
+	if err := a.install(p, n, !persist); err != nil {
+		return p, err
+	}
+	a.approved[p.ID] = append(a.approved[p.ID], n)
+	return p, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Routes returns every announced route along with its state.
+func (a *RouteAdvertiser) Routes() []AnnouncedRoute {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var result []AnnouncedRoute
+	for _, p := range a.cfg.Peers {
+		for _, n := range a.announced[p.ID] {
+			state, overlaps := a.state(p.ID, n)
+			result = append(result, AnnouncedRoute{Net: n, Target: p, State: state, Overlaps: overlaps})
+		}
+	}
+	return result
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Forget drops the announcement of a removed peer. RemovePeer already takes care of its routes.
+func (a *RouteAdvertiser) Forget(p peer.ID) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.announced, p)
+	delete(a.approved, p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// state classifies the announced route n of p. Overlaps with the routes of other peers, including their builtin
+// addresses, and with the routes advertised by this node are never installed on their own.
+func (a *RouteAdvertiser) state(p peer.ID, n net.IPNet) (string, string) {
+	for _, local := range a.cfg.AdvertiseRoutes {
+		if local.Contains(n.IP) || n.Contains(local.IP) {
+			return RouteOverlap, fmt.Sprintf("%s advertised by this node", &local)
+		}
+	}
+	overlaps, err := a.cfg.OverlappingRoutes(n)
+	if err != nil {
+		return RoutePending, ""
+	}
+	state := RoutePending
+	for _, rte := range overlaps {
+		if rte.Target.ID == p {
+			if sameNet(rte.Net, n) {
+				state = RouteActive
+			}
+			continue
+		}
+		// The split default routes of an exit node are meant to be overridden by more specific routes.
+		if rte.Transient && slices.ContainsFunc(exitNets, func(e net.IPNet) bool { return sameNet(e, rte.Net) }) {
+			continue
+		}
+		return RouteOverlap, fmt.Sprintf("%s via @%s", &rte.Net, rte.Target.Name)
+	}
+	return state, ""
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (a *RouteAdvertiser) install(target config.Peer, n net.IPNet, transient bool) error {
+	if err := a.tunDev.Apply(tun.Route(n)); err != nil {
+		fmt.Printf("[!] Failed to add route %s via @%s: %v\n", &n, target.Name, err)
+		return err
+	}
+	a.cfg.PeerLookup.ByRoute.Insert(&config.RouteTableEntry{
+		Net:       n,
+		Target:    target,
+		Transient: transient,
+	})
+	fmt.Printf("[+] Route %s via @%s (/p2p/%s)\n", &n, target.Name, target.ID)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// withdraw removes the route n of p, unless it has been made permanent.
+func (a *RouteAdvertiser) withdraw(p peer.ID, n net.IPNet) {
+	overlaps, err := a.cfg.OverlappingRoutes(n)
+	if err != nil {
+		return
+	}
+	for _, rte := range overlaps {
+		if rte.Target.ID == p && rte.Transient && sameNet(rte.Net, n) {
+			_ = a.tunDev.Apply(tun.RemoveRoute(n))
+			_, _ = a.cfg.PeerLookup.ByRoute.Remove(n)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sameNet(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func containsNet(nets []net.IPNet, needle net.IPNet) bool {
+	return slices.ContainsFunc(nets, func(n net.IPNet) bool { return sameNet(n, needle) })
+}
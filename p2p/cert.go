@@ -0,0 +1,314 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// CertProtocol carries the membership certificates and revocation lists of a network with a CA.
+const CertProtocol = "/hyprspace/cert/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxCertMessageSize bounds the size of a certificate exchange.
+const maxCertMessageSize = 1 << 20
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxGossipedMembers bounds the number of member certificates sent to or taken from a single peer.
+const maxGossipedMembers = 1024
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// memberSweepInterval is how often members whose certificate expired or has been revoked are dropped.
+const memberSweepInterval = time.Minute
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// rendezvousInterval is how often nodes look for other members of their network in the DHT.
+const rendezvousInterval = 5 * time.Minute
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// certMessage is sent to every node speaking CertProtocol after connecting to it.
+type certMessage struct {
+	Certificate string `json:"certificate,omitempty"`
+	Revocations string `json:"revocations,omitempty"`
+	// Members are the certificates of the other members known to the sender. They are only sent to peers.
+	Members []string `json:"members,omitempty"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MemberHooks apply changes to the members of the network to the running daemon.
+type MemberHooks struct {
+	// Admit adds the holder of a valid certificate as a peer and reports whether it is a new member.
+	Admit func(*config.Certificate) (bool, error)
+	// Revoke applies a revocation list of the network CA and reports whether it replaced the current one.
+	Revoke func(*config.RevocationList) (bool, error)
+	// Drop removes a member whose certificate is no longer valid.
+	Drop func(peer.ID) error
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type membership struct {
+	host      host.Host
+	cfg       *config.Config
+	hooks     MemberHooks
+	connected event.Emitter
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MembershipService exchanges certificates with every node that connects and admits the holders of valid ones as
+// peers. Revocation lists and the certificates of known members are passed on, so they spread through the network.
+// Members are found through the DHT and dropped once their certificate expires or is revoked.
+func MembershipService(ctx context.Context, h host.Host, dht *dht.IpfsDHT, cfg *config.Config, hooks MemberHooks) {
+	connected, err := h.EventBus().Emitter(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connected.Close()
+	ms := &membership{h, cfg, hooks, connected}
+	h.SetStreamHandler(CertProtocol, ms.handle)
+
+	subID, err := h.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer subID.Close()
+	// Nodes that connected before the service started are greeted right away.
+	cfg.RLock()
+	AnnounceMembership(ctx, h, cfg)
+	cfg.RUnlock()
+
+	go rendezvous(ctx, h, dht, cfg)
+
+	sweep := time.NewTicker(memberSweepInterval)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-subID.Out():
+			evt := ev.(event.EvtPeerIdentificationCompleted)
+			cfg.RLock()
+			enabled := cfg.CA != ""
+			cfg.RUnlock()
+			if enabled && slices.Contains(evt.Protocols, CertProtocol) {
+				go sendMembership(ctx, h, cfg, evt.Peer)
+			}
+		case <-sweep.C:
+			cfg.RLock()
+			stale := cfg.StaleMembers()
+			cfg.RUnlock()
+			for _, p := range stale {
+				fmt.Printf("[-] Certificate of %s (/p2p/%s) is no longer valid\n", p.Name, p.ID)
+				if err := hooks.Drop(p.ID); err != nil {
+					fmt.Printf("[!] Failed to drop %s (/p2p/%s): %v\n", p.Name, p.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AnnounceMembership sends the certificate and revocation list of this node to every connected node, after they
+// changed. The caller holds the config lock.
+func AnnounceMembership(ctx context.Context, h host.Host, cfg *config.Config) {
+	if cfg.CA == "" {
+		return
+	}
+	for _, p := range h.Network().Peers() {
+		if protos, err := h.Peerstore().SupportsProtocols(p, CertProtocol); err == nil && len(protos) > 0 {
+			go sendMembership(ctx, h, cfg, p)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sendMembership(ctx context.Context, h host.Host, cfg *config.Config, p peer.ID) {
+	var msg certMessage
+	cfg.RLock()
+	if c := cfg.Certificate; c != nil && cfg.CheckCertificate(c) == nil {
+		msg.Certificate = c.String()
+	}
+	if l := cfg.Revocations; l != nil {
+		msg.Revocations = l.String()
+	}
+	if _, found := config.FindPeer(cfg.Peers, p); found {
+		for _, m := range cfg.Peers {
+			if m.Certificate != nil && m.ID != p && len(msg.Members) < maxGossipedMembers {
+				msg.Members = append(msg.Members, m.Certificate.String())
+			}
+		}
+	}
+	cfg.RUnlock()
+	if msg.Certificate == "" && msg.Revocations == "" && len(msg.Members) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	s, err := h.NewStream(ctx, p, CertProtocol)
+	if err != nil {
+		return
+	}
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := json.NewEncoder(s).Encode(msg); err != nil {
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (ms *membership) handle(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	remote := s.Conn().RemotePeer()
+
+	var msg certMessage
+	ms.cfg.RLock()
+	ca := ms.cfg.CA
+	ms.cfg.RUnlock()
+	if ca == "" || json.NewDecoder(io.LimitReader(s, maxCertMessageSize)).Decode(&msg) != nil {
+		s.Reset()
+		return
+	}
+
+	// The revocation list goes first, so revoked certificates in the same message are refused.
+	if msg.Revocations != "" {
+		if l, err := config.ParseRevocationList(msg.Revocations); err == nil && l.CA == ca {
+			if changed, err := ms.hooks.Revoke(l); err != nil {
+				fmt.Printf("[!] Failed to apply the revocation list from /p2p/%s: %v\n", remote, err)
+			} else if changed {
+				fmt.Printf("[+] Applied the revocation list issued at %s, received from /p2p/%s\n",
+					l.Issued.Local().Format(time.RFC1123), remote)
+			}
+		}
+	}
+
+	if msg.Certificate != "" {
+		c, err := config.ParseCertificate(msg.Certificate)
+		if err == nil && c.ID != remote {
+			err = errors.New("certificate belongs to another node")
+		}
+		if err == nil {
+			ms.cfg.RLock()
+			err = ms.cfg.CheckCertificate(c)
+			ms.cfg.RUnlock()
+		}
+		var added bool
+		if err == nil {
+			added, err = ms.admit(c)
+		}
+		if err != nil {
+			fmt.Printf("[!] Rejected certificate of /p2p/%s: %v\n", remote, err)
+		} else if added {
+			// Now that it is a peer, the new member learns about the others.
+			go sendMembership(context.Background(), ms.host, ms.cfg, remote)
+		}
+	}
+
+	// Only peers vouch for other members.
+	ms.cfg.RLock()
+	_, found := config.FindPeer(ms.cfg.Peers, remote)
+	ms.cfg.RUnlock()
+	if !found {
+		return
+	}
+	discovered := false
+	for i, m := range msg.Members {
+		if i == maxGossipedMembers {
+			break
+		}
+		c, err := config.ParseCertificate(m)
+		if err == nil {
+			ms.cfg.RLock()
+			err = ms.cfg.CheckCertificate(c)
+			ms.cfg.RUnlock()
+		}
+		if err != nil || c.ID == ms.host.ID() {
+			continue
+		}
+		if added, _ := ms.admit(c); added && ms.host.Network().Connectedness(c.ID) != network.Connected {
+			discovered = true
+		}
+	}
+	if discovered {
+		go Rediscover()
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// admit adds the holder of a certificate as a peer and reports whether it is a new member.
+func (ms *membership) admit(c *config.Certificate) (bool, error) {
+	added, err := ms.hooks.Admit(c)
+	if err != nil || !added {
+		return false, err
+	}
+	fmt.Printf("[+] Admitted %s (/p2p/%s) by certificate\n", c.Name, c.ID)
+	// Services greet peers as they connect, which a member that is already connected did before it was admitted.
+	if ms.host.Network().Connectedness(c.ID) == network.Connected {
+		_ = ms.connected.Emit(event.EvtPeerConnectednessChanged{Peer: c.ID, Connectedness: network.Connected})
+	}
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// rendezvous advertises the members of a network in the DHT under the ID of its CA and connects to the others found
+// there, which then exchange their certificates.
+func rendezvous(ctx context.Context, h host.Host, dht *dht.IpfsDHT, cfg *config.Config) {
+	disc := drouting.NewRoutingDiscovery(dht)
+	// Give the DHT time to bootstrap first.
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(rendezvousInterval)
+		cfg.RLock()
+		ca := cfg.CA
+		member := cfg.Certificate != nil && cfg.CheckCertificate(cfg.Certificate) == nil
+		cfg.RUnlock()
+		if ca == "" {
+			continue
+		}
+		ns := "/mynetwork/members/" + ca.String()
+
+		if member {
+			advertiseCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			_, _ = disc.Advertise(advertiseCtx, ns)
+			cancel()
+		}
+		searchCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		found, err := disc.FindPeers(searchCtx, ns)
+		if err != nil {
+			cancel()
+			continue
+		}
+		for ai := range found {
+			if ai.ID == h.ID() || len(ai.Addrs) == 0 || h.Network().Connectedness(ai.ID) == network.Connected {
+				continue
+			}
+			go func(ai peer.AddrInfo) {
+				connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				defer cancel()
+				_ = h.Connect(connectCtx, ai)
+			}(ai)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,369 @@
+package p2p
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	libp2ptls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/quic-go/quic-go"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DatagramProtocol is the ALPN of the QUIC connections that carry tunnel packets as unreliable datagrams. They share
+// the UDP sockets of the libp2p QUIC transport, so they work wherever a direct QUIC connection to the peer does.
+const DatagramProtocol = "hyprspace-datagram/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	// Every datagram starts with the packet sequence number, the fragment index and the fragment count.
+	datagramHeaderLen = 4
+	// maxDatagramFragments bounds how many datagrams a single packet may be split into.
+	maxDatagramFragments = 64
+	// datagramSlots is the number of partially received packets kept per connection.
+	datagramSlots = 16
+	// datagramRetryDelay is how long to wait before trying to set up a datagram connection to a peer again.
+	datagramRetryDelay = 30 * time.Second
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var errTooManyFragments = errors.New("packet needs too many datagram fragments")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// quicConns is the QUIC connection manager of the libp2p host, captured by CreateNode.
+var quicConns *quicreuse.ConnManager
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DatagramPlane sends tunnel packets to peers as QUIC datagrams, avoiding the head-of-line blocking and the double
+// retransmissions of tunneling TCP over a reliable stream. Peers without a datagram connection keep using streams.
+type DatagramPlane struct {
+	ctx        context.Context
+	host       host.Host
+	cfg        *config.Config
+	identity   *libp2ptls.Identity
+	handler    func(peer.ID, []byte)
+	lock       sync.Mutex
+	conns      map[peer.ID]*datagramConn
+	retryAfter map[peer.ID]time.Time
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type datagramConn struct {
+	quic.Connection
+	dialer peer.ID
+	seq    atomic.Uint32
+	limit  atomic.Int64
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// partialPacket collects the fragments of a packet that was split over several datagrams.
+type partialPacket struct {
+	seq   uint16
+	count uint8
+	have  uint64
+	frags [][]byte
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewDatagramPlane accepts datagram connections on the QUIC listen addresses of the host and hands every packet
+// received from a configured peer to handler.
+func NewDatagramPlane(ctx context.Context, h host.Host, cfg *config.Config, handler func(peer.ID, []byte)) (*DatagramPlane, error) {
+	identity, err := libp2ptls.NewIdentity(cfg.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	d := &DatagramPlane{
+		ctx:        ctx,
+		host:       h,
+		cfg:        cfg,
+		identity:   identity,
+		handler:    handler,
+		conns:      make(map[peer.ID]*datagramConn),
+		retryAfter: make(map[peer.ID]time.Time),
+	}
+	if quicConns == nil {
+		return d, nil
+	}
+
+	var tlsConf tls.Config
+	tlsConf.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+		conf, _ := identity.ConfigForPeer("")
+		conf.NextProtos = []string{DatagramProtocol}
+		return conf, nil
+	}
+	tlsConf.NextProtos = []string{DatagramProtocol}
+	for _, addr := range h.Network().ListenAddresses() {
+		if !isDirectQUIC(addr) {
+			continue
+		}
+		ln, err := quicConns.ListenQUIC(addr, &tlsConf, noWindowIncrease)
+		if err != nil {
+			fmt.Println("[!] Failed to listen for datagrams on " + addr.String() + ": " + err.Error())
+			continue
+		}
+		go d.accept(ln)
+	}
+	return d, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Send sends a packet to p as datagrams. It returns false if there is no datagram connection to p yet, in which case
+// the packet has to go over a stream. Setting up the connection is started in the background.
+func (d *DatagramPlane) Send(p peer.ID, packet []byte) bool {
+	d.lock.Lock()
+	dc, ok := d.conns[p]
+	d.lock.Unlock()
+	if !ok {
+		d.maybeDial(p)
+		return false
+	}
+
+	err := dc.send(packet)
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, errTooManyFragments) {
+		d.drop(p, dc)
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Active reports whether packets to p currently travel as datagrams.
+func (d *DatagramPlane) Active(p peer.ID) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.conns[p]
+	return ok
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Close closes the datagram connection to p, if there is one.
+func (d *DatagramPlane) Close(p peer.ID) {
+	d.lock.Lock()
+	dc, ok := d.conns[p]
+	delete(d.conns, p)
+	delete(d.retryAfter, p)
+	d.lock.Unlock()
+	if ok {
+		dc.CloseWithError(0, "peer removed")
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (d *DatagramPlane) accept(ln quicreuse.Listener) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept(d.ctx)
+		if err != nil {
+			return
+		}
+		remote, err := remotePeer(conn)
+		if err != nil {
+			conn.CloseWithError(0, err.Error())
+			continue
+		}
+		d.cfg.RLock()
+		_, found := config.FindPeer(d.cfg.Peers, remote)
+		d.cfg.RUnlock()
+		if !found {
+			conn.CloseWithError(0, "unknown peer")
+			continue
+		}
+		d.adopt(remote, conn, remote)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (d *DatagramPlane) maybeDial(p peer.ID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if time.Now().Before(d.retryAfter[p]) {
+		return
+	}
+	d.retryAfter[p] = time.Now().Add(datagramRetryDelay)
+	go d.dial(p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// dial connects to p through the addresses of its existing direct QUIC connections, which are known to be reachable.
+func (d *DatagramPlane) dial(p peer.ID) {
+	if quicConns == nil {
+		return
+	}
+	for _, c := range d.host.Network().ConnsToPeer(p) {
+		addr := c.RemoteMultiaddr()
+		if !isDirectQUIC(addr) {
+			continue
+		}
+		tlsConf, _ := d.identity.ConfigForPeer(p)
+		tlsConf.NextProtos = []string{DatagramProtocol}
+		ctx, cancel := context.WithTimeout(d.ctx, 5*time.Second)
+		conn, err := quicConns.DialQUIC(ctx, addr, tlsConf, noWindowIncrease)
+		cancel()
+		if err != nil {
+			continue
+		}
+		d.adopt(p, conn, d.host.ID())
+		return
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// adopt makes conn the datagram connection to p. When both sides dial each other at the same time, both keep the
+// connection dialed by the lower peer ID.
+func (d *DatagramPlane) adopt(p peer.ID, conn quic.Connection, dialer peer.ID) {
+	dc := &datagramConn{Connection: conn, dialer: dialer}
+	preferred := min(d.host.ID(), p)
+
+	d.lock.Lock()
+	old, ok := d.conns[p]
+	if ok && old.dialer == preferred && dialer != preferred {
+		d.lock.Unlock()
+		conn.CloseWithError(0, "duplicate connection")
+		return
+	}
+	d.conns[p] = dc
+	d.lock.Unlock()
+
+	if ok {
+		old.CloseWithError(0, "duplicate connection")
+	} else {
+		fmt.Println("[+] Using datagrams for " + p.String())
+	}
+	go d.receive(p, dc)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (d *DatagramPlane) drop(p peer.ID, dc *datagramConn) {
+	d.lock.Lock()
+	if d.conns[p] == dc {
+		delete(d.conns, p)
+		fmt.Println("[-] Datagrams to " + p.String() + " unavailable, using streams")
+	}
+	d.lock.Unlock()
+	dc.CloseWithError(0, "")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (d *DatagramPlane) receive(p peer.ID, dc *datagramConn) {
+	var slots [datagramSlots]partialPacket
+	for {
+		dgram, err := dc.ReceiveDatagram(d.ctx)
+		if err != nil {
+			d.drop(p, dc)
+			return
+		}
+		if packet := reassemble(&slots, dgram); packet != nil {
+			d.handler(p, packet)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// send transmits packet as one datagram, or as several fragments if it does not fit into one.
+func (dc *datagramConn) send(packet []byte) error {
+	seq := uint16(dc.seq.Add(1))
+	chunk := len(packet)
+	if limit := int(dc.limit.Load()); limit > 0 {
+		chunk = limit - datagramHeaderLen
+	}
+	for {
+		err := dc.sendFragments(seq, packet, chunk)
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
+		limit := int(tooLarge.MaxDatagramPayloadSize)
+		if limit-datagramHeaderLen >= chunk || limit <= datagramHeaderLen {
+			return err
+		}
+		dc.limit.Store(int64(limit))
+		chunk = limit - datagramHeaderLen
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (dc *datagramConn) sendFragments(seq uint16, packet []byte, chunk int) error {
+	count := max((len(packet)+chunk-1)/chunk, 1)
+	if count > maxDatagramFragments {
+		return errTooManyFragments
+	}
+	buf := make([]byte, 0, datagramHeaderLen+chunk)
+	for i := 0; i < count; i++ {
+		frag := packet[i*chunk : min((i+1)*chunk, len(packet))]
+		buf = binary.LittleEndian.AppendUint16(buf[:0], seq)
+		buf = append(buf, uint8(i), uint8(count))
+		buf = append(buf, frag...)
+		if err := dc.SendDatagram(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// reassemble returns the packet carried by dgram once all of its fragments have arrived, and nil until then.
+// Fragments of lost packets are overwritten by later packets sharing their slot.
+func reassemble(slots *[datagramSlots]partialPacket, dgram []byte) []byte {
+	if len(dgram) < datagramHeaderLen {
+		return nil
+	}
+	seq := binary.LittleEndian.Uint16(dgram)
+	index, count := dgram[2], dgram[3]
+	payload := dgram[datagramHeaderLen:]
+	if count == 1 && index == 0 {
+		return payload
+	}
+	if index >= count || count > maxDatagramFragments {
+		return nil
+	}
+
+	s := &slots[seq%datagramSlots]
+	if s.seq != seq || s.count != count || s.have == 0 {
+		s.seq, s.count, s.have = seq, count, 0
+		s.frags = slices.Grow(s.frags[:0], int(count))[:count]
+	}
+	s.frags[index] = payload
+	s.have |= 1 << index
+	if s.have != 1<<count-1 {
+		return nil
+	}
+	s.have = 0
+	return slices.Concat(s.frags...)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func remotePeer(conn quic.Connection) (peer.ID, error) {
+	pubKey, err := libp2ptls.PubKeyFromCertChain(conn.ConnectionState().TLS.PeerCertificates)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pubKey)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func isDirectQUIC(addr ma.Multiaddr) bool {
+	if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+		return false
+	}
+	_, err := addr.ValueForProtocol(ma.P_QUIC_V1)
+	return err == nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// noWindowIncrease refuses flow control window increases, datagram connections never open streams.
+func noWindowIncrease(quic.Connection, uint64) bool {
+	return false
+}
@@ -2,20 +2,36 @@ package p2p
 
 import (
 	"context"
+	"slices"
 	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
 	"github.com/soitun/mynetwork/config"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-var discoverNow = make(chan bool)
+// discoverNow wakes up Discover. A pending wakeup covers any further ones, so Rediscover never blocks.
+var discoverNow = make(chan bool, 1)
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // Discover starts up a DHT based discovery system finding and adding nodes with the same rendezvous string.
 func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, cfg *config.Config) {
+	// Peers with static addresses or addresses saved by the last run don't have to be looked up, so they are dialled
+	// right away.
+	cfg.RLock()
+	peers := slices.Clone(cfg.Peers)
+	cfg.RUnlock()
+	for _, p := range peers {
+		if len(h.Peerstore().Addrs(p.ID)) > 0 {
+			go h.Network().DialPeer(ctx, p.ID)
+		}
+	}
+
 	dur := time.Second * 1
 	ticker := time.NewTicker(dur)
 	defer ticker.Stop()
@@ -31,9 +47,16 @@ func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, cfg *config.Co
 		case <-ticker.C:
 			connectedToAny := false
 			// 检查当前所有的 peers（包括动态添加的）
-			for _, p := range cfg.Peers {
+			cfg.RLock()
+			peers := slices.Clone(cfg.Peers)
+			cfg.RUnlock()
+			for _, p := range peers {
 				if h.Network().Connectedness(p.ID) != network.Connected {
 					_, err := h.Network().DialPeer(ctx, p.ID)
+					// A peer that rotated its key runs under its previous ID until it restarts.
+					if t := p.KeyTransition; err != nil && t != nil && t.Active() {
+						_, err = h.Network().DialPeer(ctx, t.Old)
+					}
 					if err != nil {
 						continue
 					}
@@ -61,5 +84,15 @@ func Discover(ctx context.Context, h host.Host, dht *dht.IpfsDHT, cfg *config.Co
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func Rediscover() {
-	discoverNow <- true
+	select {
+	case discoverNow <- true:
+	default:
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// SetStaticAddrs keeps the static addresses of a peer in the peerstore for good, and forgets the ones they replace.
+func SetStaticAddrs(h host.Host, id peer.ID, prev, addrs []multiaddr.Multiaddr) {
+	h.Peerstore().SetAddrs(id, prev, 0)
+	h.Peerstore().AddAddrs(id, addrs, peerstore.PermanentAddrTTL)
 }
@@ -0,0 +1,285 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/proto"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ExitProtocol is served by peers that forward traffic to the internet for the rest of the network.
+const ExitProtocol = "/hyprspace/exit/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// exitNets split the default routes in two halves, so they take precedence over the default routes of the system
+// without replacing them.
+var exitNets = []net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.IPv4(128, 0, 0, 0).To4(), Mask: net.CIDRMask(1, 32)},
+	{IP: net.ParseIP("::"), Mask: net.CIDRMask(1, 128)},
+	{IP: net.ParseIP("8000::"), Mask: net.CIDRMask(1, 128)},
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// activeExitClient is consulted by the RecursionGater to keep libp2p connections out of the tunnel.
+var activeExitClient *ExitClient
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ServeExit turns this node into an exit node: traffic from other peers is forwarded and masqueraded behind the
+// addresses of this host until ctx is done.
+func ServeExit(ctx context.Context, h host.Host, cfg *config.Config) error {
+	cleanup, err := enableNAT(cfg)
+	if err != nil {
+		return err
+	}
+	h.SetStreamHandler(ExitProtocol, func(s network.Stream) {
+		cfg.RLock()
+		_, found := config.FindPeer(cfg.Peers, s.Conn().RemotePeer())
+		cfg.RUnlock()
+		if !found {
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+	go func() {
+		<-ctx.Done()
+		cleanup()
+	}()
+	fmt.Println("[+] Acting as exit node")
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ExitClient sends all traffic without a more specific route through an exit node.
+type ExitClient struct {
+	host   host.Host
+	cfg    *config.Config
+	tunDev *tun.TUN
+	lock   sync.Mutex
+	exit   *config.Peer
+	bypass bypassRoutes
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewExitClient creates the exit client of the daemon. The exit node in use, if any, is turned off once ctx is done.
+func NewExitClient(ctx context.Context, h host.Host, cfg *config.Config, tunDev *tun.TUN) *ExitClient {
+	e := &ExitClient{
+		host:   h,
+		cfg:    cfg,
+		tunDev: tunDev,
+	}
+	activeExitClient = e
+	go func() {
+		<-ctx.Done()
+		_ = e.Off()
+	}()
+	return e
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Use routes all traffic through the exit node p. The current connections to peers and relays and the bootstrap
+// nodes keep using the regular uplink.
+func (e *ExitClient) Use(ctx context.Context, p peer.ID) error {
+	e.cfg.RLock()
+	target, found := config.FindPeer(e.cfg.Peers, p)
+	e.cfg.RUnlock()
+	if !found {
+		return errors.New("no such peer")
+	}
+	// Ask before taking the locks, opening the stream may dial and end up in Bypass.
+	s, err := e.host.NewStream(ctx, p, ExitProtocol)
+	if err != nil {
+		return fmt.Errorf("@%s does not act as exit node: %w", target.Name, err)
+	}
+	s.Close()
+
+	// The config is locked before the exit client, the same order Forget is called in.
+	e.cfg.Lock()
+	defer e.cfg.Unlock()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if target, found = config.FindPeer(e.cfg.Peers, p); !found {
+		return errors.New("no such peer")
+	}
+	if e.exit != nil {
+		e.off()
+	}
+	if err := e.bypass.capture(e.cfg); err != nil {
+		return err
+	}
+
+	for _, c := range e.host.Network().Conns() {
+		if ip := addrIP(c.RemoteMultiaddr()); ip != nil && e.bypassed(c.RemotePeer()) {
+			e.bypass.add(ip)
+		}
+	}
+	for _, addr := range bootstrapAddrs(e.cfg) {
+		if ip := addrIP(addr); ip != nil {
+			e.bypass.add(ip)
+		}
+	}
+
+	for _, n := range exitNets {
+		e.cfg.PeerLookup.ByRoute.Insert(&config.RouteTableEntry{
+			Net:       n,
+			Target:    *target,
+			Transient: true,
+		})
+		if err := e.tunDev.Apply(tun.Route(n)); err != nil {
+			e.exit = target
+			e.off()
+			return err
+		}
+	}
+	e.exit = target
+	fmt.Printf("[+] Using @%s (/p2p/%s) as exit node\n", target.Name, target.ID)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Off stops using the exit node.
+func (e *ExitClient) Off() error {
+	e.cfg.Lock()
+	defer e.cfg.Unlock()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.exit == nil {
+		return errors.New("no exit node in use")
+	}
+	e.off()
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Forget stops using p as exit node once it has been removed. The caller holds the config lock.
+func (e *ExitClient) Forget(p peer.ID) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.exit != nil && e.exit.ID == p {
+		e.off()
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (e *ExitClient) off() {
+	for _, n := range exitNets {
+		if removed, _ := e.cfg.RemoveRouteTo(n, e.exit.ID); removed {
+			_ = e.tunDev.Apply(tun.RemoveRoute(n))
+		}
+	}
+	e.bypass.clear()
+	fmt.Printf("[-] Stopped using @%s (/p2p/%s) as exit node\n", e.exit.Name, e.exit.ID)
+	e.exit = nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Current returns the exit node in use.
+func (e *ExitClient) Current() (config.Peer, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.exit == nil {
+		return config.Peer{}, false
+	}
+	return *e.exit, true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Bypass keeps traffic to ip, an address of p, on the regular uplink while an exit node is in use. Only peers,
+// relays and bootstrap nodes get a bypass route, the rest of the DHT is reached through the exit node.
+func (e *ExitClient) Bypass(p peer.ID, ip net.IP) {
+	if _, active := e.Current(); !active {
+		return
+	}
+	e.cfg.RLock()
+	bypassed := e.bypassed(p)
+	e.cfg.RUnlock()
+	if !bypassed {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.exit != nil {
+		e.bypass.add(ip)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// BypassAccepted is Bypass for an inbound connection from ip, whose node is not known yet. It gets a bypass route if
+// ip is a known address of a peer, relay or bootstrap node, or the handshake answers would take the exit node.
+func (e *ExitClient) BypassAccepted(ip net.IP) {
+	if _, active := e.Current(); !active {
+		return
+	}
+	e.cfg.RLock()
+	peers := e.bypassPeers()
+	e.cfg.RUnlock()
+	for _, p := range peers {
+		if slices.ContainsFunc(e.host.Peerstore().Addrs(p), func(addr ma.Multiaddr) bool { return ip.Equal(addrIP(addr)) }) {
+			e.Bypass(p, ip)
+			return
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// bypassed reports whether connections to p keep using the regular uplink. The caller holds the config lock.
+func (e *ExitClient) bypassed(p peer.ID) bool {
+	return slices.Contains(e.bypassPeers(), p) || e.isRelay(p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// bypassPeers returns the peers, the relays this node holds a reservation with and the bootstrap nodes. The caller
+// holds the config lock.
+func (e *ExitClient) bypassPeers() []peer.ID {
+	ids := make([]peer.ID, 0, len(e.cfg.Peers))
+	for _, p := range e.cfg.Peers {
+		ids = append(ids, p.ID)
+	}
+	for _, addr := range bootstrapAddrs(e.cfg) {
+		if info, err := peer.AddrInfoFromP2pAddr(addr); err == nil {
+			ids = append(ids, info.ID)
+		}
+	}
+	// The circuit addresses of this node name its relays.
+	for _, addr := range e.host.Addrs() {
+		relay, circuit := ma.SplitFunc(addr, func(c ma.Component) bool { return c.Code() == ma.P_CIRCUIT })
+		if len(circuit) == 0 {
+			continue
+		}
+		if info, err := peer.AddrInfoFromP2pAddr(relay); err == nil {
+			ids = append(ids, info.ID)
+		}
+	}
+	return ids
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// isRelay reports whether p offers relay reservations. AutoRelay dials its candidates before this node holds a
+// reservation with them.
+func (e *ExitClient) isRelay(p peer.ID) bool {
+	supported, err := e.host.Peerstore().SupportsProtocols(p, proto.ProtoIDv2Hop)
+	return err == nil && len(supported) > 0
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func addrIP(addr ma.Multiaddr) net.IP {
+	if s, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
+		return net.ParseIP(s)
+	}
+	if s, err := addr.ValueForProtocol(ma.P_IP6); err == nil {
+		return net.ParseIP(s)
+	}
+	return nil
+}
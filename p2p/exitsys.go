@@ -0,0 +1,149 @@
+//go:build !windows
+// +build !windows
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/soitun/mynetwork/config"
+	"github.com/vishvananda/netlink"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// uplinkProbes are well known internet addresses used to look up the regular uplink of each address family.
+var uplinkProbes = []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("2606:4700:4700::1111")}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// bypassRoutes are host routes through the regular uplink that take precedence over the exit routes.
+type bypassRoutes struct {
+	tunIndex int
+	overlay  []net.IPNet
+	uplinks  map[int]netlink.Route
+	routes   map[string]netlink.Route
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// capture remembers the regular uplinks, before the exit routes hide them.
+func (b *bypassRoutes) capture(cfg *config.Config) error {
+	link, err := netlink.LinkByName(cfg.Interface)
+	if err != nil {
+		return err
+	}
+	b.tunIndex = link.Attrs().Index
+	b.overlay = []net.IPNet{cfg.Net4, cfg.Net6, cfg.ServiceNet}
+	b.uplinks = make(map[int]netlink.Route)
+	b.routes = make(map[string]netlink.Route)
+	for _, probe := range uplinkProbes {
+		routes, err := netlink.RouteGet(probe)
+		if err == nil && len(routes) > 0 && routes[0].LinkIndex != b.tunIndex {
+			b.uplinks[hostBits(probe)] = routes[0]
+		}
+	}
+	if len(b.uplinks) == 0 {
+		return errors.New("no uplink to reach the exit node through")
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (b *bypassRoutes) add(ip net.IP) {
+	if _, ok := b.routes[ip.String()]; ok || ip.IsLoopback() || slices.ContainsFunc(b.overlay, func(n net.IPNet) bool { return n.Contains(ip) }) {
+		return
+	}
+	// Addresses on directly attached networks are never caught by the exit routes.
+	if routes, err := netlink.RouteGet(ip); err == nil && len(routes) > 0 && routes[0].LinkIndex != b.tunIndex && routes[0].Gw == nil {
+		return
+	}
+	bits := hostBits(ip)
+	uplink, ok := b.uplinks[bits]
+	if !ok {
+		return
+	}
+	r := netlink.Route{
+		LinkIndex: uplink.LinkIndex,
+		Gw:        uplink.Gw,
+		Dst:       &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+	}
+	if err := netlink.RouteAdd(&r); err != nil {
+		fmt.Printf("[!] Failed to add bypass route for %s: %v\n", ip, err)
+		return
+	}
+	b.routes[ip.String()] = r
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (b *bypassRoutes) clear() {
+	for _, r := range b.routes {
+		_ = netlink.RouteDel(&r)
+	}
+	b.routes = nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func hostBits(ip net.IP) int {
+	if ip.To4() != nil {
+		return 32
+	}
+	return 128
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// enableNAT turns on forwarding and masquerades traffic from the network leaving through any other interface.
+// The returned function removes the firewall rules again.
+func enableNAT(cfg *config.Config) (func(), error) {
+	for _, sysctl := range []string{"/proc/sys/net/ipv4/ip_forward", "/proc/sys/net/ipv6/conf/all/forwarding"} {
+		if err := os.WriteFile(sysctl, []byte("1"), 0o644); err != nil {
+			return nil, err
+		}
+	}
+
+	var added [][]string
+	cleanup := func() {
+		for i := len(added) - 1; i >= 0; i-- {
+			_ = iptables(added[i][0], "-D", added[i][1:]...)
+		}
+	}
+	for _, family := range []struct {
+		cmd string
+		net net.IPNet
+	}{
+		{"iptables", cfg.Net4},
+		{"ip6tables", cfg.Net6},
+	} {
+		rules := [][]string{
+			{"POSTROUTING", "-t", "nat", "-s", family.net.String(), "!", "-d", family.net.String(), "-j", "MASQUERADE"},
+			{"FORWARD", "-i", cfg.Interface, "-j", "ACCEPT"},
+			{"FORWARD", "-o", cfg.Interface, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		}
+		for _, rule := range rules {
+			if err := iptables(family.cmd, "-I", rule...); err != nil {
+				// Exit traffic still works for the other address family.
+				fmt.Printf("[!] %s: %v\n", family.cmd, err)
+				break
+			}
+			added = append(added, append([]string{family.cmd}, rule...))
+		}
+	}
+	if len(added) == 0 {
+		return nil, errors.New("failed to set up masquerading")
+	}
+	return cleanup, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// iptables runs cmd with the given action on the chain that starts the rule.
+func iptables(cmd string, action string, rule ...string) error {
+	args := append([]string{action}, rule...)
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", cmd, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package p2p
+
+import (
+	"errors"
+	"net"
+
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var errExitUnsupported = errors.New("exit nodes are not supported on windows")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type bypassRoutes struct{}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (b *bypassRoutes) capture(cfg *config.Config) error {
+	return errExitUnsupported
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (b *bypassRoutes) add(ip net.IP) {}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (b *bypassRoutes) clear() {}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func enableNAT(cfg *config.Config) (func(), error) {
+	return nil, errExitUnsupported
+}
@@ -0,0 +1,96 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var droppedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "mynetwork_dropped_packets_total",
+	Help: "Packets received from peers that were dropped by the packet filter.",
+}, []string{"peer", "reason"})
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// spoofLogInterval limits how often dropped spoofed packets are logged per peer.
+const spoofLogInterval = 10 * time.Second
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PacketFilter decides which packets received from peers may be written to the TUN device.
+type PacketFilter struct {
+	cfg       *config.Config
+	lock      sync.Mutex
+	lastSpoof map[peer.ID]time.Time
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func NewPacketFilter(cfg *config.Config) *PacketFilter {
+	return &PacketFilter{
+		cfg:       cfg,
+		lastSpoof: make(map[peer.ID]time.Time),
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Allow reports whether a packet sent by src passes the source address check and the ACL of src, and counts it as
+// dropped otherwise.
+func (f *PacketFilter) Allow(src peer.ID, packet []byte) bool {
+	f.cfg.RLock()
+	defer f.cfg.RUnlock()
+	p, found := config.FindPeer(f.cfg.Peers, src)
+	if !found {
+		droppedPackets.WithLabelValues(src.String(), "unknown").Inc()
+		return false
+	}
+	if Mismatched(src) {
+		droppedPackets.WithLabelValues(src.String(), "mismatch").Inc()
+		return false
+	}
+	if !p.AllowAnySource {
+		addr := sourceAddr(packet)
+		if addr == nil {
+			droppedPackets.WithLabelValues(src.String(), "malformed").Inc()
+			return false
+		}
+		// Reverse path check: the source must be routed back to the peer that sent the packet.
+		if rte, found := f.cfg.FindRouteForIP(addr); !found || !rte.Target.Is(src) {
+			droppedPackets.WithLabelValues(src.String(), "spoof").Inc()
+			f.logSpoof(p, addr)
+			return false
+		}
+	}
+	if p.ACL != nil && !p.ACL.Allows(packet) {
+		droppedPackets.WithLabelValues(src.String(), "acl").Inc()
+		return false
+	}
+	return true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (f *PacketFilter) logSpoof(p *config.Peer, addr net.IP) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if time.Since(f.lastSpoof[p.ID]) < spoofLogInterval {
+		return
+	}
+	f.lastSpoof[p.ID] = time.Now()
+	fmt.Printf("[!] Dropped packet from @%s (/p2p/%s) with foreign source address %s\n", p.Name, p.ID, addr)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sourceAddr(packet []byte) net.IP {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return net.IP(packet[12:16])
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return net.IP(packet[8:24])
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// BatchProtocol carries the same packets as Protocol, but several of them are coalesced into one length-prefixed
+// batch per stream write.
+const BatchProtocol = "/hyprspace/0.0.2"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MaxBatchSize is the largest batch payload that fits into a BatchProtocol frame.
+const MaxBatchSize = 65535
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// MaxFrameSize is the largest packet that fits into a Protocol frame.
+const MaxFrameSize = 65535
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+var errMalformedBatch = errors.New("malformed packet batch")
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// IsTunnelProtocol reports whether a stream protocol carries tunnel packets.
+func IsTunnelProtocol(id protocol.ID) bool {
+	return id == Protocol || id == BatchProtocol
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AppendFrame appends a packet prefixed with its length to buf.
+func AppendFrame(buf []byte, packet []byte) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(packet)))
+	return append(buf, packet...)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ReadFrames reads length-prefixed packets as sent over Protocol and calls handle for each of them, until reading
+// from r fails.
+func ReadFrames(r io.Reader, buf []byte, handle func([]byte)) error {
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint16(size[:]))
+		if n > len(buf) {
+			return fmt.Errorf("packet of %d bytes exceeds buffer of %d bytes", n, len(buf))
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		handle(buf[:n])
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ReadBatches reads batches as sent over BatchProtocol and calls handle for every packet in them, until reading
+// from r fails. buf must be able to hold MaxBatchSize bytes.
+func ReadBatches(r io.Reader, buf []byte, handle func([]byte)) error {
+	var size [2]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			return err
+		}
+		batch := buf[:n]
+		for len(batch) > 0 {
+			if len(batch) < 2 {
+				return errMalformedBatch
+			}
+			plen := int(binary.LittleEndian.Uint16(batch))
+			batch = batch[2:]
+			if plen > len(batch) {
+				return errMalformedBatch
+			}
+			handle(batch[:plen])
+			batch = batch[plen:]
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// InviteProtocol carries the handshake of a node joining the network with an invite.
+const InviteProtocol = "/hyprspace/invite/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxInviteMessageSize bounds the size of the messages of the invite handshake.
+const maxInviteMessageSize = 4096
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// joinRequest is sent by the joining node with the secret of its invite.
+type joinRequest struct {
+	Secret []byte `json:"secret"`
+	// Name is the name the joining node proposes for itself, used if the invite doesn't name it.
+	Name string `json:"name"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// JoinResult is the answer of the inviter to a join request.
+type JoinResult struct {
+	Error string `json:"error,omitempty"`
+	// Name is the name the inviter gave the joining node.
+	Name string `json:"name,omitempty"`
+	// Addr4 and Addr6 are the addresses the joining node has in the network.
+	Addr4 net.IP `json:"addr4,omitempty"`
+	Addr6 net.IP `json:"addr6,omitempty"`
+	// InviterAddr4 and InviterAddr6 are the addresses of the inviter.
+	InviterAddr4 net.IP `json:"inviterAddr4,omitempty"`
+	InviterAddr6 net.IP `json:"inviterAddr6,omitempty"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Invites holds the invites issued by this node until they are used or expire. They only live as long as the daemon.
+type Invites struct {
+	host    host.Host
+	cfg     *config.Config
+	accept  func(name string, id peer.ID) (config.Peer, error)
+	mu      sync.Mutex
+	pending map[[32]byte]*config.Invite
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NewInvites answers join requests of nodes holding an invite of this node. accept adds the joining node as a peer.
+func NewInvites(h host.Host, cfg *config.Config, accept func(name string, id peer.ID) (config.Peer, error)) *Invites {
+	i := &Invites{
+		host:    h,
+		cfg:     cfg,
+		accept:  accept,
+		pending: make(map[[32]byte]*config.Invite),
+	}
+	h.SetStreamHandler(InviteProtocol, i.handle)
+	return i
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Create issues an invite that can be used once until ttl has passed. hostname is the name the joining node gives this
+// node, name the one this node gives it.
+func (i *Invites) Create(hostname, name string, ttl time.Duration) (*config.Invite, string, error) {
+	var addrs []ma.Multiaddr
+	for _, addr := range i.host.Addrs() {
+		if !manet.IsIPLoopback(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	inv, err := i.cfg.NewInvite(hostname, name, addrs, time.Now().Add(ttl))
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := inv.Token(i.cfg.PrivateKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for key, pending := range i.pending {
+		if !time.Now().Before(pending.Expires) {
+			delete(i.pending, key)
+		}
+	}
+	i.pending[sha256.Sum256(inv.Secret)] = inv
+	return inv, token, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// take removes the invite with the given secret, so it can't be used again.
+func (i *Invites) take(secret []byte) (*config.Invite, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key := sha256.Sum256(secret)
+	inv, found := i.pending[key]
+	delete(i.pending, key)
+	if !found || !time.Now().Before(inv.Expires) {
+		return nil, false
+	}
+	return inv, true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// restore makes an invite usable again after a join failed on this side.
+func (i *Invites) restore(inv *config.Invite) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.pending[sha256.Sum256(inv.Secret)] = inv
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (i *Invites) handle(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+	remote := s.Conn().RemotePeer()
+
+	var req joinRequest
+	if err := json.NewDecoder(io.LimitReader(s, maxInviteMessageSize)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+	reply := func(res JoinResult) {
+		_ = json.NewEncoder(s).Encode(res)
+	}
+	inv, found := i.take(req.Secret)
+	if !found {
+		fmt.Printf("[!] Rejected join request of /p2p/%s: invalid or expired invite\n", remote)
+		reply(JoinResult{Error: "invalid or expired invite"})
+		return
+	}
+	name := inv.Name
+	if name == "" {
+		name = req.Name
+	}
+	if name == "" {
+		i.restore(inv)
+		reply(JoinResult{Error: "the invite doesn't name the new peer, pass --name to join"})
+		return
+	}
+	p, err := i.accept(name, remote)
+	if err != nil {
+		i.restore(inv)
+		fmt.Printf("[!] Failed to add /p2p/%s as %s: %v\n", remote, name, err)
+		reply(JoinResult{Error: err.Error()})
+		return
+	}
+	fmt.Printf("[+] %s (/p2p/%s) joined with an invite\n", name, remote)
+	reply(JoinResult{
+		Name:         name,
+		Addr4:        p.BuiltinAddr4,
+		Addr6:        p.BuiltinAddr6,
+		InviterAddr4: i.cfg.BuiltinAddr4,
+		InviterAddr6: i.cfg.BuiltinAddr6,
+	})
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Join dials the inviter and hands it the secret of the invite. The inviter adds this node as a peer named name,
+// unless the invite names it.
+func Join(ctx context.Context, h host.Host, inv *config.Invite, name string) (*JoinResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	if err := h.Connect(ctx, peer.AddrInfo{ID: inv.Inviter, Addrs: inv.Addrs}); err != nil {
+		return nil, fmt.Errorf("unable to reach the inviter: %w", err)
+	}
+	s, err := h.NewStream(ctx, inv.Inviter, InviteProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("the inviter doesn't accept invites: %w", err)
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(s).Encode(joinRequest{Secret: inv.Secret, Name: name}); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	var res JoinResult
+	if err := json.NewDecoder(io.LimitReader(s, maxInviteMessageSize)).Decode(&res); err != nil {
+		s.Reset()
+		return nil, fmt.Errorf("no answer from the inviter: %w", err)
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	if res.Addr4.To4() == nil || res.Addr6 == nil || res.InviterAddr4.To4() == nil || res.InviterAddr6 == nil {
+		return nil, errors.New("invalid answer from the inviter")
+	}
+	return &res, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ApplyJoin pins the addresses the inviter assigned to this node if they differ from the ones it picked itself, and
+// returns the addresses to configure for the inviter, nil if it gets them anyway. It reports whether the addresses of
+// this node changed. Only the pinned addresses change, a running node keeps using its current ones until it is
+// restarted.
+func ApplyJoin(cfg *config.Config, inv *config.Invite, res *JoinResult) (addr4, addr6 net.IP, changed bool) {
+	if !res.Addr4.Equal(cfg.BuiltinAddr4) || !res.Addr6.Equal(cfg.BuiltinAddr6) {
+		cfg.Addr4, cfg.Addr6 = res.Addr4.To4(), res.Addr6
+		changed = true
+	}
+	pref4, pref6 := cfg.PreferredAddrs(inv.Inviter)
+	if !res.InviterAddr4.Equal(pref4) || !res.InviterAddr6.Equal(pref6) {
+		addr4, addr6 = res.InviterAddr4.To4(), res.InviterAddr6
+	}
+	return addr4, addr6, changed
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// JoinWithKey runs Join from a temporary node with the given key, for nodes whose daemon isn't running.
+func JoinWithKey(ctx context.Context, key crypto.PrivKey, inv *config.Invite, name string) (*JoinResult, error) {
+	h, err := libp2p.New(
+		libp2p.Identity(key),
+		libp2p.UserAgent("hyprspace"),
+		libp2p.NoListenAddrs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	return Join(ctx, h, inv, name)
+}
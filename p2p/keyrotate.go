@@ -0,0 +1,113 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyTransitionProtocol carries the signed record a node sends its peers after rotating its key.
+const KeyTransitionProtocol = "/hyprspace/key-transition/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// maxKeyTransitionSize bounds the size of a key transition record.
+const maxKeyTransitionSize = 4096
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// KeyTransitionService applies the key transitions sent by peers through apply, and sends the key transition of this
+// node to every VPN peer that connects while its grace window is open, so that peers that were offline during the
+// rotation catch up.
+func KeyTransitionService(ctx context.Context, h host.Host, cfg *config.Config, apply func(*config.KeyTransition) error) {
+	h.SetStreamHandler(KeyTransitionProtocol, func(s network.Stream) {
+		s.SetDeadline(time.Now().Add(10 * time.Second))
+		data, err := io.ReadAll(io.LimitReader(s, maxKeyTransitionSize))
+		if err != nil {
+			s.Reset()
+			return
+		}
+		remote := s.Conn().RemotePeer()
+		t, err := config.ConsumeKeyTransition(data)
+		// The record comes from the rotating node itself, under either identity.
+		if err != nil || (remote != t.Old && remote != t.New) {
+			fmt.Printf("[!] Ignoring invalid key transition from /p2p/%s\n", remote)
+			s.Reset()
+			return
+		}
+		cfg.RLock()
+		_, found := config.FindPeer(cfg.Peers, t.Old)
+		cfg.RUnlock()
+		if !found || !t.Active() {
+			s.Reset()
+			return
+		}
+		if err := apply(t); err != nil {
+			fmt.Printf("[!] Failed to apply key transition of /p2p/%s: %v\n", t.Old, err)
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+
+	subCon, err := h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer subCon.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-subCon.Out():
+			evt := ev.(event.EvtPeerConnectednessChanged)
+			cfg.RLock()
+			_, found := config.FindPeer(cfg.Peers, evt.Peer)
+			cfg.RUnlock()
+			if found && evt.Connectedness == network.Connected {
+				go sendKeyTransition(ctx, h, cfg, evt.Peer)
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AnnounceKeyTransition sends the key transition of this node to every connected peer, right after the rotation. The
+// caller holds the config lock.
+func AnnounceKeyTransition(ctx context.Context, h host.Host, cfg *config.Config) {
+	for _, p := range cfg.Peers {
+		if h.Network().Connectedness(p.ID) == network.Connected {
+			go sendKeyTransition(ctx, h, cfg, p.ID)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func sendKeyTransition(ctx context.Context, h host.Host, cfg *config.Config, p peer.ID) {
+	cfg.RLock()
+	t := cfg.KeyTransition
+	cfg.RUnlock()
+	if t == nil || !t.Active() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	s, err := h.NewStream(ctx, p, KeyTransitionProtocol)
+	if err != nil {
+		// Peers running an older version don't speak the protocol.
+		return
+	}
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := s.Write(t.Envelope); err != nil {
+		s.Reset()
+		return
+	}
+	s.Close()
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// mdnsServiceName is announced on the local network instead of the one of IPFS, so nodes only hear of each other.
+const mdnsServiceName = "_mynetwork._udp"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// mdnsNotifee dials the configured peers that mDNS finds on the local network.
+type mdnsNotifee struct {
+	ctx  context.Context
+	host host.Host
+	cfg  *config.Config
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// HandlePeerFound connects to a peer announced on the local network, unless it isn't one of ours or is connected
+// already.
+func (n mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	n.cfg.RLock()
+	_, found := config.FindPeer(n.cfg.Peers, pi.ID)
+	n.cfg.RUnlock()
+	if !found || n.host.Network().Connectedness(pi.ID) == network.Connected {
+		return
+	}
+	go n.host.Connect(n.ctx, pi)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// startMdns announces the node on the local network and looks for its peers there until ctx is done.
+func startMdns(ctx context.Context, h host.Host, cfg *config.Config) {
+	service := mdns.NewMdnsService(h, mdnsServiceName, mdnsNotifee{ctx, h, cfg})
+	if err := service.Start(); err != nil {
+		fmt.Println("[!] Local peer discovery failed:", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		service.Close()
+	}()
+}
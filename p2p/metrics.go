@@ -26,7 +26,9 @@ func RouteMetricsService(ctx context.Context, host host.Host, cfg *config.Config
 			return
 		case ev := <-subCon.Out():
 			evt := ev.(event.EvtPeerConnectednessChanged)
+			cfg.RLock()
 			_, found := config.FindPeer(cfg.Peers, evt.Peer)
+			cfg.RUnlock()
 			if found {
 				if evt.Connectedness == network.Connected {
 					ctx2, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
@@ -0,0 +1,193 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	// IPv4 routers quote as much of the offending packet as fits into 576 bytes, IPv6 ones as much as fits into 1280.
+	maxICMPv4Error = 576
+	maxICMPv6Error = 1280
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ClampMSS lowers the MSS option of a TCP SYN to what fits into mtu, so that neither end of the connection sends
+// segments that are too large for the path between them.
+func ClampMSS(packet []byte, mtu int) {
+	var hlen, mss int
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		hlen, mss = int(packet[0]&0x0f)*4, mtu-40
+		if packet[9] != 6 || hlen < 20 || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		// Extension headers before TCP are rare enough to leave such packets alone.
+		hlen, mss = 40, mtu-60
+		if packet[6] != 6 {
+			return
+		}
+	default:
+		return
+	}
+	if len(packet) < hlen+20 {
+		return
+	}
+	tcp := packet[hlen:]
+	if tcp[13]&0x02 == 0 {
+		return
+	}
+	end := int(tcp[12]>>4) * 4
+	if end < 20 || len(tcp) < end {
+		return
+	}
+	for i := 20; i < end; {
+		switch tcp[i] {
+		case 0:
+			return
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= end || tcp[i+1] < 2 || i+int(tcp[i+1]) > end {
+			return
+		}
+		if tcp[i] == 2 && tcp[i+1] == 4 {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if int(old) > mss {
+				binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+				updateChecksum(tcp[16:18], old, uint16(mss), (i+2)%2 == 1)
+			}
+			return
+		}
+		i += int(tcp[i+1])
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// TooBig returns the ICMP "fragmentation needed" or ICMPv6 "packet too big" error that tells the sender of packet to
+// stay below mtu, to be written to the TUN device. It returns nil for IPv4 packets that may be fragmented instead and
+// for packets that must not be answered with an error, like ICMP errors themselves.
+func TooBig(cfg *config.Config, packet []byte, mtu int) []byte {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		hlen := int(packet[0]&0x0f) * 4
+		if hlen < 20 || len(packet) < hlen || binary.BigEndian.Uint16(packet[6:8])&0x4000 == 0 {
+			return nil
+		}
+		if packet[9] == 1 && len(packet) > hlen {
+			switch packet[hlen] {
+			case 3, 4, 5, 11, 12:
+				return nil
+			}
+		}
+		quote := packet[:min(len(packet), maxICMPv4Error-28)]
+		reply := make([]byte, 28+len(quote))
+		reply[0] = 0x45
+		binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+		reply[8], reply[9] = 64, 1
+		copy(reply[12:16], cfg.BuiltinAddr4.To4())
+		copy(reply[16:20], packet[12:16])
+		binary.BigEndian.PutUint16(reply[10:12], checksum(0, reply[:20]))
+		icmp := reply[20:]
+		icmp[0], icmp[1] = 3, 4
+		binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(0, icmp))
+		return reply
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		if packet[6] == 58 && len(packet) > 40 && packet[40] < 128 {
+			return nil
+		}
+		quote := packet[:min(len(packet), maxICMPv6Error-48)]
+		reply := make([]byte, 48+len(quote))
+		reply[0] = 0x60
+		binary.BigEndian.PutUint16(reply[4:6], uint16(8+len(quote)))
+		reply[6], reply[7] = 58, 64
+		copy(reply[8:24], cfg.BuiltinAddr6.To16())
+		copy(reply[24:40], packet[8:24])
+		icmp := reply[40:]
+		icmp[0] = 2
+		binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+		copy(icmp[8:], quote)
+		// The checksum covers a pseudo header of both addresses, the length and the next header as well.
+		pseudo := sum(0, reply[8:40]) + uint32(len(icmp)) + 58
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(pseudo, icmp))
+		return reply
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Fragment splits an IPv4 packet without the don't fragment flag into fragments that fit into mtu. It returns nil
+// for every other packet.
+func Fragment(packet []byte, mtu int) [][]byte {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return nil
+	}
+	hlen := int(packet[0]&0x0f) * 4
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	if hlen < 20 || len(packet) < hlen || flags&0x4000 != 0 {
+		return nil
+	}
+	offset, more := flags&0x1fff, flags&0x2000
+	payload := packet[hlen:]
+	chunk := (mtu - hlen) &^ 7
+	var frags [][]byte
+	for start := 0; start < len(payload); start += chunk {
+		end := min(start+chunk, len(payload))
+		frag := make([]byte, hlen+end-start)
+		copy(frag, packet[:hlen])
+		copy(frag[hlen:], payload[start:end])
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		fflags := offset + uint16(start/8)
+		if end < len(payload) {
+			fflags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(frag[6:8], fflags|more)
+		frag[10], frag[11] = 0, 0
+		binary.BigEndian.PutUint16(frag[10:12], checksum(0, frag[:hlen]))
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// sum adds b to a partial internet checksum.
+func sum(acc uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		acc += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		acc += uint32(b[0]) << 8
+	}
+	return acc
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// checksum completes the internet checksum of b, starting from a partial sum.
+func checksum(acc uint32, b []byte) uint16 {
+	acc = sum(acc, b)
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+	return ^uint16(acc)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// updateChecksum adjusts a checksum for a 16 bit value that changed from prev to next, as described in RFC 1624.
+// Values at odd offsets straddle two checksum words, which amounts to swapping their bytes.
+func updateChecksum(field []byte, prev, next uint16, odd bool) {
+	if odd {
+		prev, next = bits.ReverseBytes16(prev), bits.ReverseBytes16(next)
+	}
+	acc := uint32(^binary.BigEndian.Uint16(field)) + uint32(^prev) + uint32(next)
+	for acc > 0xffff {
+		acc = acc&0xffff + acc>>16
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(acc))
+}
@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	msmux "github.com/multiformats/go-multistream"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NetParamsProtocol lets peers compare their overlay ranges, which have to be the same on every node. A second line
+// carries the MTU of the peer, which older versions don't send.
+const NetParamsProtocol = "/hyprspace/netparams/0.0.1"
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// mismatchedPeers holds the peers whose overlay ranges differ from ours. Packets from them are dropped.
+var mismatchedPeers sync.Map
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// peerMTUs holds the MTU of every peer that has told us about it.
+var peerMTUs sync.Map
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// netParams describes the overlay ranges of a config.
+func netParams(cfg *config.Config) string {
+	return fmt.Sprintf("%s %s %s", &cfg.Net4, &cfg.Net6, &cfg.ServiceNet)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Mismatched reports whether p uses different overlay ranges than this node.
+func Mismatched(p peer.ID) bool {
+	_, found := mismatchedPeers.Load(p)
+	return found
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PathMTU returns the largest packet that may be sent to p, which is the smaller of our MTU and the MTU of p. Until
+// the MTU of p is known, our own is assumed.
+func PathMTU(p peer.ID, local int) int {
+	if mtu, found := peerMTUs.Load(p); found {
+		return min(local, mtu.(int))
+	}
+	return local
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// NetParamsService tells peers about the overlay ranges of this node and compares the ranges of every VPN peer that
+// connects with our own. Peers with different ranges are disconnected.
+func NetParamsService(ctx context.Context, h host.Host, cfg *config.Config) {
+	h.SetStreamHandler(NetParamsProtocol, func(s network.Stream) {
+		cfg.RLock()
+		_, found := config.FindPeer(cfg.Peers, s.Conn().RemotePeer())
+		cfg.RUnlock()
+		if !found {
+			s.Reset()
+			return
+		}
+		s.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := fmt.Fprintf(s, "%s\n%d\n", netParams(cfg), cfg.MTU); err != nil {
+			s.Reset()
+			return
+		}
+		s.Close()
+	})
+
+	subCon, err := h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer subCon.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-subCon.Out():
+			evt := ev.(event.EvtPeerConnectednessChanged)
+			cfg.RLock()
+			_, found := config.FindPeer(cfg.Peers, evt.Peer)
+			cfg.RUnlock()
+			if found && evt.Connectedness == network.Connected {
+				go checkNetParams(ctx, h, cfg, evt.Peer)
+			}
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func checkNetParams(ctx context.Context, h host.Host, cfg *config.Config, p peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var remote string
+	// Older versions always use the default MTU.
+	remoteMTU := config.DefaultMTU
+	s, err := h.NewStream(ctx, p, NetParamsProtocol)
+	switch {
+	case errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}):
+		// Older versions always use the default ranges.
+		remote = netParams(&config.Config{Net4: config.DefaultNet4, Net6: config.DefaultNet6, ServiceNet: config.DefaultServiceNet})
+	case err != nil:
+		return
+	default:
+		s.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(s)
+		remote, err = r.ReadString('\n')
+		if err != nil {
+			s.Reset()
+			return
+		}
+		if line, err := r.ReadString('\n'); err == nil {
+			if mtu, err := strconv.Atoi(strings.TrimSuffix(line, "\n")); err == nil && mtu >= config.MinMTU {
+				remoteMTU = mtu
+			}
+		}
+		s.Close()
+		remote = strings.TrimSuffix(remote, "\n")
+	}
+	setPeerMTU(p, remoteMTU, cfg.MTU)
+
+	if local := netParams(cfg); remote != local {
+		if _, seen := mismatchedPeers.LoadOrStore(p, struct{}{}); !seen {
+			fmt.Printf("[!] /p2p/%s uses the overlay networks %s, but this node uses %s; refusing it\n", p, remote, local)
+		}
+		_ = h.Network().ClosePeer(p)
+		return
+	}
+	mismatchedPeers.Delete(p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// setPeerMTU records the MTU of p, and tells about it when packets to p have to be smaller than our own.
+func setPeerMTU(p peer.ID, mtu int, local int) {
+	old, found := peerMTUs.Swap(p, mtu)
+	if mtu < local && (!found || old.(int) != mtu) {
+		fmt.Printf("[!] /p2p/%s uses an MTU of %d, smaller than ours of %d; packets to it are limited to that\n", p, mtu, local)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
 	drclient "github.com/ipfs/boxo/routing/http/client"
@@ -20,7 +19,6 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/libp2p/go-libp2p/core/routing"
 	"github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
@@ -30,6 +28,7 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/soitun/mynetwork/config"
+	"go.uber.org/fx"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -55,6 +54,61 @@ func (c *httpRoutingWrapper) Bootstrap(ctx context.Context) error {
 // Protocol is a descriptor for the Hyprspace P2P Protocol.
 const Protocol = "/hyprspace/0.0.1"
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// defaultBootstrapPeers are the public nodes the DHT is bootstrapped from, unless the config names others.
+var defaultBootstrapPeers = []string{
+	"/ip4/152.67.75.145/tcp/110/p2p/12D3KooWQWsHPUUeFhe4b6pyCaD1hBoj8j6Z7S7kTznRTh1p1eVt",
+	"/ip4/152.67.75.145/udp/110/quic-v1/p2p/12D3KooWQWsHPUUeFhe4b6pyCaD1hBoj8j6Z7S7kTznRTh1p1eVt",
+	"/ip4/152.67.75.145/tcp/995/p2p/QmbrAHuh4RYcyN9fWePCZMVmQjbaNXtyvrDCWz4VrchbXh",
+	"/ip4/152.67.75.145/udp/995/quic-v1/p2p/QmbrAHuh4RYcyN9fWePCZMVmQjbaNXtyvrDCWz4VrchbXh",
+	"/ip4/95.216.8.12/tcp/110/p2p/Qmd7QHZU8UjfYdwmjmq1SBh9pvER9AwHpfwQvnvNo3HBBo",
+	"/ip4/95.216.8.12/udp/110/quic-v1/p2p/Qmd7QHZU8UjfYdwmjmq1SBh9pvER9AwHpfwQvnvNo3HBBo",
+	"/ip4/95.216.8.12/tcp/995/p2p/QmYs4xNBby2fTs8RnzfXEk161KD4mftBfCiR8yXtgGPj4J",
+	"/ip4/95.216.8.12/udp/995/quic-v1/p2p/QmYs4xNBby2fTs8RnzfXEk161KD4mftBfCiR8yXtgGPj4J",
+	"/ip4/152.67.73.164/tcp/995/p2p/12D3KooWL84sAtq1QTYwb7gVbhSNX5ZUfVt4kgYKz8pdif1zpGUh",
+	"/ip4/152.67.73.164/udp/995/quic-v1/p2p/12D3KooWL84sAtq1QTYwb7gVbhSNX5ZUfVt4kgYKz8pdif1zpGUh",
+	"/ip4/37.27.11.202/udp/21/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
+	"/ip4/37.27.11.202/udp/443/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
+	"/ip4/37.27.11.202/udp/500/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
+	"/ip4/37.27.11.202/udp/995/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/12D3KooWEZXjE41uU4EL2gpkAQeDXYok6wghN7wwNVPF5bwkaNfS",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmZa1sAxajnQjVM8WjWXoMbmPd7NsWhfKsPkErzpm9wGkp",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
+	"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// defaultDelegatedRouting are the HTTP routing endpoints peers are looked up at, unless the config names others.
+var defaultDelegatedRouting = []string{"https://p2p.privatevoid.net"}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// bootstrapAddrs returns the addresses of the nodes the DHT is bootstrapped from. Private nodes only use configured
+// ones.
+func bootstrapAddrs(cfg *config.Config) []ma.Multiaddr {
+	if len(cfg.BootstrapPeers) > 0 || cfg.Private {
+		return cfg.BootstrapPeers
+	}
+	addrs := make([]ma.Multiaddr, len(defaultBootstrapPeers))
+	for i, s := range defaultBootstrapPeers {
+		addrs[i] = ma.StringCast(s)
+	}
+	return addrs
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// delegatedRouting returns the HTTP routing endpoints to use, none for private nodes.
+func delegatedRouting(cfg *config.Config) []string {
+	switch {
+	case cfg.Private:
+		return nil
+	case len(cfg.DelegatedRouting) > 0:
+		return cfg.DelegatedRouting
+	}
+	return defaultDelegatedRouting
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func getExtraPeers(addr ma.Multiaddr) (nodesList []string) {
 	nodesList = []string{}
@@ -116,19 +170,11 @@ func getExtraBootstrapNodes(addr ma.Multiaddr) (nodesList []string) {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // CreateNode creates an internal Libp2p nodes and returns it and it's DHT Discovery service.
-func CreateNode(ctx context.Context, privateKey crypto.PrivKey, listenAddreses []ma.Multiaddr, handler network.StreamHandler, acl relay.ACLFilter, gater connmgr.ConnectionGater, vpnPeers []config.Peer) (node host.Host, dhtOut *dht.IpfsDHT, err error) {
+func CreateNode(ctx context.Context, privateKey crypto.PrivKey, listenAddreses []ma.Multiaddr, handler network.StreamHandler, acl relay.ACLFilter, gater connmgr.ConnectionGater, cfg *config.Config) (node host.Host, dhtOut *dht.IpfsDHT, err error) {
 	maybePrivateNet := libp2p.ChainOptions()
-	swarmKeyFile, ok := os.LookupEnv("HYPRSPACE_SWARM_KEY")
-	if ok {
-		fmt.Println("[+] Using swarm key " + swarmKeyFile)
-		var swarmKey *os.File
-		swarmKey, err = os.Open(swarmKeyFile)
-		if err != nil {
-			return
-		}
-		defer swarmKey.Close()
-		key, _ := pnet.DecodeV1PSK(swarmKey)
-		maybePrivateNet = libp2p.PrivateNetwork(key)
+	if cfg.Settings.SwarmKey != nil {
+		fmt.Println("[+] Using a swarm key, only joining the private network")
+		maybePrivateNet = libp2p.PrivateNetwork(cfg.Settings.SwarmKey)
 	}
 
 	peerChan := make(chan peer.AddrInfo)
@@ -175,83 +221,73 @@ func CreateNode(ctx context.Context, privateKey crypto.PrivKey, listenAddreses [
 			autorelay.WithBootDelay(10*time.Second),
 		),
 		libp2p.WithDialTimeout(time.Second*5),
+		libp2p.WithFxOption(fx.Populate(&quicConns)),
 		libp2p.FallbackDefaults,
 	)
 	if err != nil {
 		return
 	}
 
-	// Define Bootstrap Nodes.
-	peers := []string{
-		"/ip4/152.67.75.145/tcp/110/p2p/12D3KooWQWsHPUUeFhe4b6pyCaD1hBoj8j6Z7S7kTznRTh1p1eVt",
-		"/ip4/152.67.75.145/udp/110/quic-v1/p2p/12D3KooWQWsHPUUeFhe4b6pyCaD1hBoj8j6Z7S7kTznRTh1p1eVt",
-		"/ip4/152.67.75.145/tcp/995/p2p/QmbrAHuh4RYcyN9fWePCZMVmQjbaNXtyvrDCWz4VrchbXh",
-		"/ip4/152.67.75.145/udp/995/quic-v1/p2p/QmbrAHuh4RYcyN9fWePCZMVmQjbaNXtyvrDCWz4VrchbXh",
-		"/ip4/95.216.8.12/tcp/110/p2p/Qmd7QHZU8UjfYdwmjmq1SBh9pvER9AwHpfwQvnvNo3HBBo",
-		"/ip4/95.216.8.12/udp/110/quic-v1/p2p/Qmd7QHZU8UjfYdwmjmq1SBh9pvER9AwHpfwQvnvNo3HBBo",
-		"/ip4/95.216.8.12/tcp/995/p2p/QmYs4xNBby2fTs8RnzfXEk161KD4mftBfCiR8yXtgGPj4J",
-		"/ip4/95.216.8.12/udp/995/quic-v1/p2p/QmYs4xNBby2fTs8RnzfXEk161KD4mftBfCiR8yXtgGPj4J",
-		"/ip4/152.67.73.164/tcp/995/p2p/12D3KooWL84sAtq1QTYwb7gVbhSNX5ZUfVt4kgYKz8pdif1zpGUh",
-		"/ip4/152.67.73.164/udp/995/quic-v1/p2p/12D3KooWL84sAtq1QTYwb7gVbhSNX5ZUfVt4kgYKz8pdif1zpGUh",
-		"/ip4/37.27.11.202/udp/21/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
-		"/ip4/37.27.11.202/udp/443/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
-		"/ip4/37.27.11.202/udp/500/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
-		"/ip4/37.27.11.202/udp/995/quic-v1/p2p/12D3KooWN31twBvdEcxz2jTv4tBfPe3mkNueBwDJFCN4xn7ZwFbi",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/12D3KooWEZXjE41uU4EL2gpkAQeDXYok6wghN7wwNVPF5bwkaNfS",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmZa1sAxajnQjVM8WjWXoMbmPd7NsWhfKsPkErzpm9wGkp",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb",
-		"/dnsaddr/bootstrap.libp2p.io/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt",
-	}
-
 	// Convert Bootstap Nodes into usable addresses.
-	staticBootstrapPeers, err := parsePeerAddrs(peers)
+	staticBootstrapPeers, err := peer.AddrInfosFromP2pAddrs(bootstrapAddrs(cfg)...)
 	if err != nil {
 		return node, nil, err
 	}
 
-	ipfsApiStr, ok := os.LookupEnv("MYNETWORK_IPFS_API")
-	if ok {
-		ipfsApiAddr, err := ma.NewMultiaddr(ipfsApiStr)
+	// What the last run learned gets us going before any lookup finishes.
+	state := loadState(cfg)
+	savedRelays, seeds := state.restore(basicHost, cfg)
+	staticBootstrapPeers = append(seeds, staticBootstrapPeers...)
+
+	// The IPFS node knows public peers only, which private nodes stay away from.
+	ipfsApiAddr := cfg.Settings.IPFSAPI
+	if cfg.Private {
+		fmt.Println("[+] Private mode, staying off the public DHT and HTTP routing")
+		ipfsApiAddr = nil
+	}
+	if ipfsApiAddr != nil {
+		fmt.Println("[+] Getting additional peers from IPFS API")
+		extraPeers, err := parsePeerAddrs(getExtraPeers(ipfsApiAddr))
 		if err == nil {
-			fmt.Println("[+] Getting additional peers from IPFS API")
-			extraPeers, err := parsePeerAddrs(getExtraPeers(ipfsApiAddr))
-			if err == nil {
-				fmt.Printf("[+] %d additional addresses\n", len(extraPeers))
-				for _, p := range extraPeers {
-					basicHost.Peerstore().AddAddrs(p.ID, p.Addrs, 5*time.Minute)
-				}
+			fmt.Printf("[+] %d additional addresses\n", len(extraPeers))
+			for _, p := range extraPeers {
+				basicHost.Peerstore().AddAddrs(p.ID, p.Addrs, 5*time.Minute)
 			}
 		}
 	}
 
+	// Private nodes keep a DHT of their own, which all of them serve.
+	dhtOpts := []dht.Option{dht.Mode(dht.ModeClient)}
+	if cfg.Private {
+		dhtOpts = []dht.Option{dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/mynetwork")}
+	}
+
 	// Create DHT Subsystem
 	dhtOut, err = dht.New(
 		ctx,
 		basicHost,
-		dht.Mode(dht.ModeClient),
-		dht.BootstrapPeers(staticBootstrapPeers...),
-		dht.BootstrapPeersFunc(func() []peer.AddrInfo {
-			extraBootstrapNodes := []string{}
-			ipfsApiStr, ok := os.LookupEnv("MYNETWORK_IPFS_API")
-			if ok {
-				ipfsApiAddr, err := ma.NewMultiaddr(ipfsApiStr)
-				if err == nil {
+		append(dhtOpts,
+			dht.BootstrapPeers(staticBootstrapPeers...),
+			dht.BootstrapPeersFunc(func() []peer.AddrInfo {
+				extraBootstrapNodes := []string{}
+				if ipfsApiAddr != nil {
 					fmt.Println("[+] Getting additional bootstrap nodes from IPFS API")
 					extraBootstrapNodes = getExtraBootstrapNodes(ipfsApiAddr)
 					fmt.Printf("[+] %d additional bootstrap nodes\n", len(extraBootstrapNodes))
 				}
-			}
-			dynamicBootstrapPeers, err := parsePeerAddrs(extraBootstrapNodes)
-			if err != nil {
-				return staticBootstrapPeers
-			} else {
-				return append(staticBootstrapPeers, dynamicBootstrapPeers...)
-			}
-		}),
+				dynamicBootstrapPeers, err := parsePeerAddrs(extraBootstrapNodes)
+				if err != nil {
+					return staticBootstrapPeers
+				} else {
+					return append(staticBootstrapPeers, dynamicBootstrapPeers...)
+				}
+			}),
+		)...,
 	)
 
+	pexr := PeXRouting{basicHost, cfg}
+	routings := []routedhost.Routing{pexr, dhtOut}
+
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.MaxIdleConns = 500
 	transport.MaxIdleConnsPerHost = 100
@@ -261,37 +297,42 @@ func CreateNode(ctx context.Context, privateKey crypto.PrivKey, listenAddreses [
 			LimitBytes:   1 << 20,
 		},
 	}
-	dr, err := drclient.New(
-		"https://p2p.privatevoid.net",
-		drclient.WithHTTPClient(delegateHTTPClient),
-		drclient.WithIdentity(privateKey),
-		drclient.WithUserAgent("hyprspace"),
-	)
-	if err != nil {
-		return node, nil, err
-	}
-
-	cr := contentrouter.NewContentRoutingClient(dr)
+	for _, endpoint := range delegatedRouting(cfg) {
+		dr, err := drclient.New(
+			endpoint,
+			drclient.WithHTTPClient(delegateHTTPClient),
+			drclient.WithIdentity(privateKey),
+			drclient.WithUserAgent("hyprspace"),
+		)
+		if err != nil {
+			return node, nil, err
+		}
 
-	pexr := PeXRouting{basicHost, vpnPeers}
+		cr := contentrouter.NewContentRoutingClient(dr)
+		routings = append(routings, httpRoutingWrapper{
+			ContentRouting: cr,
+			PeerRouting:    cr,
+			ValueStore:     cr,
+		})
+	}
 
-	pr := ParallelRouting{[]routedhost.Routing{pexr, dhtOut, httpRoutingWrapper{
-		ContentRouting: cr,
-		PeerRouting:    cr,
-		ValueStore:     cr,
-	}}}
+	pr := ParallelRouting{routings}
 
 	node = routedhost.Wrap(basicHost, pr)
 
 	// Setup Hyprspace Stream Handler
 	node.SetStreamHandler(Protocol, handler)
+	node.SetStreamHandler(BatchProtocol, handler)
 
 	if err != nil {
 		return node, nil, err
 	}
 
-	// Continuously feed peers into the AutoRelay service
+	// Continuously feed peers into the AutoRelay service, starting with the relays used last time
 	go func() {
+		for _, r := range savedRelays {
+			peerChan <- r
+		}
 		delay := backoff.NewExponentialDecorrelatedJitter(time.Second, time.Second*60, 5.0, rand.NewSource(time.Now().UnixMilli()))()
 		for {
 			for _, p := range node.Network().Peers() {
@@ -313,6 +354,13 @@ func CreateNode(ctx context.Context, privateKey crypto.PrivKey, listenAddreses [
 		}
 	}()
 
+	go state.run(ctx, node, dhtOut, cfg)
+
+	// Without public infrastructure, peers on the same network can still find each other directly.
+	if cfg.Private {
+		startMdns(ctx, node, cfg)
+	}
+
 	return node, dhtOut, nil
 }
 
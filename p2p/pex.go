@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,8 +21,8 @@ import (
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 type PeXRouting struct {
-	host     host.Host
-	vpnPeers []config.Peer
+	host host.Host
+	cfg  *config.Config
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -42,8 +43,11 @@ func NewPeXStreamHandler(host host.Host, cfg *config.Config) func(network.Stream
 	return func(stream network.Stream) {
 		found := false
 		// 检查当前所有的 peers（包括动态添加的）
-		for _, p := range cfg.Peers {
-			if p.ID == stream.Conn().RemotePeer() {
+		cfg.RLock()
+		peers := slices.Clone(cfg.Peers)
+		cfg.RUnlock()
+		for _, p := range peers {
+			if p.Is(stream.Conn().RemotePeer()) {
 				found = true
 				break
 			}
@@ -61,8 +65,8 @@ func NewPeXStreamHandler(host host.Host, cfg *config.Config) func(network.Stream
 		if str == "r" {
 			// peer requests addresses
 			// 返回当前所有 peers 的地址（包括动态添加的）
-			for _, p := range cfg.Peers {
-				if p.ID != stream.Conn().RemotePeer() {
+			for _, p := range peers {
+				if !p.Is(stream.Conn().RemotePeer()) {
 					for _, a := range host.Peerstore().Addrs(p.ID) {
 						_, err := stream.Write([]byte(fmt.Sprintf("%s|%s\n", p.ID, a)))
 						if checkErrPeX(err, stream) {
@@ -132,7 +136,10 @@ func PeXService(ctx context.Context, host host.Host, cfg *config.Config) {
 		case ev := <-subCon.Out():
 			evt := ev.(event.EvtPeerConnectednessChanged)
 			// 检查当前所有的 peers（包括动态添加的）
-			for _, vpnPeer := range cfg.Peers {
+			cfg.RLock()
+			current := slices.Clone(cfg.Peers)
+			cfg.RUnlock()
+			for _, vpnPeer := range current {
 				if vpnPeer.ID == evt.Peer {
 					if evt.Connectedness == network.Connected {
 						go func() {
@@ -147,7 +154,7 @@ func PeXService(ctx context.Context, host host.Host, cfg *config.Config) {
 					} else if evt.Connectedness == network.NotConnected {
 						// 获取当前所有 peers 的 ID（包括动态添加的）
 						peers := []peer.ID{}
-						for _, p := range cfg.Peers {
+						for _, p := range current {
 							peers = append(peers, p.ID)
 						}
 						go func() {
@@ -174,10 +181,15 @@ func (pexr PeXRouting) FindPeer(ctx context.Context, targetPeer peer.ID) (peer.A
 	addrInfo := peer.AddrInfo{
 		ID: targetPeer,
 	}
-	for _, p := range pexr.vpnPeers {
+	pexr.cfg.RLock()
+	current := slices.Clone(pexr.cfg.Peers)
+	pexr.cfg.RUnlock()
+	for _, p := range current {
 		peers = append(peers, p.ID)
 		if p.ID == targetPeer {
 			found = true
+			// Static addresses come first and don't depend on other peers.
+			addrInfo.Addrs = append(addrInfo.Addrs, p.Addrs...)
 		}
 	}
 	// PeX routing only returns VPN node addresses
@@ -186,6 +198,9 @@ func (pexr PeXRouting) FindPeer(ctx context.Context, targetPeer peer.ID) (peer.A
 	}
 	addrInfos, err := RequestPeX(ctx, pexr.host, peers)
 	if err != nil {
+		if len(addrInfo.Addrs) > 0 {
+			return addrInfo, nil
+		}
 		return addrInfo, err
 	}
 	for _, ai := range addrInfos {
@@ -8,26 +8,33 @@ import (
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ClosedCircuitRelayFilter only relays for VPN peers permitted by the relay policy, including those added at runtime.
 type ClosedCircuitRelayFilter struct {
-	allowedPeers []config.Peer
+	cfg *config.Config
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (ccr ClosedCircuitRelayFilter) AllowReserve(p peer.ID, a multiaddr.Multiaddr) bool {
-	_, found := config.FindPeer(ccr.allowedPeers, p)
-	return found
+	return ccr.allowed(p)
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (ccr ClosedCircuitRelayFilter) AllowConnect(src peer.ID, srcAddr multiaddr.Multiaddr, dest peer.ID) bool {
-	_, foundSrc := config.FindPeer(ccr.allowedPeers, src)
-	_, foundDst := config.FindPeer(ccr.allowedPeers, dest)
-	return foundSrc || foundDst
+	return ccr.allowed(src) || ccr.allowed(dest)
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func NewClosedCircuitRelayFilter(allowedPeers []config.Peer) relay.ACLFilter {
+// allowed reports whether a node is a peer permitted by the relay policy.
+func (ccr ClosedCircuitRelayFilter) allowed(id peer.ID) bool {
+	ccr.cfg.RLock()
+	defer ccr.cfg.RUnlock()
+	p, found := config.FindPeer(ccr.cfg.Peers, id)
+	return found && ccr.cfg.MayRelay(*p)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func NewClosedCircuitRelayFilter(cfg *config.Config) relay.ACLFilter {
 	return ClosedCircuitRelayFilter{
-		allowedPeers: allowedPeers,
+		cfg: cfg,
 	}
 }
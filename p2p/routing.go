@@ -72,9 +72,16 @@ func NewRecursionGater(config *config.Config) RecursionGater {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (rg RecursionGater) InterceptAddrDial(pid peer.ID, addr ma.Multiaddr) bool {
+	// While an exit node is in use, libp2p connections must not be caught by its routes.
+	if ip := addrIP(addr); ip != nil && activeExitClient != nil {
+		activeExitClient.Bypass(pid, ip)
+	}
 	if ip4str, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
 		ip4 := net.ParseIP(ip4str)
-		if rte, ok := rg.config.FindRouteForIP(ip4); ok {
+		rg.config.RLock()
+		rte, ok := rg.config.FindRouteForIP(ip4)
+		rg.config.RUnlock()
+		if ok {
 			if rte.Target.ID == pid {
 				routes, err := netlink.RouteGet(ip4)
 				if err == nil {
@@ -95,6 +102,9 @@ func (rg RecursionGater) InterceptPeerDial(pid peer.ID) bool {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (rg RecursionGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	if ip := addrIP(addrs.RemoteMultiaddr()); ip != nil && activeExitClient != nil {
+		activeExitClient.BypassAccepted(ip)
+	}
 	return true
 }
 
@@ -71,7 +71,10 @@ func NewRecursionGater(config *config.Config) RecursionGater {
 func (rg RecursionGater) InterceptAddrDial(pid peer.ID, addr ma.Multiaddr) bool {
 	if ip4str, err := addr.ValueForProtocol(ma.P_IP4); err == nil {
 		ip4 := net.ParseIP(ip4str)
-		if rte, ok := rg.config.FindRouteForIP(ip4); ok {
+		rg.config.RLock()
+		rte, ok := rg.config.FindRouteForIP(ip4)
+		rg.config.RUnlock()
+		if ok {
 			if rte.Target.ID == pid {
 				return false
 			}
@@ -0,0 +1,246 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/soitun/mynetwork/config"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	// stateFile is the file in the state directory that holds the saved state.
+	stateFile = "peerstore.json"
+	// stateMaxAge is how long an address of a peer is kept without connecting to the peer there again.
+	stateMaxAge = 7 * 24 * time.Hour
+	// stateMaxAddrs bounds the number of addresses kept per peer, the most recently used ones win.
+	stateMaxAddrs = 8
+	// stateSeeds is the number of peers from the DHT routing table kept to bootstrap from.
+	stateSeeds = 16
+	// stateSaveInterval is how often the state is refreshed and written to disk if it changed.
+	stateSaveInterval = time.Minute
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// nodeState is what the node remembers about the network across restarts, so that it reconnects without waiting for
+// the DHT, delegated routing or PeX.
+type nodeState struct {
+	// Private is the mode the relays and seeds were found in. They are not used in the other one.
+	Private bool `json:"private"`
+	// Peers are the addresses VPN peers were last connected at, by peer ID.
+	Peers map[string][]savedAddr `json:"peers"`
+	// Relays are the relays this node held reservations with, as /p2p addresses.
+	Relays []string `json:"relays,omitempty"`
+	// Seeds are peers from the DHT routing table, as /p2p addresses.
+	Seeds []string `json:"seeds,omitempty"`
+
+	path   string
+	dirty  bool
+	failed bool
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type savedAddr struct {
+	Addr string    `json:"addr"`
+	Seen time.Time `json:"seen"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// loadState reads the state saved by the last run of the daemon. Without a usable state file the state starts empty.
+func loadState(cfg *config.Config) *nodeState {
+	s := &nodeState{
+		Private: cfg.Private,
+		Peers:   make(map[string][]savedAddr),
+		path:    filepath.Join(cfg.StateDir(), stateFile),
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return s
+	}
+	var saved nodeState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fmt.Printf("[!] Ignoring state file %s: %v\n", s.path, err)
+		return s
+	}
+	if saved.Peers != nil {
+		s.Peers = saved.Peers
+	}
+	if saved.Private == cfg.Private {
+		s.Relays, s.Seeds = saved.Relays, saved.Seeds
+	}
+	return s
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// restore puts the saved addresses of VPN peers into the peerstore and returns the saved relays and DHT seeds.
+func (s *nodeState) restore(h host.Host, cfg *config.Config) (relays, seeds []peer.AddrInfo) {
+	count := 0
+	for idStr, addrs := range s.Peers {
+		id, err := peer.Decode(idStr)
+		if err != nil {
+			continue
+		}
+		cfg.RLock()
+		_, found := config.FindPeer(cfg.Peers, id)
+		cfg.RUnlock()
+		if !found {
+			continue
+		}
+		for _, a := range addrs {
+			addr, err := ma.NewMultiaddr(a.Addr)
+			if err != nil || time.Since(a.Seen) > stateMaxAge {
+				continue
+			}
+			h.Peerstore().AddAddr(id, addr, peerstore.RecentlyConnectedAddrTTL)
+			count++
+		}
+	}
+	// A single broken entry costs the whole list, which the next save replaces anyway.
+	relays, _ = parsePeerAddrs(s.Relays)
+	seeds, _ = parsePeerAddrs(s.Seeds)
+	if count > 0 || len(relays) > 0 || len(seeds) > 0 {
+		fmt.Printf("[+] Restored %d peer addresses, %d relays and %d DHT seeds from %s\n", count, len(relays), len(seeds), s.path)
+	}
+	return relays, seeds
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// run keeps the state up to date while the node runs. Addresses of VPN peers are recorded as they connect, relays
+// and DHT seeds are refreshed periodically.
+func (s *nodeState) run(ctx context.Context, h host.Host, d *dht.IpfsDHT, cfg *config.Config) {
+	subCon, err := h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer subCon.Close()
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.save()
+			return
+		case ev := <-subCon.Out():
+			evt := ev.(event.EvtPeerConnectednessChanged)
+			cfg.RLock()
+			_, found := config.FindPeer(cfg.Peers, evt.Peer)
+			cfg.RUnlock()
+			if found && evt.Connectedness == network.Connected {
+				s.remember(h, evt.Peer)
+			}
+		case <-ticker.C:
+			s.refresh(h, d)
+			s.save()
+		}
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// remember records the addresses of the current connections to a VPN peer. Only addresses this node dialled directly
+// are worth dialling again, inbound connections come from ephemeral ports and relayed ones depend on the relay's
+// reservation.
+func (s *nodeState) remember(h host.Host, p peer.ID) {
+	now := time.Now()
+	addrs := s.Peers[p.String()]
+	for _, c := range h.Network().ConnsToPeer(p) {
+		if c.Stat().Direction != network.DirOutbound {
+			continue
+		}
+		if _, err := c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		addr := c.RemoteMultiaddr().String()
+		i := slices.IndexFunc(addrs, func(a savedAddr) bool { return a.Addr == addr })
+		if i < 0 {
+			addrs = append(addrs, savedAddr{Addr: addr})
+			i = len(addrs) - 1
+		}
+		addrs[i].Seen = now
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	s.Peers[p.String()] = addrs
+	s.dirty = true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// refresh takes the current relays and DHT seeds. While there are none, the saved ones are kept.
+func (s *nodeState) refresh(h host.Host, d *dht.IpfsDHT) {
+	var relays []string
+	for _, addr := range h.Addrs() {
+		relay, circuit := ma.SplitFunc(addr, func(c ma.Component) bool { return c.Code() == ma.P_CIRCUIT })
+		if len(circuit) > 0 && !slices.Contains(relays, relay.String()) {
+			relays = append(relays, relay.String())
+		}
+	}
+	var seeds []string
+	for _, p := range d.RoutingTable().ListPeers() {
+		addrs, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: p, Addrs: h.Peerstore().Addrs(p)})
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		seeds = append(seeds, addrs[0].String())
+		if len(seeds) == stateSeeds {
+			break
+		}
+	}
+	slices.Sort(relays)
+	slices.Sort(seeds)
+	if len(relays) > 0 && !slices.Equal(relays, s.Relays) {
+		s.Relays, s.dirty = relays, true
+	}
+	if len(seeds) > 0 && !slices.Equal(seeds, s.Seeds) {
+		s.Seeds, s.dirty = seeds, true
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// save writes the state to disk if it changed, after dropping addresses that are too old or too many.
+func (s *nodeState) save() {
+	if !s.dirty {
+		return
+	}
+	for id, addrs := range s.Peers {
+		addrs = slices.DeleteFunc(addrs, func(a savedAddr) bool { return time.Since(a.Seen) > stateMaxAge })
+		slices.SortFunc(addrs, func(a, b savedAddr) int { return b.Seen.Compare(a.Seen) })
+		if len(addrs) == 0 {
+			delete(s.Peers, id)
+		} else {
+			s.Peers[id] = addrs[:min(len(addrs), stateMaxAddrs)]
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	}
+	// Writing to a temporary file first never leaves a truncated state file behind.
+	if err == nil {
+		err = os.WriteFile(s.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		if !s.failed {
+			fmt.Printf("[!] Unable to save state to %s: %v\n", s.path, err)
+		}
+		s.failed = true
+		return
+	}
+	s.dirty, s.failed = false, false
+}
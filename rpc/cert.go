@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AdmitMember adds the holder of a valid certificate as a peer of the running daemon, or updates the name and tags of
+// a member presenting a newer certificate. It reports whether the member is new.
+func AdmitMember(host host.Host, cfg *config.Config, tunDev *tun.TUN, c *config.Certificate) (bool, error) {
+	cfg.Lock()
+	defer cfg.Unlock()
+
+	_, existed := config.FindPeer(cfg.Peers, c.ID)
+	p, changed, err := cfg.AddMember(c)
+	if err != nil || !changed || existed {
+		return false, err
+	}
+	hsr := HyprspaceRPC{host, cfg, tunDev}
+	hsr.activatePeer(p)
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// UpdateRevocations applies a newer revocation list of the network CA, drops the members it revokes and keeps it in
+// the state directory, so it survives a restart. It reports whether the list has been applied.
+func UpdateRevocations(host host.Host, cfg *config.Config, tunDev *tun.TUN, l *config.RevocationList) (bool, error) {
+	cfg.Lock()
+	defer cfg.Unlock()
+
+	changed, err := cfg.SetRevocations(l)
+	if err != nil || !changed {
+		return false, err
+	}
+	hsr := HyprspaceRPC{host, cfg, tunDev}
+	hsr.dropStaleMembers()
+	if err := cfg.SaveRevocations(); err != nil {
+		fmt.Printf("[!] Warning: Failed to save the revocation list: %v\n", err)
+	}
+	return true, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// DropMember removes a member whose certificate is no longer valid from the running daemon.
+func DropMember(host host.Host, cfg *config.Config, tunDev *tun.TUN, id peer.ID) error {
+	cfg.Lock()
+	defer cfg.Unlock()
+
+	p, found := config.FindPeer(cfg.Peers, id)
+	if !found || p.Certificate == nil || cfg.CheckCertificate(p.Certificate) == nil {
+		return nil
+	}
+	hsr := HyprspaceRPC{host, cfg, tunDev}
+	return hsr.removePeerLive(id)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// dropStaleMembers removes every member whose certificate expired or has been revoked.
+func (hsr *HyprspaceRPC) dropStaleMembers() []config.Peer {
+	var dropped []config.Peer
+	for _, p := range hsr.config.StaleMembers() {
+		if err := hsr.removePeerLive(p.ID); err != nil {
+			fmt.Printf("[!] Failed to drop %s (/p2p/%s): %v\n", p.Name, p.ID, err)
+			continue
+		}
+		dropped = append(dropped, p)
+	}
+	return dropped
+}
@@ -101,3 +101,104 @@ func AddPeer(ifname string, args AddPeerArgs) AddPeerReply {
 	}
 	return reply
 }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func RemovePeer(ifname string, args RemovePeerArgs) RemovePeerReply {
+	client := getClient(ifname)
+	var reply RemovePeerReply
+	if err := client.Call("HyprspaceRPC.RemovePeer", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func RenamePeer(ifname string, args RenamePeerArgs) RenamePeerReply {
+	client := getClient(ifname)
+	var reply RenamePeerReply
+	if err := client.Call("HyprspaceRPC.RenamePeer", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func Tag(ifname string, args TagArgs) TagReply {
+	client := getClient(ifname)
+	var reply TagReply
+	if err := client.Call("HyprspaceRPC.Tag", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func Exit(ifname string, args ExitArgs) ExitReply {
+	client := getClient(ifname)
+	var reply ExitReply
+	if err := client.Call("HyprspaceRPC.Exit", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func Reload(ifname string) ReloadReply {
+	client := getClient(ifname)
+	var reply ReloadReply
+	if err := client.Call("HyprspaceRPC.Reload", new(Args), &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Running reports whether a daemon is serving RPC requests for the interface.
+func Running(ifname string) bool {
+	var client *rpc.Client
+	var err error
+	if runtime.GOOS == "windows" {
+		data, readErr := os.ReadFile(filepath.Join(os.TempDir(), fmt.Sprintf("mynetwork-rpc.%s.port", ifname)))
+		if readErr != nil {
+			return false
+		}
+		client, err = rpc.Dial("tcp", "127.0.0.1:"+strings.TrimSpace(string(data)))
+	} else {
+		client, err = rpc.Dial("unix", fmt.Sprintf("/run/mynetwork-rpc.%s.sock", ifname))
+	}
+	if err != nil {
+		return false
+	}
+	client.Close()
+	return true
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func RotateKey(ifname string, args RotateKeyArgs) RotateKeyReply {
+	client := getClient(ifname)
+	var reply RotateKeyReply
+	if err := client.Call("HyprspaceRPC.RotateKey", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func Invite(ifname string, args InviteArgs) InviteReply {
+	client := getClient(ifname)
+	var reply InviteReply
+	if err := client.Call("HyprspaceRPC.Invite", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func Join(ifname string, args JoinArgs) JoinReply {
+	client := getClient(ifname)
+	var reply JoinReply
+	if err := client.Call("HyprspaceRPC.Join", args, &reply); err != nil {
+		log.Fatal("[!] RPC call failed: ", err)
+	}
+	return reply
+}
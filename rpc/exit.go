@@ -0,0 +1,55 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ExitClient is the exit client of the running daemon.
+var ExitClient *p2p.ExitClient
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) Exit(args *ExitArgs, reply *ExitReply) error {
+	if ExitClient == nil {
+		*reply = ExitReply{Success: false, Message: "Exit nodes are not available"}
+		return nil
+	}
+
+	switch args.Action {
+	case ExitShow:
+		if p, ok := ExitClient.Current(); ok {
+			*reply = ExitReply{Success: true, Message: fmt.Sprintf("Using @%s (%s) as exit node", p.Name, p.ID)}
+		} else {
+			*reply = ExitReply{Success: true, Message: "No exit node in use"}
+		}
+	case ExitUse:
+		hsr.config.RLock()
+		target, err := config.FindPeerByCLIRef(hsr.config.Peers, args.Peer)
+		hsr.config.RUnlock()
+		if err != nil {
+			*reply = ExitReply{Success: false, Message: fmt.Sprintf("Failed to use exit node: %v", err)}
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := ExitClient.Use(ctx, target.ID); err != nil {
+			*reply = ExitReply{Success: false, Message: fmt.Sprintf("Failed to use exit node: %v", err)}
+			return nil
+		}
+		*reply = ExitReply{Success: true, Message: fmt.Sprintf("Using @%s (%s) as exit node", target.Name, target.ID)}
+	case ExitOff:
+		if err := ExitClient.Off(); err != nil {
+			*reply = ExitReply{Success: false, Message: err.Error()}
+			return nil
+		}
+		*reply = ExitReply{Success: true, Message: "Exit node turned off"}
+	default:
+		*reply = ExitReply{Success: false, Message: fmt.Sprintf("Unknown action %q", args.Action)}
+	}
+	return nil
+}
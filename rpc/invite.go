@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Invites holds the invites issued by the running daemon.
+var Invites *p2p.Invites
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// AcceptInvite adds a node that joined with an invite as a peer, the same way the addpeer command does, and writes it
+// to the config file.
+func AcceptInvite(host host.Host, cfg *config.Config, tunDev *tun.TUN, name string, id peer.ID) (config.Peer, error) {
+	hsr := HyprspaceRPC{host, cfg, tunDev}
+	var reply AddPeerReply
+	if err := hsr.AddPeer(&AddPeerArgs{Name: name, ID: id.String(), Persist: true}, &reply); err != nil {
+		return config.Peer{}, err
+	}
+	if !reply.Success {
+		return config.Peer{}, errors.New(reply.Message)
+	}
+	cfg.RLock()
+	defer cfg.RUnlock()
+	// The peer may have been removed again before the lock was taken.
+	p, found := config.FindPeer(cfg.Peers, id)
+	if !found {
+		return config.Peer{}, errors.New("peer was removed while being added")
+	}
+	return *p, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) Invite(args *InviteArgs, reply *InviteReply) error {
+	if Invites == nil {
+		*reply = InviteReply{Success: false, Message: "Invites are not available"}
+		return nil
+	}
+	hsr.config.RLock()
+	_, found := config.FindPeerByName(hsr.config.Peers, args.Name)
+	hsr.config.RUnlock()
+	if args.Name != "" && found {
+		*reply = InviteReply{Success: false, Message: fmt.Sprintf("A peer named %s already exists", args.Name)}
+		return nil
+	}
+	ttl := args.Expires
+	if ttl <= 0 {
+		ttl = config.DefaultInviteExpiry
+	}
+	hostname, _ := os.Hostname()
+	inv, token, err := Invites.Create(hostname, args.Name, ttl)
+	if err != nil {
+		*reply = InviteReply{Success: false, Message: fmt.Sprintf("Failed to create invite: %v", err)}
+		return nil
+	}
+	*reply = InviteReply{Success: true, Message: "Invite created", Token: token, Expires: inv.Expires}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) Join(args *JoinArgs, reply *JoinReply) error {
+	inv, err := config.ParseInvite(args.Token)
+	if err != nil {
+		*reply = JoinReply{Success: false, Message: err.Error()}
+		return nil
+	}
+	hsr.config.RLock()
+	name, err := hsr.config.CheckInvite(inv)
+	hsr.config.RUnlock()
+	if err != nil {
+		*reply = JoinReply{Success: false, Message: err.Error()}
+		return nil
+	}
+	res, err := p2p.Join(context.Background(), hsr.host, inv, args.Name)
+	if err != nil {
+		*reply = JoinReply{Success: false, Message: fmt.Sprintf("Failed to join: %v", err)}
+		return nil
+	}
+
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+	addr4, addr6, changed := p2p.ApplyJoin(hsr.config, inv, res)
+	var added AddPeerReply
+	if err := hsr.addPeer(&AddPeerArgs{Name: name, ID: inv.Inviter.String(), Persist: true, Addr4: addr4, Addr6: addr6}, &added); err != nil || !added.Success {
+		*reply = JoinReply{Success: false, Message: fmt.Sprintf("Joined as %s, but the inviter could not be added: %s", res.Name, added.Message)}
+		return nil
+	}
+
+	message := fmt.Sprintf("Joined the network of %s (/p2p/%s) as %s", name, inv.Inviter, res.Name)
+	if changed {
+		if err := hsr.config.PersistIdentity(); err != nil {
+			*reply = JoinReply{Success: false, Message: fmt.Sprintf("%s, but the addresses %s and %s could not be saved: %v", message, res.Addr4, res.Addr6, err)}
+			return nil
+		}
+		message += fmt.Sprintf(", restart the daemon to use the addresses %s and %s", res.Addr4, res.Addr6)
+	}
+	*reply = JoinReply{Success: true, Message: message}
+	return nil
+}
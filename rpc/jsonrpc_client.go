@@ -155,6 +155,84 @@ func (c *JSONRPCClient) AddPeer(name, id string) (*AddPeerReply, error) {
 	return &result, nil
 }
 
+// 删除对等节点
+func (c *JSONRPCClient) RemovePeer(ref string, persist bool) (*RemovePeerReply, error) {
+	params := map[string]interface{}{
+		"peer":    ref,
+		"persist": persist,
+	}
+
+	resp, err := c.call("removePeer", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result RemovePeerReply
+	resultBytes, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %v", err)
+	}
+
+	return &result, nil
+}
+
+// 重命名对等节点
+func (c *JSONRPCClient) RenamePeer(ref, name string, persist bool) (*RenamePeerReply, error) {
+	params := map[string]interface{}{
+		"peer":    ref,
+		"name":    name,
+		"persist": persist,
+	}
+
+	resp, err := c.call("renamePeer", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result RenamePeerReply
+	resultBytes, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %v", err)
+	}
+
+	return &result, nil
+}
+
+// 添加或删除对等节点的标签
+func (c *JSONRPCClient) TagPeer(ref string, add, remove []string, persist bool) (*TagReply, error) {
+	params := map[string]interface{}{
+		"peer":    ref,
+		"add":     add,
+		"remove":  remove,
+		"persist": persist,
+	}
+
+	resp, err := c.call("tagPeer", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result TagReply
+	resultBytes, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %v", err)
+	}
+
+	return &result, nil
+}
+
 // 获取当前节点的 IP 地址
 func (c *JSONRPCClient) NodeIp() (*NodeIpReply, error) {
 	resp, err := c.call("nodeIp", nil)
@@ -175,6 +253,51 @@ func (c *JSONRPCClient) NodeIp() (*NodeIpReply, error) {
 	return &result, nil
 }
 
+// 切换出口节点
+func (c *JSONRPCClient) Exit(action ExitAction, ref string) (*ExitReply, error) {
+	params := map[string]interface{}{
+		"action": string(action),
+		"peer":   ref,
+	}
+
+	resp, err := c.call("exit", params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ExitReply
+	resultBytes, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %v", err)
+	}
+
+	return &result, nil
+}
+
+// 重新加载配置文件
+func (c *JSONRPCClient) Reload() (*ReloadReply, error) {
+	resp, err := c.call("reload", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ReloadReply
+	resultBytes, err := json.Marshal(resp.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result: %v", err)
+	}
+
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal result: %v", err)
+	}
+
+	return &result, nil
+}
+
 // 便捷方法：显示路由
 func (c *JSONRPCClient) ShowRoutes() (*RouteReply, error) {
 	return c.Route(Show, nil)
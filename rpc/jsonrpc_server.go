@@ -124,8 +124,18 @@ func (s *JSONRPCServer) handleMethod(method string, params interface{}) (interfa
 		return s.handleRoute(params)
 	case "addPeer":
 		return s.handleAddPeer(params)
+	case "removePeer":
+		return s.handleRemovePeer(params)
+	case "renamePeer":
+		return s.handleRenamePeer(params)
+	case "tagPeer":
+		return s.handleTagPeer(params)
 	case "nodeIp":
 		return s.handleNodeIp(params)
+	case "reload":
+		return s.handleReload(params)
+	case "exit":
+		return s.handleExit(params)
 	default:
 		return nil, &JSONRPCError{
 			Code:    MethodNotFound,
@@ -201,6 +211,11 @@ func (s *JSONRPCServer) handleRoute(params interface{}) (interface{}, *JSONRPCEr
 		}
 	}
 
+	// 解析 persist
+	if persist, ok := paramsMap["persist"].(bool); ok {
+		args.Persist = persist
+	}
+
 	var reply RouteReply
 	err := s.rpcService.Route(&args, &reply)
 	if err != nil {
@@ -247,6 +262,11 @@ func (s *JSONRPCServer) handleAddPeer(params interface{}) (interface{}, *JSONRPC
 		}
 	}
 
+	// 解析 persist
+	if persist, ok := paramsMap["persist"].(bool); ok {
+		args.Persist = persist
+	}
+
 	var reply AddPeerReply
 	err := s.rpcService.AddPeer(&args, &reply)
 	if err != nil {
@@ -260,7 +280,194 @@ func (s *JSONRPCServer) handleAddPeer(params interface{}) (interface{}, *JSONRPC
 	return reply, nil
 }
 
-// 写入错误响应}
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// 处理 removePeer 方法
+func (s *JSONRPCServer) handleRemovePeer(params interface{}) (interface{}, *JSONRPCError) {
+	paramsMap, ok := params.(map[string]interface{})
+	if !ok {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Invalid params",
+		}
+	}
+
+	var args RemovePeerArgs
+
+	// 解析 peer（@名称或 ID 前缀）
+	if p, ok := paramsMap["peer"].(string); ok {
+		args.Peer = p
+	} else {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Missing or invalid 'peer' parameter",
+		}
+	}
+
+	// 解析 persist
+	if persist, ok := paramsMap["persist"].(bool); ok {
+		args.Persist = persist
+	}
+
+	var reply RemovePeerReply
+	err := s.rpcService.RemovePeer(&args, &reply)
+	if err != nil {
+		return nil, &JSONRPCError{
+			Code:    InternalError,
+			Message: "Internal error",
+			Data:    err.Error(),
+		}
+	}
+
+	return reply, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// 处理 renamePeer 方法
+func (s *JSONRPCServer) handleRenamePeer(params interface{}) (interface{}, *JSONRPCError) {
+	paramsMap, ok := params.(map[string]interface{})
+	if !ok {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Invalid params",
+		}
+	}
+
+	var args RenamePeerArgs
+
+	// 解析 peer（@名称或 ID 前缀）
+	if p, ok := paramsMap["peer"].(string); ok {
+		args.Peer = p
+	} else {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Missing or invalid 'peer' parameter",
+		}
+	}
+
+	// 解析 name
+	if name, ok := paramsMap["name"].(string); ok {
+		args.Name = name
+	} else {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Missing or invalid 'name' parameter",
+		}
+	}
+
+	// 解析 persist
+	if persist, ok := paramsMap["persist"].(bool); ok {
+		args.Persist = persist
+	}
+
+	var reply RenamePeerReply
+	err := s.rpcService.RenamePeer(&args, &reply)
+	if err != nil {
+		return nil, &JSONRPCError{
+			Code:    InternalError,
+			Message: "Internal error",
+			Data:    err.Error(),
+		}
+	}
+
+	return reply, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// 处理 tagPeer 方法
+func (s *JSONRPCServer) handleTagPeer(params interface{}) (interface{}, *JSONRPCError) {
+	paramsMap, ok := params.(map[string]interface{})
+	if !ok {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Invalid params",
+		}
+	}
+
+	var args TagArgs
+
+	// 解析 peer（@名称或 ID 前缀）
+	if p, ok := paramsMap["peer"].(string); ok {
+		args.Peer = p
+	} else {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Missing or invalid 'peer' parameter",
+		}
+	}
+
+	// 解析要添加和删除的标签
+	for key, tags := range map[string]*[]string{"add": &args.Add, "remove": &args.Remove} {
+		list, _ := paramsMap[key].([]interface{})
+		for _, item := range list {
+			tag, ok := item.(string)
+			if !ok {
+				return nil, &JSONRPCError{
+					Code:    InvalidParams,
+					Message: fmt.Sprintf("Invalid '%s' parameter", key),
+				}
+			}
+			*tags = append(*tags, tag)
+		}
+	}
+
+	// 解析 persist
+	if persist, ok := paramsMap["persist"].(bool); ok {
+		args.Persist = persist
+	}
+
+	var reply TagReply
+	err := s.rpcService.Tag(&args, &reply)
+	if err != nil {
+		return nil, &JSONRPCError{
+			Code:    InternalError,
+			Message: "Internal error",
+			Data:    err.Error(),
+		}
+	}
+
+	return reply, nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// 处理 exit 方法
+func (s *JSONRPCServer) handleExit(params interface{}) (interface{}, *JSONRPCError) {
+	paramsMap, ok := params.(map[string]interface{})
+	if !ok {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Invalid params",
+		}
+	}
+
+	var args ExitArgs
+
+	// 解析 action
+	if action, ok := paramsMap["action"].(string); ok {
+		args.Action = ExitAction(action)
+	} else {
+		return nil, &JSONRPCError{
+			Code:    InvalidParams,
+			Message: "Missing or invalid 'action' parameter",
+		}
+	}
+
+	// 解析 peer（@名称或 ID 前缀）
+	if p, ok := paramsMap["peer"].(string); ok {
+		args.Peer = p
+	}
+
+	var reply ExitReply
+	err := s.rpcService.Exit(&args, &reply)
+	if err != nil {
+		return nil, &JSONRPCError{
+			Code:    InternalError,
+			Message: "Internal error",
+			Data:    err.Error(),
+		}
+	}
+
+	return reply, nil
+}
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 // 处理 nodeIp 方法
@@ -279,6 +486,23 @@ func (s *JSONRPCServer) handleNodeIp(params interface{}) (interface{}, *JSONRPCE
 	return reply, nil
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// 处理 reload 方法
+func (s *JSONRPCServer) handleReload(params interface{}) (interface{}, *JSONRPCError) {
+	var args Args
+	var reply ReloadReply
+	err := s.rpcService.Reload(&args, &reply)
+	if err != nil {
+		return nil, &JSONRPCError{
+			Code:    InternalError,
+			Message: "Internal error",
+			Data:    err.Error(),
+		}
+	}
+
+	return reply, nil
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (s *JSONRPCServer) writeError(w http.ResponseWriter, code int, message string, data interface{}, id interface{}) {
 	response := JSONRPCResponse{
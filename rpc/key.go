@@ -0,0 +1,75 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+	"github.com/soitun/mynetwork/schema"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ApplyKeyTransition moves a peer that rotated its key over to its new peer ID and writes the change to the config
+// file.
+func ApplyKeyTransition(host host.Host, cfg *config.Config, tunDev *tun.TUN, t *config.KeyTransition) error {
+	cfg.Lock()
+	defer cfg.Unlock()
+
+	p, changed, err := cfg.ApplyKeyTransition(t)
+	if err != nil || !changed {
+		return err
+	}
+	if Services != nil {
+		r := Services.PeerRange(p.ID)
+		if err := tunDev.Apply(tun.Route(r)); err != nil {
+			fmt.Printf("[!] Warning: Failed to add route %s to TUN device: %v\n", &r, err)
+		}
+	}
+	host.ConnManager().Protect(p.ID, "/hyprspace/peer")
+	fmt.Printf("[+] @%s rotated its key, /p2p/%s is now /p2p/%s\n", p.Name, t.Old, t.New)
+
+	// Only the entry of the peer changes in the config file, other runtime changes stay out of it.
+	err = cfg.PersistPeer(t.Old, func(sp *schema.Peer) {
+		sp.Id, sp.Addr4, sp.Addr6, sp.KeyTransition = t.New.String(), t.Addr4.String(), t.Addr6.String(), t.String()
+	})
+	if err != nil {
+		fmt.Printf("[!] Warning: Key transition of @%s applied but config could not be saved: %v\n", p.Name, err)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) RotateKey(args *RotateKeyArgs, reply *RotateKeyReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+
+	grace := args.Grace
+	if grace <= 0 {
+		grace = config.DefaultKeyGrace
+	}
+	addr4, addr6 := hsr.config.Addr4, hsr.config.Addr6
+	t, err := hsr.config.RotateKey(grace)
+	if err != nil {
+		*reply = RotateKeyReply{Success: false, Message: fmt.Sprintf("Failed to rotate key: %v", err)}
+		return nil
+	}
+	if err := hsr.config.PersistIdentity(); err != nil {
+		// Without the new key on disk the rotation never happened.
+		hsr.config.NextKey, hsr.config.KeyTransition = nil, nil
+		hsr.config.Addr4, hsr.config.Addr6 = addr4, addr6
+		*reply = RotateKeyReply{Success: false, Message: fmt.Sprintf("Failed to save config: %v", err)}
+		return nil
+	}
+	p2p.AnnounceKeyTransition(context.Background(), hsr.host, hsr.config)
+
+	*reply = RotateKeyReply{
+		Success: true,
+		Message: fmt.Sprintf("Key rotated, restart the daemon to switch to /p2p/%s", t.New),
+		ID:      t.New.String(),
+		Expires: t.Expires,
+	}
+	return nil
+}
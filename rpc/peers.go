@@ -0,0 +1,225 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+	"github.com/soitun/mynetwork/schema"
+	"github.com/soitun/mynetwork/svc"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// OnPeerRemoved is called after a peer has been removed at runtime, so the daemon can drop its per-peer state.
+var OnPeerRemoved func(peer.ID)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Services is the service network of the running daemon. Runtime peer and service changes are applied to it once set.
+var Services *svc.ServiceNetwork
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Datagrams is the datagram transport of the running daemon, used to report how packets reach each peer.
+var Datagrams *p2p.DatagramPlane
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// transportMode names the data plane currently carrying packets to p.
+func transportMode(p peer.ID) string {
+	if Datagrams != nil && Datagrams.Active(p) {
+		return "datagram"
+	}
+	return "stream"
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addPeerLive adds a peer to the configuration and applies it to the TUN device and the connection manager.
+// addr4 and addr6 are the explicitly configured addresses of the peer, if any.
+func (hsr *HyprspaceRPC) addPeerLive(name string, peerID peer.ID, addr4, addr6 net.IP) error {
+	if err := hsr.config.AddPeerWithAddrs(name, peerID, addr4, addr6); err != nil {
+		return err
+	}
+	hsr.activatePeer(hsr.config.Peers[len(hsr.config.Peers)-1])
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// activatePeer routes the addresses of a peer that has just been added to the TUN device and keeps connections to it
+// open.
+func (hsr *HyprspaceRPC) activatePeer(p config.Peer) {
+	routes := []net.IPNet{
+		{IP: p.BuiltinAddr4, Mask: net.CIDRMask(32, 32)},
+		{IP: p.BuiltinAddr6, Mask: net.CIDRMask(128, 128)},
+	}
+	if Services != nil {
+		routes = append(routes, Services.PeerRange(p.ID))
+	}
+	for _, r := range routes {
+		if err := hsr.tunDev.Apply(tun.Route(r)); err != nil {
+			fmt.Printf("[!] Warning: Failed to add route %s to TUN device: %v\n", &r, err)
+		}
+	}
+
+	hsr.host.ConnManager().Protect(p.ID, "/hyprspace/peer")
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// removePeerLive removes a peer from the configuration, its routes from the TUN device and closes all connections to it.
+func (hsr *HyprspaceRPC) removePeerLive(peerID peer.ID) error {
+	if ExitClient != nil {
+		ExitClient.Forget(peerID)
+	}
+	var static []multiaddr.Multiaddr
+	if p, found := config.FindPeer(hsr.config.Peers, peerID); found {
+		static = p.Addrs
+	}
+	routes, err := hsr.config.RemovePeer(peerID)
+	if err != nil {
+		return err
+	}
+	p2p.SetStaticAddrs(hsr.host, peerID, static, nil)
+	if Advertiser != nil {
+		Advertiser.Forget(peerID)
+	}
+	if Services != nil {
+		routes = append(routes, Services.PeerRange(peerID))
+	}
+	for _, r := range routes {
+		if err := hsr.tunDev.Apply(tun.RemoveRoute(r)); err != nil {
+			fmt.Printf("[!] Warning: Failed to remove route %s from TUN device: %v\n", &r, err)
+		}
+	}
+
+	hsr.host.ConnManager().Unprotect(peerID, "/hyprspace/peer")
+	if OnPeerRemoved != nil {
+		OnPeerRemoved(peerID)
+	}
+	if err := hsr.host.Network().ClosePeer(peerID); err != nil {
+		fmt.Printf("[!] Warning: Failed to close connections to %s: %v\n", peerID, err)
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) RemovePeer(args *RemovePeerArgs, reply *RemovePeerReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+
+	target, err := config.FindPeerByCLIRef(hsr.config.Peers, args.Peer)
+	if err != nil {
+		*reply = RemovePeerReply{Success: false, Message: fmt.Sprintf("Failed to remove peer: %v", err)}
+		return nil
+	}
+	p := *target
+	// 来自 drop-in 文件的 peer 只能在该文件中持久修改
+	if args.Persist && p.Source != "" {
+		*reply = RemovePeerReply{Success: false, Message: fmt.Sprintf("Peer %s is defined in %s, change it there", p.Name, p.Source)}
+		return nil
+	}
+
+	// 从配置、路由表和 TUN 设备中移除 peer，并断开连接
+	if err := hsr.removePeerLive(p.ID); err != nil {
+		*reply = RemovePeerReply{Success: false, Message: fmt.Sprintf("Failed to remove peer: %v", err)}
+		return nil
+	}
+
+	if args.Persist {
+		if err := hsr.config.PersistRemovedPeer(p.ID); err != nil {
+			*reply = RemovePeerReply{Success: false, Message: fmt.Sprintf("Peer %s (%s) removed but config could not be saved: %v", p.Name, p.ID, err)}
+			return nil
+		}
+	}
+
+	*reply = RemovePeerReply{Success: true, Message: fmt.Sprintf("Peer %s (%s) removed successfully", p.Name, p.ID)}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) RenamePeer(args *RenamePeerArgs, reply *RenamePeerReply) error {
+	if args.Name == "" {
+		*reply = RenamePeerReply{Success: false, Message: "Peer name cannot be empty"}
+		return nil
+	}
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+
+	target, err := config.FindPeerByCLIRef(hsr.config.Peers, args.Peer)
+	if err != nil {
+		*reply = RenamePeerReply{Success: false, Message: fmt.Sprintf("Failed to rename peer: %v", err)}
+		return nil
+	}
+	p := *target
+	// 来自 drop-in 文件的 peer 只能在该文件中持久修改
+	if args.Persist && p.Source != "" {
+		*reply = RenamePeerReply{Success: false, Message: fmt.Sprintf("Peer %s is defined in %s, change it there", p.Name, p.Source)}
+		return nil
+	}
+
+	if err := hsr.config.RenamePeer(p.ID, args.Name); err != nil {
+		*reply = RenamePeerReply{Success: false, Message: fmt.Sprintf("Failed to rename peer: %v", err)}
+		return nil
+	}
+
+	if args.Persist {
+		if err := hsr.config.PersistPeer(p.ID, func(sp *schema.Peer) { sp.Name = args.Name }); err != nil {
+			*reply = RenamePeerReply{Success: false, Message: fmt.Sprintf("Peer %s renamed to %s but config could not be saved: %v", p.Name, args.Name, err)}
+			return nil
+		}
+	}
+
+	*reply = RenamePeerReply{Success: true, Message: fmt.Sprintf("Peer %s (%s) renamed to %s", p.Name, p.ID, args.Name)}
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) Tag(args *TagArgs, reply *TagReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+
+	target, err := config.FindPeerByCLIRef(hsr.config.Peers, args.Peer)
+	if err != nil {
+		*reply = TagReply{Success: false, Message: fmt.Sprintf("Failed to tag peer: %v", err)}
+		return nil
+	}
+	p := *target
+	// 来自 drop-in 文件的 peer 只能在该文件中持久修改
+	if args.Persist && p.Source != "" {
+		*reply = TagReply{Success: false, Message: fmt.Sprintf("Peer %s is defined in %s, change it there", p.Name, p.Source)}
+		return nil
+	}
+	if p.Certificate != nil {
+		*reply = TagReply{Success: false, Message: fmt.Sprintf("Peer %s is a member, its tags come from its certificate", p.Name)}
+		return nil
+	}
+	add, err := config.ParseTags(args.Add)
+	remove, err2 := config.ParseTags(args.Remove)
+	if err = errors.Join(err, err2); err != nil {
+		*reply = TagReply{Success: false, Message: err.Error()}
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range append(slices.Clone(p.Tags), add...) {
+		if !slices.Contains(tags, tag) && !slices.Contains(remove, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if err := hsr.config.SetPeerTags(p.ID, tags); err != nil {
+		*reply = TagReply{Success: false, Message: fmt.Sprintf("Failed to set tags: %v", err)}
+		return nil
+	}
+
+	if args.Persist {
+		if err := hsr.config.PersistPeer(p.ID, func(sp *schema.Peer) { sp.Tags = tags }); err != nil {
+			*reply = TagReply{Success: false, Message: fmt.Sprintf("Tags of peer %s changed but config could not be saved: %v", p.Name, err), Tags: tags}
+			return nil
+		}
+	}
+
+	*reply = TagReply{Success: true, Message: fmt.Sprintf("Tags of peer %s (%s) updated", p.Name, p.ID), Tags: tags}
+	return nil
+}
@@ -0,0 +1,238 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+	"github.com/soitun/mynetwork/svc"
+	"github.com/soitun/mynetwork/tun"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ReloadConfig re-reads the config file of a running daemon and applies the differences without restarting it.
+func ReloadConfig(host host.Host, config *config.Config, tunDev *tun.TUN) ReloadReply {
+	hsr := HyprspaceRPC{host, config, tunDev}
+	var reply ReloadReply
+	_ = hsr.Reload(new(Args), &reply)
+	return reply
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func (hsr *HyprspaceRPC) Reload(args *Args, reply *ReloadReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+
+	next, err := config.Read(hsr.config.Path)
+	if err != nil {
+		*reply = ReloadReply{Success: false, Message: fmt.Sprintf("Failed to read config: %v", err)}
+		return nil
+	}
+	next.Interface = hsr.config.Interface
+	next.RestoreRevocations()
+
+	d, err := hsr.config.Diff(next)
+	if err != nil {
+		*reply = ReloadReply{Success: false, Message: fmt.Sprintf("Failed to compare configs: %v", err)}
+		return nil
+	}
+	// The live config remembers the drop-in file of each peer and service, so saving it leaves them there.
+	defer hsr.config.AdoptSources(next)
+	if d.Empty() {
+		*reply = ReloadReply{Success: true, Message: "Config unchanged"}
+		return nil
+	}
+
+	var changes []string
+	record := func(format string, a ...any) {
+		change := fmt.Sprintf(format, a...)
+		fmt.Println("[-] Reload:", change)
+		changes = append(changes, change)
+	}
+
+	if d.KeyChanged {
+		record("private key changed, restart required to apply")
+	}
+	if d.ListenChanged {
+		record("listen addresses changed, restart required to apply")
+	}
+	if d.AddrsChanged {
+		record("overlay networks or addresses changed, restart required to apply")
+	}
+	if d.ExitNodeChanged {
+		record("exit node setting changed, restart required to apply")
+	}
+	if d.MTUChanged {
+		record("MTU changed, restart required to apply")
+	}
+	if d.SettingsChanged {
+		record("swarm key, IPFS API, metrics listener or routing settings changed, restart required to apply")
+	}
+
+	for _, p := range d.RemovedPeers {
+		if err := hsr.removePeerLive(p.ID); err != nil {
+			record("failed to remove peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		record("removed peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.AddedPeers {
+		if err := hsr.addPeerLive(p.Name, p.ID, p.Addr4, p.Addr6); err != nil {
+			record("failed to add peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		if p.ACL != nil || p.AllowAnySource {
+			if err := hsr.config.SetPeerACL(p.ID, p.ACL, p.AllowAnySource); err != nil {
+				record("failed to set acl of peer %s (%s): %v", p.Name, p.ID, err)
+			}
+		}
+		if p.AutoApproveRoutes {
+			if err := hsr.config.SetPeerAutoApprove(p.ID, true); err != nil {
+				record("failed to set route approval of peer %s (%s): %v", p.Name, p.ID, err)
+			}
+		}
+		if len(p.Tags) > 0 {
+			if err := hsr.config.SetPeerTags(p.ID, p.Tags); err != nil {
+				record("failed to set tags of peer %s (%s): %v", p.Name, p.ID, err)
+			}
+		}
+		if len(p.Addrs) > 0 {
+			if err := hsr.config.SetPeerAddrs(p.ID, p.Addrs); err != nil {
+				record("failed to set addresses of peer %s (%s): %v", p.Name, p.ID, err)
+			} else {
+				p2p.SetStaticAddrs(hsr.host, p.ID, nil, p.Addrs)
+			}
+		}
+		record("added peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.ChangedACLs {
+		if err := hsr.config.SetPeerACL(p.ID, p.ACL, p.AllowAnySource); err != nil {
+			record("failed to update acl of peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		record("updated acl of peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.ChangedApprovals {
+		if err := hsr.config.SetPeerAutoApprove(p.ID, p.AutoApproveRoutes); err != nil {
+			record("failed to update route approval of peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		if Advertiser != nil {
+			Advertiser.Reevaluate(p.ID)
+		}
+		record("updated route approval of peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.ChangedTags {
+		if err := hsr.config.SetPeerTags(p.ID, p.Tags); err != nil {
+			record("failed to update tags of peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		record("updated tags of peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.ChangedAddrs {
+		var prev []multiaddr.Multiaddr
+		if old, found := config.FindPeer(hsr.config.Peers, p.ID); found {
+			prev = old.Addrs
+		}
+		if err := hsr.config.SetPeerAddrs(p.ID, p.Addrs); err != nil {
+			record("failed to update addresses of peer %s (%s): %v", p.Name, p.ID, err)
+			continue
+		}
+		p2p.SetStaticAddrs(hsr.host, p.ID, prev, p.Addrs)
+		record("updated addresses of peer %s (%s)", p.Name, p.ID)
+	}
+	for _, p := range d.RenamedPeers {
+		if err := hsr.config.RenamePeer(p.ID, p.Name); err != nil {
+			record("failed to rename peer %s to %s: %v", p.ID, p.Name, err)
+			continue
+		}
+		record("renamed peer %s to %s", p.ID, p.Name)
+	}
+
+	for _, rte := range d.RemovedRoutes {
+		// Only the route to the old target goes, the network may be routed to another peer at runtime by now.
+		if cur, found := hsr.config.FindExactRoute(rte.Net); !found || cur.Target.ID != rte.Target.ID {
+			continue
+		}
+		if err := hsr.tunDev.Apply(tun.RemoveRoute(rte.Net)); err != nil {
+			record("failed to remove route %s: %v", &rte.Net, err)
+			continue
+		}
+		if _, err := hsr.config.RemoveRouteTo(rte.Net, rte.Target.ID); err != nil {
+			_ = hsr.tunDev.Apply(tun.Route(rte.Net))
+			record("failed to remove route %s: %v", &rte.Net, err)
+			continue
+		}
+		record("removed route %s via /p2p/%s", &rte.Net, rte.Target.ID)
+	}
+	for _, rte := range d.AddedRoutes {
+		target, found := config.FindPeer(hsr.config.Peers, rte.Target.ID)
+		if !found {
+			continue
+		}
+		if err := hsr.tunDev.Apply(tun.Route(rte.Net)); err != nil {
+			record("failed to add route %s: %v", &rte.Net, err)
+			continue
+		}
+		hsr.config.PeerLookup.ByRoute.Insert(&config.RouteTableEntry{
+			Net:    rte.Net,
+			Target: *target,
+		})
+		record("added route %s via /p2p/%s", &rte.Net, target.ID)
+	}
+
+	for _, name := range d.RemovedServices {
+		delete(hsr.config.Services, name)
+		if Services != nil {
+			Services.Unregister(name)
+		}
+		record("removed service %s", name)
+	}
+	for name, addr := range d.AddedServices {
+		proxy, err := svc.ProxyTo(addr)
+		if err != nil {
+			record("failed to add service %s: %v", name, err)
+			continue
+		}
+		if _, exists := hsr.config.Services[name]; exists && Services != nil {
+			Services.Unregister(name)
+		}
+		hsr.config.Services[name] = addr
+		if Services != nil {
+			Services.Register(name, proxy)
+		}
+		record("set service %s to %s", name, addr)
+	}
+
+	if d.MembershipChanged {
+		hsr.config.CA, hsr.config.Certificate, hsr.config.Revocations = next.CA, next.Certificate, next.Revocations
+		for _, p := range hsr.dropStaleMembers() {
+			record("dropped member %s (%s)", p.Name, p.ID)
+		}
+		p2p.AnnounceMembership(context.Background(), hsr.host, hsr.config)
+		record("network CA, certificate or revocation list changed, announced to connected peers")
+	}
+
+	if d.PoliciesChanged {
+		hsr.config.Relay, hsr.config.ServiceAccess = next.Relay, next.ServiceAccess
+		record("relay or service access policies changed")
+	}
+
+	if d.AdvertiseChanged {
+		hsr.config.AdvertiseRoutes = next.AdvertiseRoutes
+		if Advertiser != nil {
+			Advertiser.Announce(context.Background())
+		}
+		record("advertised routes changed, announced to connected peers")
+	}
+
+	if len(d.AddedPeers) > 0 {
+		p2p.Rediscover()
+	}
+
+	*reply = ReloadReply{Success: true, Message: fmt.Sprintf("Applied %d change(s)", len(changes)), Changes: changes}
+	return nil
+}
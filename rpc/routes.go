@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/soitun/mynetwork/config"
+	"github.com/soitun/mynetwork/p2p"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Advertiser exchanges subnet route announcements with the peers of the running daemon.
+var Advertiser *p2p.RouteAdvertiser
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// approveRoute installs the route announced for args[0], optionally by the peer named in args[1].
+func (hsr *HyprspaceRPC) approveRoute(args []string, persist bool) (string, error) {
+	if Advertiser == nil {
+		return "", errors.New("route announcements are not available")
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return "", errors.New("expected 1 or 2 arguments")
+	}
+	_, network, err := net.ParseCIDR(args[0])
+	if err != nil {
+		return "", err
+	}
+	var target *config.Peer
+	if len(args) == 2 {
+		p, err := config.FindPeerByCLIRef(hsr.config.Peers, args[1])
+		if err != nil {
+			return "", err
+		}
+		target = p
+	}
+	p, err := Advertiser.Approve(*network, target, persist)
+	if err != nil {
+		return "", err
+	}
+	if persist {
+		if err := hsr.config.PersistRoute(*network, p.ID); err != nil {
+			return "", fmt.Errorf("route approved but config could not be saved: %w", err)
+		}
+	}
+	return fmt.Sprintf("Approved route %s via @%s", network, p.Name), nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// advertisedRoutes lists the routes announced by peers.
+func advertisedRoutes() []RouteInfo {
+	if Advertiser == nil {
+		return nil
+	}
+	var routes []RouteInfo
+	for _, r := range Advertiser.Routes() {
+		routes = append(routes, RouteInfo{
+			Network:    r.Net,
+			TargetName: r.Target.Name,
+			TargetAddr: r.Target.ID,
+			State:      r.State,
+			Overlaps:   r.Overlaps,
+		})
+	}
+	return routes
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"strings"
 	"syscall"
 
 	"github.com/libp2p/go-libp2p/core/host"
@@ -31,15 +32,18 @@ type HyprspaceRPC struct {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) Status(args *Args, reply *StatusReply) error {
+	hsr.config.RLock()
+	defer hsr.config.RUnlock()
 	netPeersCurrent := 0
 	var netPeerAddrsCurrent []string
 	for _, p := range hsr.config.Peers {
 		if hsr.host.Network().Connectedness(p.ID) == network.Connected {
 			netPeersCurrent = netPeersCurrent + 1
 			for _, c := range hsr.host.Network().ConnsToPeer(p.ID) {
-				netPeerAddrsCurrent = append(netPeerAddrsCurrent, fmt.Sprintf("@%s (%s) %s/p2p/%s",
+				netPeerAddrsCurrent = append(netPeerAddrsCurrent, fmt.Sprintf("@%s (%s, %s) %s/p2p/%s",
 					p.Name,
 					hsr.host.Peerstore().LatencyEWMA(p.ID).String(),
+					transportMode(p.ID),
 					c.RemoteMultiaddr().String(),
 					p.ID.String(),
 				))
@@ -63,6 +67,8 @@ func (hsr *HyprspaceRPC) Status(args *Args, reply *StatusReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
 	switch args.Action {
 	case Show:
 		var routeInfos []RouteInfo
@@ -84,7 +90,7 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 			ConnLoop:
 				for _, c := range hsr.host.Network().ConnsToPeer(rte.Target.ID) {
 					for _, s := range c.GetStreams() {
-						if s.Protocol() == p2p.Protocol {
+						if p2p.IsTunnelProtocol(s.Protocol()) {
 							if _, err := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
 								relay = true
 								if ra, err := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_P2P); err == nil {
@@ -109,6 +115,7 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 				RelayAddr:   relayAddr,
 				IsRelay:     relay,
 				IsConnected: connected,
+				Transport:   transportMode(rte.Target.ID),
 			})
 		}
 		*reply = RouteReply{
@@ -122,19 +129,35 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 		if err != nil {
 			return err
 		}
-		target, found := config.FindPeerByCLIRef(hsr.config.Peers, args.Args[1])
-		if !found {
-			return errors.New("no such peer")
+		target, err := config.FindPeerByCLIRef(hsr.config.Peers, args.Args[1])
+		if err != nil {
+			return err
 		}
 		err = hsr.tunDev.Apply(tun.Route(*network))
 		if err != nil {
 			return err
 		}
 
+		// 重叠的路由并存，数据包按最长前缀匹配选择路由
+		overlaps, _ := hsr.config.OverlappingRoutes(*network)
+		for _, rte := range overlaps {
+			if rte.Net.String() == network.String() {
+				reply.Out += fmt.Sprintf("[!] Replaced route %s to %s\n", network, rte.Target.Name)
+			} else {
+				reply.Out += fmt.Sprintf("[!] Route %s overlaps %s to %s, packets take the more specific one\n", network, &rte.Net, rte.Target.Name)
+			}
+		}
+		reply.Out = strings.TrimSuffix(reply.Out, "\n")
+
 		hsr.config.PeerLookup.ByRoute.Insert(&config.RouteTableEntry{
 			Net:    *network,
 			Target: *target,
 		})
+		if args.Persist {
+			if err := hsr.config.PersistRoute(*network, target.ID); err != nil {
+				return fmt.Errorf("route added but config could not be saved: %w", err)
+			}
+		}
 	case Del:
 		if len(args.Args) != 1 {
 			return errors.New("expected exactly 1 argument")
@@ -143,17 +166,40 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 		if err != nil {
 			return err
 		}
+		rte, found := hsr.config.FindExactRoute(*network)
+		if !found {
+			return fmt.Errorf("no route for %s", network)
+		}
+		// 守护进程在运行时自行安装的路由（出口节点、未持久化的通告路由）由其自身管理
+		if rte.Transient {
+			return fmt.Errorf("route %s to %s is managed by the daemon and cannot be deleted", network, rte.Target.Name)
+		}
 
 		err = hsr.tunDev.Apply(tun.RemoveRoute(*network))
 		if err != nil {
 			return err
 		}
 
-		_, err = hsr.config.PeerLookup.ByRoute.Remove(*network)
+		_, err = hsr.config.RemoveRouteTo(*network, rte.Target.ID)
 		if err != nil {
 			_ = hsr.tunDev.Apply(tun.Route(*network))
 			return err
 		}
+		if args.Persist {
+			if err := hsr.config.PersistRemovedRoute(*network, rte.Target.ID); err != nil {
+				return fmt.Errorf("route removed but config could not be saved: %w", err)
+			}
+		}
+	case Approve:
+		out, err := hsr.approveRoute(args.Args, args.Persist)
+		if err != nil {
+			return err
+		}
+		reply.Out = out
+	case Advertised:
+		*reply = RouteReply{
+			Routes: advertisedRoutes(),
+		}
 	default:
 		return errors.New("no such action")
 	}
@@ -162,6 +208,8 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
+	hsr.config.RLock()
+	defer hsr.config.RUnlock()
 	var peers []PeerInfo
 	
 	for _, c := range hsr.host.Network().Conns() {
@@ -177,6 +225,10 @@ func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
 		for _, peer := range hsr.config.Peers {
 			if peer.ID.String() == peerID {
 				peerInfo.Name = peer.Name // 只保留节点名称
+				peerInfo.Tags = peer.Tags
+				for _, addr := range peer.Addrs {
+					peerInfo.Addrs = append(peerInfo.Addrs, addr.String())
+				}
 				if peer.BuiltinAddr4 != nil {
 					peerInfo.IPv4 = peer.BuiltinAddr4.String()
 				}
@@ -196,6 +248,14 @@ func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) AddPeer(args *AddPeerArgs, reply *AddPeerReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+	return hsr.addPeer(args, reply)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addPeer 与 AddPeer 相同，供已持有配置锁的调用方使用
+func (hsr *HyprspaceRPC) addPeer(args *AddPeerArgs, reply *AddPeerReply) error {
 	// 验证输入参数
 	if args.Name == "" {
 		*reply = AddPeerReply{Success: false, Message: "Peer name cannot be empty", Err: errors.New("peer name cannot be empty")}
@@ -225,39 +285,25 @@ func (hsr *HyprspaceRPC) AddPeer(args *AddPeerArgs, reply *AddPeerReply) error {
 		return nil
 	}
 
-	// 调用配置模块的方法添加 peer
-	err = hsr.config.AddPeer(args.Name, peerID)
+	// 调用配置模块的方法添加 peer，并将其路由添加到 TUN 设备
+	// Addr4/Addr6 为空时由 peer ID 分配地址
+	err = hsr.addPeerLive(args.Name, peerID, args.Addr4, args.Addr6)
 	if err != nil {
 		*reply = AddPeerReply{Success: false, Message: fmt.Sprintf("Failed to add peer: %v", err), Err: err}
 		return nil
 	}
 
-	// 获取新添加的 peer 并添加路由到 TUN 设备
-	newPeer := hsr.config.Peers[len(hsr.config.Peers)-1]
-	
-	// 添加 IPv4 路由到 TUN 设备
-	ipv4Route := net.IPNet{
-		IP:   newPeer.BuiltinAddr4,
-		Mask: net.CIDRMask(32, 32),
-	}
-	err = hsr.tunDev.Apply(tun.Route(ipv4Route))
-	if err != nil {
-		fmt.Printf("[!] Warning: Failed to add IPv4 route to TUN device: %v\n", err)
-	}
-
-	// 添加 IPv6 路由到 TUN 设备
-	ipv6Route := net.IPNet{
-		IP:   newPeer.BuiltinAddr6,
-		Mask: net.CIDRMask(128, 128),
-	}
-	err = hsr.tunDev.Apply(tun.Route(ipv6Route))
-	if err != nil {
-		fmt.Printf("[!] Warning: Failed to add IPv6 route to TUN device: %v\n", err)
-	}
-
 	// 触发重新发现，让新添加的节点能被发现服务识别
 	p2p.Rediscover()
 
+	// 按需将变更写回配置文件
+	if args.Persist {
+		if err := hsr.config.PersistAddedPeer(peerID); err != nil {
+			*reply = AddPeerReply{Success: false, Message: fmt.Sprintf("Peer %s (%s) added but config could not be saved: %v", args.Name, args.ID, err), Err: err}
+			return nil
+		}
+	}
+
 	*reply = AddPeerReply{Success: true, Message: fmt.Sprintf("Peer %s (%s) added successfully", args.Name, args.ID), Err: nil}
 	return nil
 }
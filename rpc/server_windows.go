@@ -41,7 +41,7 @@ func (hsr *HyprspaceRPC) Status(args *Args, reply *StatusReply) error {
 	reply.NetPeersCurrent = len(connectedPeers)
 	reply.NetPeerAddrsCurrent = make([]string, len(connectedPeers))
 	for i, p := range connectedPeers {
-		reply.NetPeerAddrsCurrent[i] = p.String()
+		reply.NetPeerAddrsCurrent[i] = fmt.Sprintf("%s (%s)", p, transportMode(p))
 	}
 	reply.NetPeersMax = 100 // Default max peers
 
@@ -50,8 +50,9 @@ func (hsr *HyprspaceRPC) Status(args *Args, reply *StatusReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
-	if len(args.Args) == 0 {
-		reply.Err = errors.New("no arguments provided")
+	// Windows 上 add 和 del 不修改路由表，没有可以写回配置文件的变更
+	if args.Persist && (args.Action == Add || args.Action == Del) {
+		reply.Err = fmt.Errorf("--persist is not supported for route %s on Windows", args.Action)
 		return nil
 	}
 
@@ -75,6 +76,7 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 		// Try to decode as peer ID
 		if targetPeer, err = peer.Decode(dest); err != nil {
 			// Try to find by name in config
+			hsr.config.RLock()
 			for _, p := range hsr.config.Peers {
 				if p.Name == dest {
 					targetPeer = p.ID
@@ -82,6 +84,7 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 					break
 				}
 			}
+			hsr.config.RUnlock()
 			if err != nil {
 				reply.Err = fmt.Errorf("peer not found: %s", dest)
 				return nil
@@ -112,6 +115,14 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 	case Del:
 		// TODO: Implement route deletion
 		reply.Out = "Route deletion not implemented on Windows"
+	case Approve:
+		hsr.config.Lock()
+		reply.Out, reply.Err = hsr.approveRoute(args.Args, args.Persist)
+		hsr.config.Unlock()
+	case Advertised:
+		hsr.config.RLock()
+		reply.Routes = advertisedRoutes()
+		hsr.config.RUnlock()
 	default:
 		reply.Err = fmt.Errorf("unknown action: %s", args.Action)
 	}
@@ -121,6 +132,8 @@ func (hsr *HyprspaceRPC) Route(args *RouteArgs, reply *RouteReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
+	hsr.config.RLock()
+	defer hsr.config.RUnlock()
 	reply.Peers = make([]PeerInfo, len(hsr.config.Peers))
 	
 	for i, p := range hsr.config.Peers {
@@ -128,6 +141,10 @@ func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
 		peerInfo := PeerInfo{
 			PeerID: p.ID.String(),
 			Name:   p.Name, // 只保留节点名称
+			Tags:   p.Tags,
+		}
+		for _, addr := range p.Addrs {
+			peerInfo.Addrs = append(peerInfo.Addrs, addr.String())
 		}
 		
 		if p.BuiltinAddr4 != nil {
@@ -144,6 +161,14 @@ func (hsr *HyprspaceRPC) Peers(args *Args, reply *PeersReply) error {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (hsr *HyprspaceRPC) AddPeer(args *AddPeerArgs, reply *AddPeerReply) error {
+	hsr.config.Lock()
+	defer hsr.config.Unlock()
+	return hsr.addPeer(args, reply)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// addPeer 与 AddPeer 相同，供已持有配置锁的调用方使用
+func (hsr *HyprspaceRPC) addPeer(args *AddPeerArgs, reply *AddPeerReply) error {
 	// 验证输入参数
 	if args.Name == "" {
 		*reply = AddPeerReply{Success: false, Message: "Peer name cannot be empty", Err: fmt.Errorf("peer name cannot be empty")}
@@ -177,39 +202,25 @@ func (hsr *HyprspaceRPC) AddPeer(args *AddPeerArgs, reply *AddPeerReply) error {
 		}
 	}
 
-	// 调用配置模块的方法添加 peer
-	err = hsr.config.AddPeer(args.Name, peerID)
+	// 调用配置模块的方法添加 peer，并将其路由添加到 TUN 设备
+	// Addr4/Addr6 为空时由 peer ID 分配地址
+	err = hsr.addPeerLive(args.Name, peerID, args.Addr4, args.Addr6)
 	if err != nil {
 		*reply = AddPeerReply{Success: false, Message: fmt.Sprintf("Failed to add peer: %v", err), Err: err}
 		return nil
 	}
 
-	// 获取新添加的 peer 并添加路由到 TUN 设备
-	newPeer := hsr.config.Peers[len(hsr.config.Peers)-1]
-	
-	// 添加 IPv4 路由到 TUN 设备
-	ipv4Route := net.IPNet{
-		IP:   newPeer.BuiltinAddr4,
-		Mask: net.CIDRMask(32, 32),
-	}
-	err = hsr.tunDev.Apply(tun.Route(ipv4Route))
-	if err != nil {
-		fmt.Printf("[!] Warning: Failed to add IPv4 route to TUN device: %v\n", err)
-	}
-
-	// 添加 IPv6 路由到 TUN 设备
-	ipv6Route := net.IPNet{
-		IP:   newPeer.BuiltinAddr6,
-		Mask: net.CIDRMask(128, 128),
-	}
-	err = hsr.tunDev.Apply(tun.Route(ipv6Route))
-	if err != nil {
-		fmt.Printf("[!] Warning: Failed to add IPv6 route to TUN device: %v\n", err)
-	}
-
 	// 触发重新发现，让新添加的节点能被发现服务识别
 	p2p.Rediscover()
 
+	// 按需将变更写回配置文件
+	if args.Persist {
+		if err := hsr.config.PersistAddedPeer(peerID); err != nil {
+			*reply = AddPeerReply{Success: false, Message: fmt.Sprintf("Peer %s (%s) added but config could not be saved: %v", args.Name, args.ID, err), Err: err}
+			return nil
+		}
+	}
+
 	*reply = AddPeerReply{Success: true, Message: fmt.Sprintf("Peer %s (%s) added successfully", args.Name, args.ID), Err: nil}
 	return nil
 }
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"net"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
@@ -26,6 +27,8 @@ type PeerInfo struct {
 	Name     string
 	IPv4     string
 	IPv6     string
+	Tags     []string
+	Addrs    []string
 }
 
 type PeersReply struct {
@@ -37,9 +40,11 @@ type RouteAction string
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 const (
-	Show RouteAction = "show"
-	Add  RouteAction = "add"
-	Del  RouteAction = "del"
+	Show       RouteAction = "show"
+	Add        RouteAction = "add"
+	Del        RouteAction = "del"
+	Approve    RouteAction = "approve"
+	Advertised RouteAction = "advertised"
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -50,12 +55,16 @@ type RouteInfo struct {
 	RelayAddr   peer.ID
 	IsRelay     bool
 	IsConnected bool
+	Transport   string
+	State       string
+	Overlaps    string
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 type RouteArgs struct {
-	Action RouteAction
-	Args   []string
+	Action  RouteAction
+	Args    []string
+	Persist bool
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -67,8 +76,12 @@ type RouteReply struct {
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 type AddPeerArgs struct {
-	Name string
-	ID   string
+	Name    string
+	ID      string
+	Persist bool
+	// Addr4 and Addr6 pin the addresses of the peer, nil to allocate them from its ID.
+	Addr4 net.IP
+	Addr6 net.IP
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -84,3 +97,111 @@ type NodeIpReply struct {
 	IPv6 string
 	Err  error
 }
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RemovePeerArgs struct {
+	Peer    string
+	Persist bool
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RemovePeerReply struct {
+	Success bool
+	Message string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RenamePeerArgs struct {
+	Peer    string
+	Name    string
+	Persist bool
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RenamePeerReply struct {
+	Success bool
+	Message string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type TagArgs struct {
+	Peer    string
+	Add     []string
+	Remove  []string
+	Persist bool
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type TagReply struct {
+	Success bool
+	Message string
+	Tags    []string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ReloadReply struct {
+	Success bool
+	Message string
+	Changes []string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ExitAction string
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+const (
+	ExitShow ExitAction = "show"
+	ExitUse  ExitAction = "use"
+	ExitOff  ExitAction = "off"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ExitArgs struct {
+	Action ExitAction
+	Peer   string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type ExitReply struct {
+	Success bool
+	Message string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RotateKeyArgs struct {
+	Grace time.Duration
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type RotateKeyReply struct {
+	Success bool
+	Message string
+	ID      string
+	Expires time.Time
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type InviteArgs struct {
+	Name    string
+	Expires time.Duration
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type InviteReply struct {
+	Success bool
+	Message string
+	Token   string
+	Expires time.Time
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type JoinArgs struct {
+	Token string
+	Name  string
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+type JoinReply struct {
+	Success bool
+	Message string
+}
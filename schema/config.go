@@ -4,9 +4,62 @@ package schema
 // Config represents the configuration structure for Hyprspace
 type Config struct {
 	ListenAddresses []string          `json:"listenAddresses"`
-	PrivateKey      string            `json:"privateKey"`
+	PrivateKey      string            `json:"privateKey,omitempty"`
 	Peers           []Peer            `json:"peers"`
 	Services        map[string]string `json:"services"`
+	// PrivateKeyFile holds the private key instead of privateKey, relative to the directory of the config file. Both
+	// may hold a key encrypted with a passphrase.
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	// Network4, Network6 and ServiceNetwork replace the default overlay ranges. All peers must use the same ones.
+	Network4       string `json:"network4,omitempty"`
+	Network6       string `json:"network6,omitempty"`
+	ServiceNetwork string `json:"serviceNetwork,omitempty"`
+	// Addr4 and Addr6 override the addresses this node allocates for itself.
+	Addr4    string `json:"addr4,omitempty"`
+	Addr6    string `json:"addr6,omitempty"`
+	ExitNode bool   `json:"exitNode,omitempty"`
+	// AdvertiseRoutes are the subnets behind this node that other peers may route through it.
+	AdvertiseRoutes []string `json:"advertiseRoutes,omitempty"`
+	// KeyTransition is the signed record handing the previous identity of this node over to privateKey, written by
+	// `key rotate`.
+	KeyTransition string `json:"keyTransition,omitempty"`
+	// CA is the peer ID of the network CA. Nodes presenting a certificate signed by it are accepted as peers without
+	// being listed in peers.
+	CA string `json:"ca,omitempty"`
+	// Certificate is the membership certificate of this node, issued by `ca sign`.
+	Certificate string `json:"certificate,omitempty"`
+	// RevocationList is the latest list of certificates revoked by the network CA, issued by `ca revoke`. Newer lists
+	// received from peers replace it.
+	RevocationList string `json:"revocationList,omitempty"`
+	// Relay limits which peers may use this node as a relay. Entries are peer names, peer IDs or tag:<tag>. All peers
+	// may if it is empty.
+	Relay []string `json:"relay,omitempty"`
+	// ServiceAccess limits which peers may reach each service of this node, with entries like those of relay.
+	// Services that are not listed are open to all peers.
+	ServiceAccess map[string][]string `json:"serviceAccess,omitempty"`
+	// Include lists drop-in files that add peers and services, as glob patterns or directories relative to the
+	// directory of the config file, like mynetwork.d/*.json.
+	Include []string `json:"include,omitempty"`
+	// SwarmKey is the pre-shared key of a private libp2p network, hex encoded or as written by ipfs-swarm-key-gen.
+	// HYPRSPACE_SWARM_KEY overrides it with a key file.
+	SwarmKey string `json:"swarmKey,omitempty"`
+	// SwarmKeyFile holds the swarm key instead of swarmKey, relative to the directory of the config file.
+	SwarmKeyFile string `json:"swarmKeyFile,omitempty"`
+	// IPFSAPI is the multiaddr of the API of a local IPFS node, which contributes peers and bootstrap nodes.
+	// MYNETWORK_IPFS_API overrides it.
+	IPFSAPI string `json:"ipfsApi,omitempty"`
+	// Metrics is the host:port the Prometheus metrics are served on. MYNETWORK_METRICS_PORT overrides it with a port
+	// on 127.0.0.1.
+	Metrics string `json:"metrics,omitempty"`
+	// BootstrapPeers replace the public nodes the DHT is bootstrapped from, as multiaddrs ending in /p2p/<peer ID>.
+	BootstrapPeers []string `json:"bootstrapPeers,omitempty"`
+	// DelegatedRouting replaces the public HTTP routing endpoints peers are looked up at.
+	DelegatedRouting []string `json:"delegatedRouting,omitempty"`
+	// Private keeps the node off public infrastructure: the public DHT, the default bootstrap nodes and HTTP routing
+	// are not used. Peers are found through bootstrapPeers, the private DHT among them and the addresses peers share.
+	Private bool `json:"private,omitempty"`
+	// MTU of the TUN device, 1420 unless set. Packets to peers with a smaller MTU are limited to theirs.
+	MTU int `json:"mtu,omitempty"`
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -14,7 +67,31 @@ type Config struct {
 type Peer struct {
 	Id     string  `json:"id"`
 	Name   string  `json:"name"`
-	Routes []Route `json:"routes"`
+	Routes []Route `json:"routes,omitempty"`
+	ACL    *ACL    `json:"acl,omitempty"`
+	// Addr4 and Addr6 override the addresses allocated for the peer. They must match the addresses the peer uses.
+	Addr4 string `json:"addr4,omitempty"`
+	Addr6 string `json:"addr6,omitempty"`
+	// AllowAnySource turns off source address validation for peers that route other networks.
+	AllowAnySource bool `json:"allowAnySource,omitempty"`
+	// AutoApproveRoutes installs the subnets announced by the peer without waiting for `route approve`.
+	AutoApproveRoutes bool `json:"autoApproveRoutes,omitempty"`
+	// KeyTransition is the signed record of the last key rotation of the peer, received from it.
+	KeyTransition string `json:"keyTransition,omitempty"`
+	// Tags group peers for relay and service policies and for DNS names such as servers.mynetwork.
+	Tags []string `json:"tags,omitempty"`
+	// Addrs are multiaddrs the peer is always reachable at, like /dns4/vpn.example.com/tcp/8001. They are dialled
+	// before the peer is looked up.
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// ACL restricts the packets a peer may send into the network. Each list that is left empty allows anything.
+type ACL struct {
+	Sources      []string `json:"sources,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+	Protocols    []string `json:"protocols,omitempty"`
+	Ports        []string `json:"ports,omitempty"`
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -0,0 +1,145 @@
+//go:build ignore
+// +build ignore
+
+// gen writes config.schema.json, the JSON Schema of the config file, from the types and doc comments in config.go.
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// required lists the properties each type can't do without.
+var required = map[string][]string{
+	"Peer":  {"id"},
+	"Route": {"net"},
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func main() {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "config.go", nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defs := map[string]any{}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			defs[ts.Name.Name] = object(ts.Name.Name, gen.Doc, st)
+		}
+	}
+
+	root := defs["Config"].(map[string]any)
+	delete(defs, "Config")
+	// Editors associate files with this schema through "$schema".
+	root["properties"].(map[string]any)["$schema"] = map[string]any{"type": "string"}
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["$id"] = "https://github.com/soitun/mynetwork/schema/config.schema.json"
+	root["$defs"] = defs
+
+	out, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("config.schema.json", append(out, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func object(name string, doc *ast.CommentGroup, st *ast.StructType) map[string]any {
+	props := map[string]any{}
+	var lastDoc string
+	for _, f := range st.Fields.List {
+		if f.Tag == nil {
+			continue
+		}
+		tag := reflect.StructTag(strings.Trim(f.Tag.Value, "`"))
+		key, _, _ := strings.Cut(tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		prop := typeSchema(f.Type)
+		text := description(f.Doc)
+		// A comment like "Addr4 and Addr6 ..." documents the fields that follow it as well.
+		if text == "" && len(f.Names) > 0 && strings.Contains(lastDoc, f.Names[0].Name) {
+			text = lastDoc
+		}
+		if text != "" {
+			prop["description"] = text
+		}
+		lastDoc = text
+		props[key] = prop
+	}
+	obj := map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if text := description(doc); text != "" {
+		obj["description"] = text
+	}
+	if req, ok := required[name]; ok {
+		obj["required"] = req
+	}
+	return obj
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func typeSchema(expr ast.Expr) map[string]any {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return typeSchema(t.X)
+	case *ast.ArrayType:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elt)}
+	case *ast.MapType:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Value)}
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return map[string]any{"type": "string"}
+		case "bool":
+			return map[string]any{"type": "boolean"}
+		case "int", "uint16", "uint32", "uint64":
+			return map[string]any{"type": "integer"}
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name}
+	}
+	log.Fatalf("unsupported type %T", expr)
+	return nil
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+func description(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	var lines []string
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		// Skip the separator lines above declarations.
+		if strings.Trim(line, "-") != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	return strings.Join(lines, " ")
+}
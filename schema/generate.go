@@ -1,3 +1,4 @@
 package schema
 
 //go:generate nix run ..#dev-generate-schemas
+//go:generate go run gen.go
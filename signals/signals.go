@@ -18,18 +18,23 @@ import (
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func SignalHandler(ctx context.Context, host host.Host, lockPath string, dht *dht.IpfsDHT, tunDev *tun.TUN, ctxCancel func()) {
+func SignalHandler(ctx context.Context, host host.Host, lockPath string, dht *dht.IpfsDHT, tunDev *tun.TUN, ctxCancel func(), reload func()) {
 	exitCh := make(chan os.Signal, 1)
 	rebootstrapCh := make(chan os.Signal, 1)
+	reloadCh := make(chan os.Signal, 1)
 	signal.Notify(exitCh, syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(rebootstrapCh, syscall.SIGUSR1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-reloadCh:
+			fmt.Println("[-] Reloading config on SIGHUP")
+			reload()
 		case <-rebootstrapCh:
-			fmt.Println("[-] Rebootstrapping on SIGHUP")
+			fmt.Println("[-] Rebootstrapping on SIGUSR1")
 			host.ConnManager().TrimOpenConns(context.Background())
 			<-dht.ForceRefresh()
 			p2p.Rediscover()
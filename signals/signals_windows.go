@@ -90,7 +90,9 @@ func setupConsoleCtrlHandler() error {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func SignalHandler(ctx context.Context, host host.Host, lockPath string, dht *dht.IpfsDHT, tunDevice *tun.TUN, ctxCancel func()) {
+// SignalHandler handles shutdown events. Windows has no SIGHUP, so reload is only reachable through the reload RPC
+// or the config file watcher there.
+func SignalHandler(ctx context.Context, host host.Host, lockPath string, dht *dht.IpfsDHT, tunDevice *tun.TUN, ctxCancel func(), reload func()) {
 	// Set up both standard Go signal handling and Windows console control handler
 	exitCh := make(chan os.Signal, 1)
 	signal.Notify(exitCh, syscall.SIGINT, syscall.SIGTERM)
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
 
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/soitun/mynetwork/config"
 	"github.com/soitun/mynetwork/netstack"
 	hstun "github.com/soitun/mynetwork/tun"
@@ -25,20 +27,65 @@ type ServiceNetwork struct {
 	NetworkRange net.IPNet
 	Tun          *tun.Device
 	netx         *netstack.Net
+	lock         sync.Mutex
 	activeAddrs  map[[16]byte]struct{}
-	activePorts  map[[16]byte]map[uint16]struct{}
+	activePorts  map[[16]byte]map[uint16]net.Listener
 	listeners    map[[2]byte]Proxy
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (sn *ServiceNetwork) Register(serviceName string, proxy Proxy) {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
 	svcId := config.MkServiceID(serviceName)
 	sn.listeners[svcId] = proxy
 	fmt.Printf("[-] Registered service \"%s\" [%x]: %s\n", serviceName, svcId, proxy.Description)
 }
 
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// Unregister removes a local service and closes the listeners that were serving it.
+func (sn *ServiceNetwork) Unregister(serviceName string) {
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
+	svcId := config.MkServiceID(serviceName)
+	delete(sn.listeners, svcId)
+	for addr, ports := range sn.activePorts {
+		if [4]byte(addr[10:14]) != sn.self || [2]byte(addr[14:16]) != svcId {
+			continue
+		}
+		for port, l := range ports {
+			l.Close()
+			delete(ports, port)
+		}
+	}
+	fmt.Printf("[-] Unregistered service \"%s\" [%x]\n", serviceName, svcId)
+}
+
+// -----------------------------------------------------------------------------------------------------------------------------------------------------
+// PeerRange returns the part of the service network that holds the services of a peer.
+func (sn *ServiceNetwork) PeerRange(p peer.ID) net.IPNet {
+	netId := config.MkNetID(p)
+	addr := make([]byte, 16)
+	copy(addr, sn.NetworkRange.IP)
+	copy(addr[10:], netId[:])
+	mask1, mask0 := sn.NetworkRange.Mask.Size()
+	return net.IPNet{
+		IP:   addr,
+		Mask: net.CIDRMask(mask1+32, mask0),
+	}
+}
+
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (sn *ServiceNetwork) EnsureListener(addr [16]byte, port uint16) bool {
+	netId := [4]byte(addr[10:14])
+	svcId := [2]byte(addr[14:16])
+	// Look the peer up before taking the lock, reloads lock the config first and register services after.
+	sn.config.RLock()
+	remote, known := sn.config.PeerLookup.ByNetID[netId]
+	sn.config.RUnlock()
+
+	sn.lock.Lock()
+	defer sn.lock.Unlock()
 	registerAddr := true
 	if _, ok := sn.activeAddrs[addr]; ok {
 		if _, ok := sn.activePorts[addr][port]; ok {
@@ -46,8 +93,6 @@ func (sn *ServiceNetwork) EnsureListener(addr [16]byte, port uint16) bool {
 		}
 		registerAddr = false
 	}
-	netId := [4]byte(addr[10:14])
-	svcId := [2]byte(addr[14:16])
 	var proxy Proxy
 	if netId == sn.self {
 		// local service
@@ -57,8 +102,11 @@ func (sn *ServiceNetwork) EnsureListener(addr [16]byte, port uint16) bool {
 			fmt.Printf("[!] [svc] Unknown service: %x\n", addr[10:16])
 			return false
 		}
-	} else if p, ok := sn.config.PeerLookup.ByNetID[netId]; ok {
-		proxy = RemoteServiceProxy(sn.host, p.ID, svcId)
+	} else if known {
+		proxy = RemoteServiceProxy(sn.host, remote.ID, svcId)
+	} else {
+		fmt.Printf("[!] [svc] Unknown peer: %x\n", netId)
+		return false
 	}
 	tcpAddr := net.TCPAddr{
 		IP:   net.IP(addr[:]),
@@ -71,14 +119,14 @@ func (sn *ServiceNetwork) EnsureListener(addr [16]byte, port uint16) bool {
 			AddressWithPrefix: tcpip.AddrFrom16(addr).WithPrefix(),
 		})
 		sn.activeAddrs[addr] = struct{}{}
-		sn.activePorts[addr] = make(map[uint16]struct{})
+		sn.activePorts[addr] = make(map[uint16]net.Listener)
 	}
 
 	tcpL, err := sn.netx.ListenTCP(&tcpAddr)
-	sn.activePorts[addr][port] = struct{}{}
 	if err != nil {
 		panic(err)
 	}
+	sn.activePorts[addr][port] = tcpL
 
 	go proxy.ServeFunc()(tcpL)
 	fmt.Printf("[-] [svc] Listening on /ip6/%s/tcp/%d\n", tcpAddr.IP, tcpAddr.Port)
@@ -86,13 +134,18 @@ func (sn *ServiceNetwork) EnsureListener(addr [16]byte, port uint16) bool {
 }
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
-func NewServiceNetwork(host host.Host, cfg *config.Config, tunDev *hstun.TUN) ServiceNetwork {
+func NewServiceNetwork(host host.Host, cfg *config.Config, tunDev *hstun.TUN) *ServiceNetwork {
+	// The netstack gets the last address of the service network for itself.
+	internal := [16]byte(cfg.ServiceNet.IP.To16())
+	for i := 10; i < 16; i++ {
+		internal[i] = 0xff
+	}
 	tun, netx, err := netstack.CreateNetTUN(
 		[]netip.Addr{
-			netip.AddrFrom16([16]byte([]byte("\xfd\x00hyprspinternal"))),
+			netip.AddrFrom16(internal),
 		},
 		[]netip.Addr{},
-		1420,
+		cfg.MTU,
 	)
 	if err != nil {
 		panic(err)
@@ -100,7 +153,7 @@ func NewServiceNetwork(host host.Host, cfg *config.Config, tunDev *hstun.TUN) Se
 
 	go func() {
 		sizes := make([]int, 1)
-		buffer := make([]byte, 1420)
+		buffer := make([]byte, cfg.MTU)
 		buffers := make([][]byte, 1)
 		buffers[0] = buffer
 		for {
@@ -119,19 +172,16 @@ func NewServiceNetwork(host host.Host, cfg *config.Config, tunDev *hstun.TUN) Se
 
 	fmt.Println("[+] Service Network ready")
 
-	sn := ServiceNetwork{
-		host:   host,
-		config: cfg,
-		self:   [4]byte(cfg.BuiltinAddr6[12:16]),
-		NetworkRange: net.IPNet{
-			IP:   []byte("\xfd\x00hyprspsv\x00\x00\x00\x00\x00\x00"),
-			Mask: net.CIDRMask(80, 128),
-		},
-		Tun:         &tun,
-		netx:        netx,
-		activeAddrs: make(map[[16]byte]struct{}),
-		activePorts: make(map[[16]byte]map[uint16]struct{}),
-		listeners:   make(map[[2]byte]Proxy),
+	sn := &ServiceNetwork{
+		host:         host,
+		config:       cfg,
+		self:         config.MkNetID(host.ID()),
+		NetworkRange: cfg.ServiceNet,
+		Tun:          &tun,
+		netx:         netx,
+		activeAddrs:  make(map[[16]byte]struct{}),
+		activePorts:  make(map[[16]byte]map[uint16]net.Listener),
+		listeners:    make(map[[2]byte]Proxy),
 	}
 
 	host.SetStreamHandler(Protocol, sn.streamHandler())
@@ -75,6 +75,7 @@ type RemoteServiceProxyStatus byte
 const (
 	RS_OK            RemoteServiceProxyStatus = 0xf1
 	RS_NOT_SUPPORTED RemoteServiceProxyStatus = 0xf2
+	RS_DENIED        RemoteServiceProxyStatus = 0xf3
 )
 
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
@@ -99,6 +100,9 @@ func RemoteServiceProxy(host host.Host, p peer.ID, svcId [2]byte) Proxy {
 			if err != nil {
 				fmt.Printf("[!] [svc] %s\n", err)
 				return
+			} else if buf[0] == byte(RS_DENIED) {
+				fmt.Printf("[!] [svc] Peer %s denied access to service %x\n", p, svcId)
+				return
 			} else if buf[0] != byte(RS_OK) {
 				fmt.Printf("[!] [svc] Peer %s does not support service %x\n", p, svcId)
 				return
@@ -10,7 +10,10 @@ import (
 // -----------------------------------------------------------------------------------------------------------------------------------------------------
 func (sn *ServiceNetwork) streamHandler() func(network.Stream) {
 	return func(stream network.Stream) {
-		if _, ok := config.FindPeer(sn.config.Peers, stream.Conn().RemotePeer()); !ok {
+		sn.config.RLock()
+		p, ok := config.FindPeer(sn.config.Peers, stream.Conn().RemotePeer())
+		sn.config.RUnlock()
+		if !ok {
 			stream.Reset()
 			return
 		}
@@ -22,7 +25,18 @@ func (sn *ServiceNetwork) streamHandler() func(network.Stream) {
 			return
 		}
 		svcId := [2]byte(buf)
-		if proxy, ok := sn.listeners[svcId]; ok {
+		sn.config.RLock()
+		allowed := sn.config.MayUseService(svcId, *p)
+		sn.config.RUnlock()
+		if !allowed {
+			fmt.Printf("[!] [svc] %s is not allowed to connect to service %x\n", p.Name, svcId)
+			_, _ = stream.Write([]byte{byte(RS_DENIED)})
+			return
+		}
+		sn.lock.Lock()
+		proxy, ok := sn.listeners[svcId]
+		sn.lock.Unlock()
+		if ok {
 			_, err := stream.Write([]byte{byte(RS_OK)})
 			if err != nil {
 				fmt.Printf("[!] [svc] %s\n", err)